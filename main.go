@@ -26,18 +26,68 @@
 package main
 
 import (
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 
 	"github.com/joshb/pi-camera-go/server"
+	"github.com/joshb/pi-camera-go/server/aggregator"
+	"github.com/joshb/pi-camera-go/server/storage"
+	"github.com/joshb/pi-camera-go/server/util"
 )
 
 func main() {
 	address := flag.String("address", "localhost:10042", "The address (including port) to bind to")
 	useHTTPS := flag.Bool("https", false, "Use HTTPS")
+	configPath := flag.String("config", "", "The configuration file to use")
+	quarantine := flag.Bool("quarantine", false, "Quarantine corrupt segments (verify command)")
+	certPath := flag.String("cert", "", "The certificate to check signed manifests with (verify-export command)")
+	flag.Usage = usage
 	flag.Parse()
 
-	s, err := server.New(*useHTTPS)
+	config, err := server.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Println("Unable to load configuration:", err)
+		return
+	}
+	if *useHTTPS {
+		config.HTTPS = true
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "verify":
+		if err := verify(config, *quarantine); err != nil {
+			fmt.Println("Unable to verify segments:", err)
+			os.Exit(1)
+		}
+		return
+	case "verify-export":
+		if err := verifyExport(flag.Arg(1), *certPath); err != nil {
+			fmt.Println("Unable to verify export:", err)
+			os.Exit(1)
+		}
+		return
+	case "aggregate":
+		a, err := aggregator.New(config.Aggregator, config.HTTPS)
+		if err != nil {
+			fmt.Println("Unable to create aggregator:", err)
+			return
+		}
+		if err := a.Start(*address); err != nil {
+			fmt.Println("Unable to start aggregator:", err)
+		}
+		return
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	s, err := server.New(config)
 	if err != nil {
 		fmt.Println("Unable to create server:", err)
 		return
@@ -47,3 +97,101 @@ func main() {
 		fmt.Println("Unable to start server:", err)
 	}
 }
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintln(flag.CommandLine.Output(), "Commands:")
+	fmt.Fprintln(flag.CommandLine.Output(), "  verify    Re-hash stored segments and report corrupt ones")
+	fmt.Fprintln(flag.CommandLine.Output(), "            (stop the server first, or use POST /api/verify)")
+	fmt.Fprintln(flag.CommandLine.Output(), "  verify-export <file>")
+	fmt.Fprintln(flag.CommandLine.Output(), "            Check an exported tar archive against its hash chain")
+	fmt.Fprintln(flag.CommandLine.Output(), "            and signed manifests")
+	fmt.Fprintln(flag.CommandLine.Output(), "  aggregate Serve the cameras of other nodes under one origin")
+	fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func verify(config server.Config, quarantine bool) error {
+	cameras, err := config.CameraConfigs()
+	if err != nil {
+		return err
+	}
+
+	total, failed := 0, 0
+	for _, camera := range cameras {
+		s, err := storage.New(*camera.Storage, camera.Namespace())
+		if err != nil {
+			return err
+		}
+
+		results, err := s.Verify(quarantine)
+		if err != nil {
+			return err
+		}
+
+		for _, result := range results {
+			if result.Status == storage.VerifyOK {
+				continue
+			}
+
+			fmt.Println(path.Join(camera.Namespace(), result.Segment.Name)+":", result.Status, result.Error)
+			if result.Quarantined {
+				fmt.Println("  moved to quarantine")
+			}
+			if result.Status != storage.VerifyNoChecksum {
+				failed++
+			}
+		}
+		total += len(results)
+	}
+
+	fmt.Println("Verified", total, "segments,", failed, "failed")
+	if failed != 0 {
+		return fmt.Errorf("%d segments failed verification", failed)
+	}
+
+	return nil
+}
+
+func verifyExport(exportPath, certPath string) error {
+	if len(exportPath) == 0 {
+		return errors.New("no export file given")
+	}
+
+	var cert *x509.Certificate
+	if len(certPath) != 0 {
+		b, err := ioutil.ReadFile(certPath)
+		if err != nil {
+			return err
+		}
+		cert, err = util.ParseCertificate(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(exportPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	report, err := storage.VerifyExport(file, cert)
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range report.Warnings {
+		fmt.Println("Warning:", warning)
+	}
+	for _, problem := range report.Problems {
+		fmt.Println("Problem:", problem)
+	}
+
+	fmt.Println("Checked", report.Segments, "segments,", report.Signed, "covered by signed manifests")
+	if !report.OK() {
+		return fmt.Errorf("%d problems found", len(report.Problems))
+	}
+
+	return nil
+}
@@ -0,0 +1,417 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package aggregator
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/util"
+)
+
+const (
+	apiNodesPath = "/api/nodes"
+	nodesPrefix  = "/nodes/"
+
+	defaultPollInterval = 10 * time.Second
+	pollTimeout         = 5 * time.Second
+)
+
+var nodeNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type Aggregator interface {
+	Start(addr string) error
+}
+
+// NodeStatus is the last known status of a node.
+type NodeStatus struct {
+	Name       string         `json:"name"`
+	URL        string         `json:"url"`
+	Discovered bool           `json:"discovered"`
+	Online     bool           `json:"online"`
+	LastSeen   *time.Time     `json:"lastSeen,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Cameras    []CameraStatus `json:"cameras"`
+}
+
+// CameraStatus is the status of a camera as reported by its node, with
+// the camera's URL on the aggregator.
+type CameraStatus struct {
+	Name          string     `json:"name"`
+	URL           string     `json:"url"`
+	Recording     bool       `json:"recording"`
+	Profile       string     `json:"profile"`
+	LatestSegment *time.Time `json:"latestSegment,omitempty"`
+}
+
+type node struct {
+	name       string
+	url        *url.URL
+	discovered bool
+	proxy      *httputil.ReverseProxy
+	status     NodeStatus
+}
+
+type aggregatorImpl struct {
+	config         Config
+	privateKeyPath string
+	publicKeyPath  string
+	transport      http.RoundTripper
+	client         *http.Client
+
+	nodes map[string]*node
+	mutex *sync.Mutex
+}
+
+func New(config Config, https bool) (Aggregator, error) {
+	if config.Discover && len(config.DiscoveryKey) == 0 {
+		return nil, errors.New("aggregator discovery requires a discoveryKey")
+	}
+
+	var privateKeyPath, publicKeyPath string
+	if https {
+		var err error
+		privateKeyPath, publicKeyPath, err = util.KeyPaths()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	a := &aggregatorImpl{
+		config:         config,
+		privateKeyPath: privateKeyPath,
+		publicKeyPath:  publicKeyPath,
+		transport:      transport,
+		client:         &http.Client{Transport: transport, Timeout: pollTimeout},
+		nodes:          make(map[string]*node),
+		mutex:          &sync.Mutex{},
+	}
+
+	for _, nodeConfig := range config.Nodes {
+		if err := a.addNode(nodeConfig.Name, nodeConfig.URL, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+func (a *aggregatorImpl) Start(addr string) error {
+	if len(a.config.Username) == 0 {
+		fmt.Println("No aggregator username is set; access is not restricted")
+	}
+
+	if a.config.Discover {
+		go a.discover()
+	}
+	go a.pollLoop()
+
+	println("Starting aggregator at address", addr)
+	if len(a.publicKeyPath) != 0 && len(a.privateKeyPath) != 0 {
+		return http.ListenAndServeTLS(addr, a.publicKeyPath, a.privateKeyPath, a)
+	} else {
+		return http.ListenAndServe(addr, a)
+	}
+}
+
+// addNode adds a node, or changes the URL of a discovered node. Configured
+// nodes are never changed by discovery.
+func (a *aggregatorImpl) addNode(name, rawURL string, discovered bool) error {
+	if !nodeNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid node name %q", name)
+	}
+
+	nodeURL, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return err
+	}
+	if nodeURL.Scheme != "http" && nodeURL.Scheme != "https" {
+		return fmt.Errorf("unsupported node URL: %s", rawURL)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if existing, ok := a.nodes[name]; ok {
+		if !discovered {
+			return fmt.Errorf("duplicate node name %q", name)
+		}
+		if !existing.discovered || existing.url.String() == nodeURL.String() {
+			return nil
+		}
+	}
+
+	if discovered {
+		println("Discovered node", name, "at", nodeURL.String())
+	}
+
+	n := &node{
+		name:       name,
+		url:        nodeURL,
+		discovered: discovered,
+		status: NodeStatus{
+			Name:       name,
+			URL:        nodeURL.String(),
+			Discovered: discovered,
+			Cameras:    []CameraStatus{},
+		},
+	}
+	n.proxy = a.newProxy(n)
+	a.nodes[name] = n
+
+	return nil
+}
+
+// newProxy creates a proxy that passes requests for /nodes/{name}/... to
+// the node.
+func (a *aggregatorImpl) newProxy(n *node) *httputil.ReverseProxy {
+	prefix := nodesPrefix + n.name
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = n.url.Scheme
+			req.URL.Host = n.url.Host
+			req.URL.Path = n.url.Path + strings.TrimPrefix(req.URL.Path, prefix)
+			req.URL.RawPath = ""
+			req.Host = n.url.Host
+
+			// The aggregator's credentials are not meant for the node.
+			req.Header.Del("Authorization")
+		},
+		Transport: a.transport,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			http.Error(w, "node "+n.name+" is unavailable: "+err.Error(), http.StatusBadGateway)
+		},
+	}
+}
+
+func (a *aggregatorImpl) pollLoop() {
+	interval := defaultPollInterval
+	if a.config.PollInterval > 0 {
+		interval = time.Duration(a.config.PollInterval) * time.Second
+	}
+
+	for {
+		a.pollNodes()
+		time.Sleep(interval)
+	}
+}
+
+// pollNodes checks the status of every node at once.
+func (a *aggregatorImpl) pollNodes() {
+	a.mutex.Lock()
+	nodes := make([]*node, 0, len(a.nodes))
+	for _, n := range a.nodes {
+		nodes = append(nodes, n)
+	}
+	a.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+
+			cameras, err := a.fetchCameras(n)
+
+			a.mutex.Lock()
+			defer a.mutex.Unlock()
+			if err != nil {
+				n.status.Online = false
+				n.status.Error = err.Error()
+				return
+			}
+
+			now := time.Now()
+			n.status.Online = true
+			n.status.LastSeen = &now
+			n.status.Error = ""
+			n.status.Cameras = cameras
+		}(n)
+	}
+	wg.Wait()
+}
+
+// fetchCameras asks a node for the status of its cameras.
+func (a *aggregatorImpl) fetchCameras(n *node) ([]CameraStatus, error) {
+	resp, err := a.client.Get(n.url.String() + "/api/cameras")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status: " + resp.Status)
+	}
+
+	var cameras []CameraStatus
+	if err := json.NewDecoder(resp.Body).Decode(&cameras); err != nil {
+		return nil, err
+	}
+
+	for i := range cameras {
+		cameras[i].URL = nodesPrefix + n.name + "/cameras/" + cameras[i].Name + "/"
+	}
+
+	return cameras, nil
+}
+
+// nodeStatuses returns the status of every node, sorted by name.
+func (a *aggregatorImpl) nodeStatuses() []NodeStatus {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	statuses := make([]NodeStatus, 0, len(a.nodes))
+	for _, n := range a.nodes {
+		statuses = append(statuses, n.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
+
+// authorized checks the request's credentials, if the aggregator has any.
+func (a *aggregatorImpl) authorized(req *http.Request) bool {
+	if len(a.config.Username) == 0 {
+		return true
+	}
+
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(a.config.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.config.Password)) == 1
+	return usernameOK && passwordOK
+}
+
+func (a *aggregatorImpl) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !a.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pi-camera-go"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if req.URL.Path == "/" {
+		a.serveStatusPage(w, req)
+	} else if req.URL.Path == apiNodesPath {
+		a.serveNodes(w, req)
+	} else if strings.HasPrefix(req.URL.Path, nodesPrefix) {
+		a.serveNode(w, req)
+	} else {
+		http.NotFound(w, req)
+	}
+}
+
+func (a *aggregatorImpl) serveNodes(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.nodeStatuses())
+}
+
+// serveNode proxies a request for /nodes/{name}/... to the node.
+func (a *aggregatorImpl) serveNode(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, nodesPrefix)
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+
+	a.mutex.Lock()
+	n, ok := a.nodes[name]
+	a.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	n.proxy.ServeHTTP(w, req)
+}
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pi-camera-go nodes</title>
+</head>
+<body>
+<h1>Nodes</h1>
+<table>
+<tr><th>Node</th><th>Status</th><th>Last seen</th><th>Camera</th><th>Recording</th><th>Latest segment</th><th></th></tr>
+{{range .}}{{$node := .}}
+{{if .Cameras}}{{range .Cameras}}
+<tr>
+<td>{{$node.Name}}</td>
+<td>{{if $node.Online}}online{{else}}offline{{end}}</td>
+<td>{{if $node.LastSeen}}{{$node.LastSeen.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{.Name}}</td>
+<td>{{if .Recording}}yes{{else}}no{{end}}</td>
+<td>{{if .LatestSegment}}{{.LatestSegment.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td><a href="{{.URL}}live.m3u8">live</a></td>
+</tr>
+{{end}}{{else}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{if .Online}}online{{else}}offline{{end}}{{if .Error}}: {{.Error}}{{end}}</td>
+<td>{{if .LastSeen}}{{.LastSeen.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td colspan="4"></td>
+</tr>
+{{end}}
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+func (a *aggregatorImpl) serveStatusPage(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPageTemplate.Execute(w, a.nodeStatuses()); err != nil {
+		fmt.Println("Unable to write status page:", err)
+	}
+}
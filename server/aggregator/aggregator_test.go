@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package aggregator
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestAggregator(t *testing.T, config Config) *aggregatorImpl {
+	t.Helper()
+	a, err := New(config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.(*aggregatorImpl)
+}
+
+func nodeURL(a *aggregatorImpl, name string) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if n, ok := a.nodes[name]; ok {
+		return n.url.String()
+	}
+	return ""
+}
+
+func TestAddNode(t *testing.T) {
+	a := newTestAggregator(t, Config{Nodes: []NodeConfig{{Name: "shed", URL: "https://192.168.1.20:10042/"}}})
+	if url := nodeURL(a, "shed"); url != "https://192.168.1.20:10042" {
+		t.Errorf("got URL %q for a configured node", url)
+	}
+
+	for _, test := range []struct {
+		name, url string
+	}{
+		{"", "http://192.168.1.21:10042"},
+		{"../shed", "http://192.168.1.21:10042"},
+		{"garage", "ftp://192.168.1.21"},
+		{"garage", "://"},
+	} {
+		if err := a.addNode(test.name, test.url, true); err == nil {
+			t.Errorf("added node %q at %q", test.name, test.url)
+		}
+	}
+
+	// Configured nodes cannot be added twice, nor moved by discovery.
+	if err := a.addNode("shed", "http://192.168.1.21:10042", false); err == nil {
+		t.Error("added a configured node twice")
+	}
+	if err := a.addNode("shed", "http://192.168.1.21:10042", true); err != nil {
+		t.Fatal(err)
+	}
+	if url := nodeURL(a, "shed"); url != "https://192.168.1.20:10042" {
+		t.Errorf("discovery moved a configured node to %q", url)
+	}
+
+	// Discovered nodes follow their announcements.
+	if err := a.addNode("garage", "http://192.168.1.22:10042", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.addNode("garage", "http://192.168.1.23:10042", true); err != nil {
+		t.Fatal(err)
+	}
+	if url := nodeURL(a, "garage"); url != "http://192.168.1.23:10042" {
+		t.Errorf("got URL %q for a discovered node", url)
+	}
+
+	if _, err := New(Config{Nodes: []NodeConfig{{Name: "shed", URL: "http://a"}, {Name: "shed", URL: "http://b"}}}, false); err == nil {
+		t.Error("created an aggregator with duplicate nodes")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var got *http.Request
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req
+		w.Write([]byte("playlist"))
+	}))
+	defer node.Close()
+
+	a := newTestAggregator(t, Config{
+		Username: "admin",
+		Password: "secret",
+		Nodes:    []NodeConfig{{Name: "shed", URL: node.URL + "/base"}},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/nodes/shed/cameras/front/live.m3u8?_HLS_msn=3", nil)
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != "playlist" {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	if got.URL.Path != "/base/cameras/front/live.m3u8" || got.URL.RawQuery != "_HLS_msn=3" {
+		t.Errorf("node got request for %s", got.URL)
+	}
+	if len(got.Header.Get("Authorization")) != 0 {
+		t.Error("the aggregator's credentials were passed to the node")
+	}
+
+	// Unknown nodes are not found, and unavailable ones are reported.
+	req = httptest.NewRequest(http.MethodGet, "/nodes/garage/cameras/front/live.m3u8", nil)
+	req.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d for an unknown node", w.Code)
+	}
+
+	node.Close()
+	req = httptest.NewRequest(http.MethodGet, "/nodes/shed/cameras/front/live.m3u8", nil)
+	req.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got %d for an unavailable node", w.Code)
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	a := newTestAggregator(t, Config{})
+	if !a.authorized(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Error("request was refused without credentials configured")
+	}
+
+	a = newTestAggregator(t, Config{Username: "admin", Password: "secret"})
+	for _, test := range []struct {
+		username, password string
+		setAuth            bool
+		want               bool
+	}{
+		{"", "", false, false},
+		{"admin", "secret", true, true},
+		{"admin", "wrong", true, false},
+		{"other", "secret", true, false},
+		{"admin", "", true, false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/nodes", nil)
+		if test.setAuth {
+			req.SetBasicAuth(test.username, test.password)
+		}
+		if got := a.authorized(req); got != test.want {
+			t.Errorf("authorized(%q, %q) = %t, want %t", test.username, test.password, got, test.want)
+		}
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, req)
+		if !test.want && (w.Code != http.StatusUnauthorized || len(w.Header().Get("WWW-Authenticate")) == 0) {
+			t.Errorf("got %d for a request with %q, %q", w.Code, test.username, test.password)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/nodes", nil)
+	req.SetBasicAuth("admin", "secret")
+	a.ServeHTTP(w, req)
+	if b, _ := ioutil.ReadAll(w.Body); w.Code != http.StatusOK || string(b) != "[]\n" {
+		t.Errorf("got %d %q", w.Code, b)
+	}
+}
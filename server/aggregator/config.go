@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package aggregator
+
+// Config configures aggregator mode, in which the server federates the
+// cameras of many pi-camera-go nodes under a single origin.
+type Config struct {
+	// Nodes are the nodes to aggregate. If Discover is set, nodes that
+	// announce themselves on the local network are added as well, as
+	// long as their announcements are signed with DiscoveryKey, which
+	// must be set to the nodes' announceKey.
+	Nodes        []NodeConfig `json:"nodes"`
+	Discover     bool         `json:"discover"`
+	DiscoveryKey string       `json:"discoveryKey"`
+
+	// Username and Password are required to access the aggregator if
+	// they are set.
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// PollInterval is the number of seconds between checks of each
+	// node's status. It defaults to 10.
+	PollInterval int `json:"pollInterval"`
+
+	// InsecureSkipVerify accepts any certificate from the nodes, which
+	// is needed for nodes that use the generated self-signed
+	// certificate.
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+}
+
+// NodeConfig names a node and gives its base URL, for example
+// "https://192.168.1.20:10042".
+type NodeConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package aggregator
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DiscoveryPort is the UDP port that nodes announce themselves on.
+	DiscoveryPort = 10043
+
+	announceInterval = 10 * time.Second
+
+	// maxAnnouncementAge is how far the time of an announcement may be
+	// from the aggregator's clock, which allows for clock skew between
+	// machines without a real-time clock.
+	maxAnnouncementAge = 5 * time.Minute
+)
+
+// announcement is broadcast by nodes so that aggregators can find them.
+// MAC is an HMAC-SHA256 of the other fields and the address that the
+// announcement is sent from, keyed with the key shared by the nodes and
+// aggregators, so that other hosts cannot announce themselves as a node.
+type announcement struct {
+	Name  string `json:"name"`
+	Port  int    `json:"port"`
+	HTTPS bool   `json:"https"`
+	Time  int64  `json:"time"`
+	MAC   string `json:"mac"`
+}
+
+// sign returns the announcement's MAC for the given sender address.
+func (msg announcement) sign(key string, ip net.IP) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%d\n%t\n%d\n%s", msg.Name, msg.Port, msg.HTTPS, msg.Time, ip)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the announcement's MAC and time.
+func (msg announcement) verify(key string, ip net.IP, now time.Time) error {
+	want, err := hex.DecodeString(msg.sign(key, ip))
+	if err != nil {
+		return err
+	}
+	got, err := hex.DecodeString(msg.MAC)
+	if err != nil || !hmac.Equal(got, want) {
+		return errors.New("invalid announcement signature")
+	}
+
+	age := now.Sub(time.Unix(msg.Time, 0))
+	if age > maxAnnouncementAge || age < -maxAnnouncementAge {
+		return errors.New("announcement is too old")
+	}
+
+	return nil
+}
+
+// Announce broadcasts the node's name and port on the local network at a
+// regular interval, signed with the key shared with the aggregators. It
+// never returns.
+func Announce(name string, port int, https bool, key string) {
+	msg := announcement{Name: name, Port: port, HTTPS: https}
+	addr := &net.UDPAddr{IP: net.IPv4bcast, Port: DiscoveryPort}
+	for {
+		if err := broadcast(addr, msg, key); err != nil {
+			fmt.Println("Unable to announce node:", err)
+		}
+
+		time.Sleep(announceInterval)
+	}
+}
+
+func broadcast(addr *net.UDPAddr, msg announcement, key string) error {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The signature covers the address that the announcement is sent
+	// from, so that it cannot be replayed by another host.
+	msg.Time = time.Now().Unix()
+	msg.MAC = msg.sign(key, conn.LocalAddr().(*net.UDPAddr).IP)
+	b, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(b)
+	return err
+}
+
+// discover listens for announcements and adds the nodes that send them.
+func (a *aggregatorImpl) discover() {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: DiscoveryPort})
+	if err != nil {
+		fmt.Println("Unable to listen for node announcements:", err)
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Println("Unable to read node announcement:", err)
+			return
+		}
+
+		if err := a.announcementReceived(buf[:n], addr, time.Now()); err != nil {
+			fmt.Println("Ignoring node announcement from", addr.IP.String()+":", err)
+		}
+	}
+}
+
+// announcementReceived adds the node that sent an announcement, if the
+// announcement is signed with the discovery key.
+func (a *aggregatorImpl) announcementReceived(b []byte, addr *net.UDPAddr, now time.Time) error {
+	var msg announcement
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return err
+	}
+	if len(msg.Name) == 0 || msg.Port <= 0 || msg.Port > 65535 {
+		return errors.New("invalid announcement")
+	}
+	if err := msg.verify(a.config.DiscoveryKey, addr.IP, now); err != nil {
+		return err
+	}
+
+	scheme := "http"
+	if msg.HTTPS {
+		scheme = "https"
+	}
+	nodeURL := fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(addr.IP.String(), fmt.Sprint(msg.Port)))
+	return a.addNode(msg.Name, nodeURL, true)
+}
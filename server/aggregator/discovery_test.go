@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package aggregator
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+const testDiscoveryKey = "discovery key"
+
+func signedAnnouncement(t *testing.T, name string, key string, ip net.IP, sent time.Time) []byte {
+	t.Helper()
+	msg := announcement{Name: name, Port: 10042, HTTPS: true, Time: sent.Unix()}
+	msg.MAC = msg.sign(key, ip)
+	b, err := json.Marshal(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestDiscoveryRequiresKey(t *testing.T) {
+	if _, err := New(Config{Discover: true}, false); err == nil {
+		t.Error("created an aggregator that discovers nodes without a key")
+	}
+}
+
+func TestAnnouncementReceived(t *testing.T) {
+	a := newTestAggregator(t, Config{Discover: true, DiscoveryKey: testDiscoveryKey})
+	now := time.Now()
+	node := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 50000}
+	other := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 66), Port: 50000}
+
+	if err := a.announcementReceived(signedAnnouncement(t, "shed", testDiscoveryKey, node.IP, now), node, now); err != nil {
+		t.Fatal(err)
+	}
+	if url := nodeURL(a, "shed"); url != "https://192.168.1.20:10042" {
+		t.Fatalf("got URL %q for a discovered node", url)
+	}
+
+	for _, test := range []struct {
+		description string
+		b           []byte
+		addr        *net.UDPAddr
+	}{
+		{"an unsigned announcement", []byte(`{"name":"shed","port":10042}`), other},
+		{"an announcement with another key", signedAnnouncement(t, "shed", "wrong key", other.IP, now), other},
+		{"a replayed announcement", signedAnnouncement(t, "shed", testDiscoveryKey, node.IP, now), other},
+		{"an old announcement", signedAnnouncement(t, "shed", testDiscoveryKey, other.IP, now.Add(-time.Hour)), other},
+		{"an invalid announcement", []byte("shed"), other},
+	} {
+		if err := a.announcementReceived(test.b, test.addr, now); err == nil {
+			t.Errorf("accepted %s", test.description)
+		}
+	}
+	if url := nodeURL(a, "shed"); url != "https://192.168.1.20:10042" {
+		t.Errorf("node was moved to %q", url)
+	}
+
+	// A node that has moved announces its new address.
+	if err := a.announcementReceived(signedAnnouncement(t, "shed", testDiscoveryKey, other.IP, now), other, now); err != nil {
+		t.Fatal(err)
+	}
+	if url := nodeURL(a, "shed"); url != "https://192.168.1.66:10042" {
+		t.Errorf("got URL %q for a node that moved", url)
+	}
+}
@@ -0,0 +1,467 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+	"github.com/joshb/pi-camera-go/server/schedule"
+	"github.com/joshb/pi-camera-go/server/storage"
+)
+
+const apiPrefix = "/api/"
+
+// serveAPI serves the server-wide API routes and passes the others to the
+// default camera.
+func (s *serverImpl) serveAPI(w http.ResponseWriter, req *http.Request) {
+	route := strings.TrimPrefix(req.URL.Path, apiPrefix)
+	if route == "ingest" || strings.HasPrefix(route, "ingest/") {
+		s.ingest.serveAPI(w, req, strings.TrimPrefix(strings.TrimPrefix(route, "ingest"), "/"))
+		return
+	}
+
+	switch route {
+	case "cameras":
+		s.serveCameras(w, req)
+	case "recorder/devices":
+		s.serveDevices(w, req)
+	default:
+		s.cameras[0].serveAPI(w, req, route)
+	}
+}
+
+// serveAPI serves the API routes of a camera.
+func (c *camera) serveAPI(w http.ResponseWriter, req *http.Request, route string) {
+	if strings.HasPrefix(route, "annotations/") {
+		c.serveAnnotation(w, req, strings.TrimPrefix(route, "annotations/"))
+		return
+	}
+
+	switch route {
+	case "verify":
+		c.serveVerify(w, req)
+	case "export":
+		c.serveExport(w, req)
+	case "pins":
+		c.servePins(w, req)
+	case "annotations":
+		c.serveAnnotations(w, req)
+	case "schedule":
+		c.serveSchedule(w, req)
+	case "schedule/override":
+		c.serveScheduleOverride(w, req)
+	case "recorder/profiles":
+		c.serveProfiles(w, req)
+	case "recorder/profile":
+		c.serveProfile(w, req)
+	case "recorder/settings":
+		c.serveRecorderSettings(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// timeRange parses the start and end query parameters, given in seconds
+// since the Unix epoch. The end defaults to the current time and the start
+// to an hour earlier.
+func timeRange(req *http.Request) (time.Time, time.Time, error) {
+	end := time.Now()
+	if value := req.URL.Query().Get("end"); len(value) != 0 {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid end time: %s", value)
+		}
+		end = time.Unix(seconds, 0)
+	}
+
+	start := end.Add(-time.Hour)
+	if value := req.URL.Query().Get("start"); len(value) != 0 {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid start time: %s", value)
+		}
+		start = time.Unix(seconds, 0)
+	}
+
+	return start, end, nil
+}
+
+// serveVerify re-hashes all stored segments. If the quarantine query
+// parameter is set, corrupt segments are quarantined.
+func (c *camera) serveVerify(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	quarantine, _ := strconv.ParseBool(req.URL.Query().Get("quarantine"))
+	results, err := c.storage.Verify(quarantine)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+// serveExport responds with a tar archive of the segments in the requested
+// time range.
+func (c *camera) serveExport(w http.ResponseWriter, req *http.Request) {
+	start, end, err := timeRange(req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(c.storage.SegmentsInRange(start, end)) == 0 {
+		writeJSONError(w, http.StatusNotFound, errors.New("no segments in range"))
+		return
+	}
+
+	fileName := fmt.Sprintf("export_%d_%d.tar", start.Unix(), end.Unix())
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", "attachment; filename="+fileName)
+	if err := c.storage.Export(w, start, end); err != nil {
+		// Part of the archive may have been sent already, so all that
+		// can be done is to log the error.
+		fmt.Println("Error when exporting segments:", err)
+	}
+}
+
+// servePins lists pinned segments (GET), pins the segments in a time range
+// (POST) or unpins them (DELETE). A pin expires at the time given by the
+// until query parameter, if any.
+func (c *camera) servePins(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, c.storage.PinStatus())
+		return
+	} else if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	if len(query.Get("start")) == 0 || len(query.Get("end")) == 0 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("start and end are required"))
+		return
+	}
+	start, end, err := timeRange(req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		count, err := c.storage.Unpin(start, end)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]int{"unpinned": count})
+		return
+	}
+
+	var until time.Time
+	if value := query.Get("until"); len(value) != 0 {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid until time: %s", value))
+			return
+		}
+		until = time.Unix(seconds, 0)
+	}
+
+	count, err := c.storage.Pin(start, end, until)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status := c.storage.PinStatus()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pinned":     count,
+		"overBudget": status.OverBudget,
+	})
+}
+
+// serveAnnotations searches annotations (GET) or creates one (POST). The
+// search is controlled by the start, end, q, author and tag query
+// parameters.
+func (c *camera) serveAnnotations(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		query := req.URL.Query()
+		annotationQuery := storage.AnnotationQuery{
+			Text:   query.Get("q"),
+			Author: query.Get("author"),
+			Tag:    query.Get("tag"),
+		}
+		if len(query.Get("start")) != 0 || len(query.Get("end")) != 0 {
+			start, end, err := timeRange(req)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			annotationQuery.Start, annotationQuery.End = start, end
+		}
+
+		writeJSON(w, http.StatusOK, c.storage.SearchAnnotations(annotationQuery))
+	case http.MethodPost:
+		var annotation storage.Annotation
+		if err := json.NewDecoder(req.Body).Decode(&annotation); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		annotation, err := c.storage.AddAnnotation(annotation)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, annotation)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveAnnotation gets (GET), replaces (PUT) or deletes (DELETE) a single
+// annotation.
+func (c *camera) serveAnnotation(w http.ResponseWriter, req *http.Request, idString string) {
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	annotationID := storage.AnnotationID(id)
+
+	var annotation storage.Annotation
+	switch req.Method {
+	case http.MethodGet:
+		annotation, err = c.storage.Annotation(annotationID)
+	case http.MethodPut:
+		if err := json.NewDecoder(req.Body).Decode(&annotation); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		annotation.ID = annotationID
+		annotation, err = c.storage.UpdateAnnotation(annotation)
+	case http.MethodDelete:
+		err = c.storage.DeleteAnnotation(annotationID)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err == storage.ErrAnnotationNotFound {
+		writeJSONError(w, http.StatusNotFound, err)
+	} else if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+	} else {
+		writeJSON(w, http.StatusOK, annotation)
+	}
+}
+
+// serveSchedule responds with the recording schedule and its state.
+func (c *camera) serveSchedule(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c.scheduler.Status())
+}
+
+// serveScheduleOverride forces recording on or off for a number of seconds
+// (POST) or returns to the schedule (DELETE).
+func (c *camera) serveScheduleOverride(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		var body struct {
+			Record   bool `json:"record"`
+			Duration int  `json:"duration"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if body.Duration <= 0 {
+			writeJSONError(w, http.StatusBadRequest, errors.New("duration must be positive"))
+			return
+		}
+
+		c.scheduler.SetOverride(body.Record, time.Duration(body.Duration)*time.Second)
+	case http.MethodDelete:
+		c.scheduler.ClearOverride()
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c.scheduler.Status())
+}
+
+// serveProfiles lists the available recorder profiles.
+func (c *camera) serveProfiles(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	profiles := []recorder.Profile{recorder.DefaultProfile}
+	for _, profile := range c.config.Profiles {
+		if profile.Name != recorder.DefaultProfile.Name {
+			profiles = append(profiles, profile)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, profiles)
+}
+
+// serveProfile responds with the current recorder profile (GET) or
+// switches to the named profile (PUT). A profile selected here stays in
+// place until the schedule next changes profiles.
+func (c *camera) serveProfile(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		profile, err := schedule.FindProfile(c.config.Profiles, body.Name)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := c.recorder.SetProfile(profile); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c.recorder.Profile())
+}
+
+// serveRecorderSettings returns or changes the recorder's configured
+// settings. Settings that are left out of a PUT request keep their current
+// values.
+func (c *camera) serveRecorderSettings(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		settings := c.recorder.Settings()
+		if err := json.NewDecoder(req.Body).Decode(&settings); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := settings.Validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := c.recorder.Configure(settings); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c.recorder.Settings())
+}
+
+// serveDevices lists the video devices that the v4l2 backend can capture
+// from, with their capabilities.
+func (s *serverImpl) serveDevices(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	devices, err := recorder.ListDevices()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, devices)
+}
+
+// serveCameras lists the cameras and whether they are recording.
+func (s *serverImpl) serveCameras(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cameras := make([]cameraStatus, 0, len(s.cameras))
+	for _, c := range s.cameras {
+		cameras = append(cameras, c.status())
+	}
+
+	writeJSON(w, http.StatusOK, cameras)
+}
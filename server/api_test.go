@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/storage"
+)
+
+// exportStorage is a storage stand-in for the export API.
+type exportStorage struct {
+	storage.Storage
+	segments []storage.Segment
+	exported bool
+}
+
+func (s *exportStorage) SegmentsInRange(start, end time.Time) []storage.Segment {
+	return s.segments
+}
+
+func (s *exportStorage) Export(w io.Writer, start, end time.Time) error {
+	s.exported = true
+	_, err := w.Write([]byte("archive"))
+	return err
+}
+
+func TestServeExport(t *testing.T) {
+	s := &exportStorage{}
+	c := &camera{storage: s}
+
+	w := httptest.NewRecorder()
+	c.serveExport(w, httptest.NewRequest(http.MethodGet, "/api/export?start=1500000000&end=1500003600", nil))
+	var body map[string]string
+	if w.Code != http.StatusNotFound || json.Unmarshal(w.Body.Bytes(), &body) != nil || len(body["error"]) == 0 {
+		t.Errorf("got %d %q for an empty range", w.Code, w.Body.String())
+	}
+	if len(w.Header().Get("Content-Disposition")) != 0 || s.exported {
+		t.Error("started an export for an empty range")
+	}
+
+	s.segments = []storage.Segment{{ID: 1, Name: "segment_1500000000_5000_1.ts"}}
+	w = httptest.NewRecorder()
+	c.serveExport(w, httptest.NewRequest(http.MethodGet, "/api/export?start=1500000000&end=1500003600", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "archive" {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Disposition") != "attachment; filename=export_1500000000_1500003600.tar" {
+		t.Errorf("got Content-Disposition %q", w.Header().Get("Content-Disposition"))
+	}
+}
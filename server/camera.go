@@ -0,0 +1,262 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/live"
+	"github.com/joshb/pi-camera-go/server/mjpeg"
+	"github.com/joshb/pi-camera-go/server/recorder"
+	"github.com/joshb/pi-camera-go/server/replication"
+	"github.com/joshb/pi-camera-go/server/schedule"
+	"github.com/joshb/pi-camera-go/server/storage"
+	"github.com/joshb/pi-camera-go/server/websocket"
+	"github.com/joshb/pi-camera-go/server/whep"
+)
+
+const camerasPrefix = "/cameras/"
+
+// camera is a recorder with its own storage and schedule.
+type camera struct {
+	name        string
+	config      CameraConfig
+	replication replication.Config
+	webrtc      whep.Config
+	mjpegConfig mjpeg.Config
+
+	storage   storage.Storage
+	recorder  recorder.Recorder
+	scheduler schedule.Scheduler
+	live      *live.Stream
+	websocket *websocket.Stream
+	whep      *whep.Server
+	mjpeg     *mjpeg.Stream
+}
+
+type cameraStatus struct {
+	Name          string     `json:"name"`
+	URL           string     `json:"url"`
+	Recording     bool       `json:"recording"`
+	Profile       string     `json:"profile"`
+	LatestSegment *time.Time `json:"latestSegment,omitempty"`
+}
+
+func newCamera(config CameraConfig, replicationConfig replication.Config, webrtcConfig whep.Config, mjpegConfig mjpeg.Config) *camera {
+	return &camera{
+		name:        config.Name,
+		config:      config,
+		replication: replicationConfig,
+		webrtc:      webrtcConfig,
+		mjpegConfig: mjpegConfig,
+		live:        live.NewStream(),
+		websocket:   websocket.NewStream(),
+	}
+}
+
+func (c *camera) start() error {
+	var err error
+	c.storage, err = storage.New(*c.config.Storage, c.config.Namespace())
+	if err != nil {
+		return err
+	}
+
+	c.storage.Start()
+
+	c.recorder, err = recorder.New(c.config.Recorder, c.config.Namespace())
+	if err != nil {
+		fmt.Println("Unable to create recorder for camera", c.name+":", err)
+		fmt.Println("Using mock recorder")
+		c.recorder = recorder.NewMock()
+	}
+
+	// Start with the profile that is currently scheduled.
+	profileName, err := c.config.Schedule.ProfileAt(time.Now())
+	if err != nil {
+		return err
+	}
+	var profile recorder.Profile
+	if len(profileName) != 0 {
+		profile, err = schedule.FindProfile(c.config.Profiles, profileName)
+		if err != nil {
+			return err
+		}
+		if err := c.recorder.SetProfile(profile); err != nil {
+			return err
+		}
+	}
+
+	if err := c.recorder.Start(); err != nil {
+		fmt.Println("Unable to start recorder for camera", c.name+":", err)
+		fmt.Println("Using mock recorder")
+		c.recorder = recorder.NewMock()
+		if len(profileName) != 0 {
+			c.recorder.SetProfile(profile)
+		}
+		if err := c.recorder.Start(); err != nil {
+			return err
+		}
+	}
+
+	c.recorder.AddSubscriber(c.storage)
+	c.recorder.AddSubscriber(c.live)
+	c.recorder.AddSubscriber(c.websocket)
+
+	if c.webrtc.Enabled() {
+		c.whep, err = whep.New(c.webrtc)
+		if err != nil {
+			return err
+		}
+		c.recorder.AddSubscriber(c.whep)
+	}
+
+	c.mjpeg, err = mjpeg.NewStream(c.mjpegConfig)
+	if err != nil {
+		return err
+	}
+	c.recorder.AddSubscriber(c.mjpeg)
+
+	if c.replication.Enabled() {
+		replicator, err := replication.New(c.replication, c.name)
+		if err != nil {
+			return err
+		}
+		replicator.Start()
+		c.recorder.AddSubscriber(replicator)
+	}
+
+	c.scheduler, err = schedule.New(*c.config.Schedule, c.recorder, c.config.Profiles, true, schedule.SystemClock)
+	if err != nil {
+		return err
+	}
+	c.scheduler.Start()
+
+	return nil
+}
+
+func (c *camera) stop() error {
+	c.scheduler.Stop()
+	return c.recorder.Stop()
+}
+
+func (c *camera) status() cameraStatus {
+	scheduleStatus := c.scheduler.Status()
+	status := cameraStatus{
+		Name:      c.name,
+		URL:       camerasPrefix + c.name + "/",
+		Recording: scheduleStatus.Recording,
+		Profile:   scheduleStatus.Profile,
+	}
+
+	if segments := c.storage.LatestSegments(2); len(segments) != 0 {
+		latest := segments[len(segments)-1].Time
+		status.LatestSegment = &latest
+	}
+
+	return status
+}
+
+// serve serves the camera's playlists, segments and API at the given path
+// within the camera's URL. It returns false if there is nothing at the
+// path.
+func (c *camera) serve(w http.ResponseWriter, req *http.Request, p string) bool {
+	switch {
+	case strings.HasPrefix(p, "api/"):
+		c.serveAPI(w, req, strings.TrimPrefix(p, "api/"))
+	case strings.HasPrefix(p, "segments/"):
+		c.storage.ServeSegment(w, req, strings.TrimPrefix(p, "segments/"))
+	case strings.HasPrefix(p, "ll/"):
+		c.live.ServeFile(w, req, strings.TrimPrefix(p, "ll/"))
+	case p == "live.m3u8" && c.live.Available():
+		// Serve the low-latency playlist once frames are coming in,
+		// which is not the case for every recorder backend.
+		c.live.ServePlaylist(w, req)
+	case p == "live.m3u" || p == "live.m3u8":
+		c.serveLivePlaylist(w, false)
+	case p == "live.txt":
+		c.serveLivePlaylist(w, true)
+	case p == "vod.m3u" || p == "vod.m3u8":
+		c.serveVODPlaylist(w, req, false)
+	case p == "vod.txt":
+		c.serveVODPlaylist(w, req, true)
+	case c.whep != nil && (p == "whep" || strings.HasPrefix(p, "whep/")):
+		c.whep.Serve(w, req, strings.TrimPrefix(strings.TrimPrefix(p, "whep"), "/"))
+	case p == "ws/live":
+		c.websocket.ServeHTTP(w, req)
+	case p == "stream.mjpg":
+		c.mjpeg.ServeHTTP(w, req)
+	case p == "live.mpd":
+		serveLiveMPD(w, c.storage, c.recorder.SegmentDuration())
+	case p == "vod.mpd":
+		serveVODMPD(w, req, c.storage)
+	default:
+		return false
+	}
+
+	return true
+}
+
+func (c *camera) serveLivePlaylist(w http.ResponseWriter, txt bool) {
+	serveLivePlaylist(w, c.storage, c.recorder.SegmentDuration(), txt)
+}
+
+func (c *camera) serveVODPlaylist(w http.ResponseWriter, req *http.Request, txt bool) {
+	serveVODPlaylist(w, req, c.storage, txt)
+}
+
+// liveSegmentCount returns the number of segments in live playlists,
+// which is enough to fill 10 seconds.
+func liveSegmentCount(segmentDuration time.Duration) int {
+	numSegments := 3
+	if segmentDuration > 0 && int((10*time.Second)/segmentDuration) > numSegments {
+		numSegments = int((10 * time.Second) / segmentDuration)
+	}
+
+	return numSegments
+}
+
+// serveLivePlaylist serves a playlist of the latest segments.
+func serveLivePlaylist(w http.ResponseWriter, s storage.Storage, segmentDuration time.Duration, txt bool) {
+	segments := s.LatestSegments(liveSegmentCount(segmentDuration))
+	writePlaylist(w, segments, nil, txt, false)
+}
+
+// serveVODPlaylist serves a playlist of the recorded segments in the time
+// range given by the start and end query parameters.
+func serveVODPlaylist(w http.ResponseWriter, req *http.Request, s storage.Storage, txt bool) {
+	start, end, err := timeRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	segments := s.SegmentsInRange(start, end)
+	annotations := s.SearchAnnotations(storage.AnnotationQuery{Start: start, End: end})
+	writePlaylist(w, segments, annotations, txt, true)
+}
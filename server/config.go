@@ -0,0 +1,196 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/joshb/pi-camera-go/server/aggregator"
+	"github.com/joshb/pi-camera-go/server/mjpeg"
+	"github.com/joshb/pi-camera-go/server/recorder"
+	"github.com/joshb/pi-camera-go/server/replication"
+	"github.com/joshb/pi-camera-go/server/rtsp"
+	"github.com/joshb/pi-camera-go/server/schedule"
+	"github.com/joshb/pi-camera-go/server/storage"
+	"github.com/joshb/pi-camera-go/server/util"
+	"github.com/joshb/pi-camera-go/server/whep"
+)
+
+const configFileName = "config.json"
+
+const defaultCameraName = "default"
+
+var cameraNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// reservedCameraNames are used for directories next to or inside the
+// segment directories of cameras, which are named after the cameras:
+// segments ingested from other instances, and the quarantined segments
+// and evidence manifests of a server with a single camera.
+var reservedCameraNames = map[string]bool{
+	ingestDirName: true,
+	"quarantine":  true,
+	"manifests":   true,
+}
+
+// Config holds the settings read from the configuration file.
+type Config struct {
+	HTTPS    bool               `json:"https"`
+	Storage  storage.Config     `json:"storage"`
+	Recorder recorder.Config    `json:"recorder"`
+	Schedule schedule.Config    `json:"schedule"`
+	Profiles []recorder.Profile `json:"profiles"`
+
+	// Cameras lists the cameras to record. If it is empty, a single
+	// camera named "default" is recorded using the settings above.
+	Cameras []CameraConfig `json:"cameras"`
+
+	// Announce broadcasts the server's address on the local network so
+	// that aggregators can discover it. Announcements are signed with
+	// AnnounceKey, which must match the aggregators' discoveryKey.
+	Announce    bool   `json:"announce"`
+	AnnounceKey string `json:"announceKey"`
+
+	// Aggregator is used when running in aggregator mode.
+	Aggregator aggregator.Config `json:"aggregator"`
+
+	// Replication sends every camera's new segments to a remote
+	// endpoint, and Ingest accepts segments replicated from other
+	// instances.
+	Replication replication.Config `json:"replication"`
+	Ingest      IngestConfig       `json:"ingest"`
+
+	// WebRTC configures the WebRTC live view of every camera, and RTSP
+	// configures the RTSP server that streams every camera.
+	WebRTC whep.Config `json:"webrtc"`
+	RTSP   rtsp.Config `json:"rtsp"`
+
+	// MJPEG configures the images of every camera's MJPEG stream.
+	MJPEG mjpeg.Config `json:"mjpeg"`
+}
+
+// IngestConfig enables the ingest endpoint. Requests must carry the token
+// as a bearer token. Ingested segments are stored using the server's
+// storage settings.
+type IngestConfig struct {
+	Token string `json:"token"`
+}
+
+// CameraConfig holds the settings of one camera. The storage, schedule and
+// profiles default to those of the server.
+type CameraConfig struct {
+	Name     string             `json:"name"`
+	Recorder recorder.Config    `json:"recorder"`
+	Storage  *storage.Config    `json:"storage"`
+	Schedule *schedule.Config   `json:"schedule"`
+	Profiles []recorder.Profile `json:"profiles"`
+
+	namespace string
+}
+
+// Namespace returns the name under which the camera's segments and
+// recorder files are kept, which is empty for the default camera so that
+// it uses the same directories as a server with a single camera.
+func (c CameraConfig) Namespace() string {
+	return c.namespace
+}
+
+// CameraConfigs returns the settings of each camera, with the server's
+// settings filled in where a camera has none of its own.
+func (config Config) CameraConfigs() ([]CameraConfig, error) {
+	if len(config.Cameras) == 0 {
+		return []CameraConfig{{
+			Name:     defaultCameraName,
+			Recorder: config.Recorder,
+			Storage:  &config.Storage,
+			Schedule: &config.Schedule,
+			Profiles: config.Profiles,
+		}}, nil
+	}
+
+	cameras := make([]CameraConfig, 0, len(config.Cameras))
+	names := make(map[string]bool)
+	for _, camera := range config.Cameras {
+		if !cameraNameRegexp.MatchString(camera.Name) {
+			return nil, fmt.Errorf("invalid camera name %q", camera.Name)
+		}
+		if reservedCameraNames[camera.Name] {
+			return nil, fmt.Errorf("camera name %q is reserved", camera.Name)
+		}
+		if names[camera.Name] {
+			return nil, fmt.Errorf("duplicate camera name %q", camera.Name)
+		}
+		names[camera.Name] = true
+
+		camera.namespace = camera.Name
+		if camera.Storage == nil {
+			storageConfig := config.Storage
+			camera.Storage = &storageConfig
+		}
+		if camera.Schedule == nil {
+			scheduleConfig := config.Schedule
+			camera.Schedule = &scheduleConfig
+		}
+		if camera.Profiles == nil {
+			camera.Profiles = config.Profiles
+		}
+		cameras = append(cameras, camera)
+	}
+
+	return cameras, nil
+}
+
+// LoadConfig reads the configuration file at the given path. If the path
+// is empty, config.json in the configuration directory is used if it
+// exists, and the default configuration is returned otherwise.
+func LoadConfig(configPath string) (Config, error) {
+	var config Config
+	if len(configPath) == 0 {
+		configDir, err := util.ConfigDir()
+		if err != nil {
+			return config, err
+		}
+
+		configPath = path.Join(configDir, configFileName)
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			return config, nil
+		}
+	}
+
+	b, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
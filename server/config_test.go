@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"testing"
+)
+
+func TestCameraConfigs(t *testing.T) {
+	config := Config{Cameras: []CameraConfig{{Name: "front"}, {Name: "garage"}}}
+	cameras, err := config.CameraConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cameras) != 2 || cameras[1].Namespace() != "garage" || cameras[1].Storage == nil || cameras[1].Schedule == nil {
+		t.Errorf("got cameras %+v", cameras)
+	}
+
+	cameras, err = Config{}.CameraConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cameras) != 1 || cameras[0].Name != defaultCameraName || len(cameras[0].Namespace()) != 0 {
+		t.Errorf("got cameras %+v without any configured", cameras)
+	}
+
+	for _, name := range []string{"", "Front", "front/back", "..", "ingest", "quarantine", "manifests"} {
+		config := Config{Cameras: []CameraConfig{{Name: name}}}
+		if _, err := config.CameraConfigs(); err == nil {
+			t.Errorf("accepted camera name %q", name)
+		}
+	}
+
+	config = Config{Cameras: []CameraConfig{{Name: "front"}, {Name: "front"}}}
+	if _, err := config.CameraConfigs(); err == nil {
+		t.Error("accepted duplicate camera names")
+	}
+}
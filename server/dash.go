@@ -0,0 +1,269 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/storage"
+)
+
+// mpd is an MPEG-DASH manifest. Each run of segments that continue one
+// another is a period, with a SegmentList that has a SegmentTimeline, since
+// segment names cannot be derived from a template.
+type mpd struct {
+	XMLName                   xml.Name    `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                  string      `xml:"profiles,attr"`
+	Type                      string      `xml:"type,attr"`
+	AvailabilityStartTime     string      `xml:"availabilityStartTime,attr,omitempty"`
+	PublishTime               string      `xml:"publishTime,attr,omitempty"`
+	MinimumUpdatePeriod       string      `xml:"minimumUpdatePeriod,attr,omitempty"`
+	TimeShiftBufferDepth      string      `xml:"timeShiftBufferDepth,attr,omitempty"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr,omitempty"`
+	MaxSegmentDuration        string      `xml:"maxSegmentDuration,attr"`
+	MinBufferTime             string      `xml:"minBufferTime,attr"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	XMLName       xml.Name `xml:"Period"`
+	ID            string   `xml:"id,attr"`
+	Start         string   `xml:"start,attr"`
+	AdaptationSet struct {
+		ContentType      string `xml:"contentType,attr"`
+		MimeType         string `xml:"mimeType,attr"`
+		SegmentAlignment bool   `xml:"segmentAlignment,attr"`
+		StartWithSAP     int    `xml:"startWithSAP,attr"`
+		Representation   struct {
+			ID          string `xml:"id,attr"`
+			Codecs      string `xml:"codecs,attr"`
+			Bandwidth   int64  `xml:"bandwidth,attr"`
+			Width       int    `xml:"width,attr"`
+			Height      int    `xml:"height,attr"`
+			SegmentList struct {
+				Timescale              uint32 `xml:"timescale,attr"`
+				PresentationTimeOffset uint64 `xml:"presentationTimeOffset,attr"`
+				Initialization         struct {
+					SourceURL string `xml:"sourceURL,attr"`
+				}
+				Timeline []mpdS          `xml:"SegmentTimeline>S"`
+				URLs     []mpdSegmentURL `xml:"SegmentURL"`
+			}
+		}
+	}
+}
+
+type mpdS struct {
+	T uint64 `xml:"t,attr"`
+	D uint64 `xml:"d,attr"`
+}
+
+type mpdSegmentURL struct {
+	XMLName xml.Name `xml:"SegmentURL"`
+	Media   string   `xml:"media,attr"`
+}
+
+// mpdDuration formats a duration as an ISO 8601 duration.
+func mpdDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// mpdRuns splits segments into runs that can share a period: a run ends
+// where the initialization segment changes, a segment is missing or does
+// not continue the one before it. MPEG-TS segments cannot be played with
+// DASH and are left out.
+func mpdRuns(segments []storage.Segment) [][]storage.Segment {
+	var runs [][]storage.Segment
+	var run []storage.Segment
+	for _, segment := range segments {
+		if len(segment.Init) == 0 {
+			continue
+		}
+
+		if len(run) != 0 {
+			prev := run[len(run)-1]
+			continues := segment.Init == prev.Init && segment.ID == prev.ID+1 && !segment.Discontinuity &&
+				(segment.MediaTime == nil) == (prev.MediaTime == nil) &&
+				(segment.MediaTime == nil || *segment.MediaTime > *prev.MediaTime)
+			if !continues {
+				runs = append(runs, run)
+				run = nil
+			}
+		}
+		run = append(run, segment)
+	}
+	if len(run) != 0 {
+		runs = append(runs, run)
+	}
+
+	return runs
+}
+
+// newMPDPeriod describes a run of segments. Segment times come from the
+// segments themselves if they are known, and otherwise from the segment
+// durations.
+func newMPDPeriod(s storage.Storage, run []storage.Segment, start time.Duration) (mpdPeriod, error) {
+	init, err := s.InitSegment(run[0].Init)
+	if err != nil {
+		return mpdPeriod{}, err
+	}
+
+	var p mpdPeriod
+	p.ID = fmt.Sprintf("segment-%d", run[0].ID)
+	p.Start = mpdDuration(start)
+
+	as := &p.AdaptationSet
+	as.ContentType = "video"
+	as.MimeType = "video/mp4"
+	as.SegmentAlignment = true
+	as.StartWithSAP = 1
+
+	r := &as.Representation
+	r.ID = "video"
+	r.Codecs = init.Codecs
+	r.Width, r.Height = init.Width, init.Height
+
+	list := &r.SegmentList
+	list.Timescale = init.Timescale
+	list.Initialization.SourceURL = "segments/" + init.Name
+
+	timescale := uint64(init.Timescale)
+	t := uint64(0)
+	if run[0].MediaTime != nil {
+		t = *run[0].MediaTime
+		list.PresentationTimeOffset = t
+	}
+
+	size, duration := int64(0), time.Duration(0)
+	for i, segment := range run {
+		d := uint64(segment.Duration) * timescale / uint64(time.Second)
+		if segment.MediaTime != nil && i+1 < len(run) {
+			d = *run[i+1].MediaTime - *segment.MediaTime
+		}
+
+		list.Timeline = append(list.Timeline, mpdS{T: t, D: d})
+		list.URLs = append(list.URLs, mpdSegmentURL{Media: "segments/" + segment.Name})
+		t += d
+
+		size += segment.Size
+		duration += segment.Duration
+	}
+
+	r.Bandwidth = 1
+	if duration > 0 && size > 0 {
+		r.Bandwidth = size * 8 * int64(time.Second) / int64(duration)
+	}
+
+	return p, nil
+}
+
+// writeMPD writes a manifest for the given segments. A live manifest is
+// dynamic: its periods are placed at the times the segments were recorded
+// and players keep reloading it. A VOD manifest plays the segments back to
+// back.
+func writeMPD(w http.ResponseWriter, s storage.Storage, segments []storage.Segment, live bool) error {
+	runs := mpdRuns(segments)
+	if len(runs) == 0 {
+		return errors.New("no fragmented MP4 segments")
+	}
+
+	m := mpd{
+		Profiles:      "urn:mpeg:dash:profile:full:2011",
+		MinBufferTime: mpdDuration(2 * time.Second),
+	}
+
+	maxSegmentDuration, total := time.Duration(0), time.Duration(0)
+	for _, run := range runs {
+		start := total
+		if live {
+			start = run[0].Time.Sub(time.Unix(0, 0))
+		}
+
+		p, err := newMPDPeriod(s, run, start)
+		if err != nil {
+			return err
+		}
+		m.Periods = append(m.Periods, p)
+
+		for _, segment := range run {
+			total += segment.Duration
+			if segment.Duration > maxSegmentDuration {
+				maxSegmentDuration = segment.Duration
+			}
+		}
+	}
+	m.MaxSegmentDuration = mpdDuration(maxSegmentDuration)
+
+	if live {
+		// Period start times are relative to the epoch, which keeps the
+		// availability start time the same across reloads.
+		m.Type = "dynamic"
+		m.AvailabilityStartTime = "1970-01-01T00:00:00Z"
+		m.PublishTime = time.Now().UTC().Format(time.RFC3339)
+		m.MinimumUpdatePeriod = mpdDuration(maxSegmentDuration)
+		m.TimeShiftBufferDepth = mpdDuration(total)
+	} else {
+		m.Type = "static"
+		m.MediaPresentationDuration = mpdDuration(total)
+	}
+
+	b, err := xml.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/dash+xml")
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+	return nil
+}
+
+// serveLiveMPD serves a live manifest of the same segments as the live
+// playlist.
+func serveLiveMPD(w http.ResponseWriter, s storage.Storage, segmentDuration time.Duration) {
+	if err := writeMPD(w, s, s.LatestSegments(liveSegmentCount(segmentDuration)), true); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+// serveVODMPD serves a manifest of the recorded segments in the time range
+// given by the start and end query parameters.
+func serveVODMPD(w http.ResponseWriter, req *http.Request, s storage.Storage) {
+	start, end, err := timeRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := writeMPD(w, s, s.SegmentsInRange(start, end), false); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/storage"
+)
+
+// dashStorage is a storage stand-in with two initialization segments.
+type dashStorage struct {
+	storage.Storage
+}
+
+func (dashStorage) InitSegment(name string) (storage.InitSegment, error) {
+	switch name {
+	case "init_1.mp4", "init_2.mp4":
+		return storage.InitSegment{Name: name, Codecs: "avc1.640028", Width: 1280, Height: 720, Timescale: 90000}, nil
+	}
+	return storage.InitSegment{}, errors.New("no such initialization segment")
+}
+
+func mediaTime(t uint64) *uint64 {
+	return &t
+}
+
+// dashSegment returns a one-second fragmented MP4 segment.
+func dashSegment(id storage.SegmentID, init string, t *uint64) storage.Segment {
+	return storage.Segment{
+		ID:        id,
+		Name:      "segment_" + string(rune('0'+id)) + ".m4s",
+		Time:      time.Unix(1500000000+int64(id), 0),
+		Duration:  time.Second,
+		Size:      1000,
+		Init:      init,
+		MediaTime: t,
+	}
+}
+
+func runIDs(runs [][]storage.Segment) [][]storage.SegmentID {
+	ids := make([][]storage.SegmentID, 0)
+	for _, run := range runs {
+		var runIDs []storage.SegmentID
+		for _, segment := range run {
+			runIDs = append(runIDs, segment.ID)
+		}
+		ids = append(ids, runIDs)
+	}
+	return ids
+}
+
+func TestMPDRuns(t *testing.T) {
+	discontinuity := dashSegment(3, "init_1.mp4", nil)
+	discontinuity.Discontinuity = true
+	mpegTS := dashSegment(2, "", nil)
+
+	for _, test := range []struct {
+		name     string
+		segments []storage.Segment
+		want     [][]storage.SegmentID
+	}{
+		{"continuous", []storage.Segment{
+			dashSegment(1, "init_1.mp4", nil),
+			dashSegment(2, "init_1.mp4", nil),
+			dashSegment(3, "init_1.mp4", nil),
+		}, [][]storage.SegmentID{{1, 2, 3}}},
+		{"init change", []storage.Segment{
+			dashSegment(1, "init_1.mp4", nil),
+			dashSegment(2, "init_2.mp4", nil),
+			dashSegment(3, "init_2.mp4", nil),
+		}, [][]storage.SegmentID{{1}, {2, 3}}},
+		{"ID gap", []storage.Segment{
+			dashSegment(1, "init_1.mp4", nil),
+			dashSegment(3, "init_1.mp4", nil),
+		}, [][]storage.SegmentID{{1}, {3}}},
+		{"discontinuity", []storage.Segment{
+			dashSegment(1, "init_1.mp4", nil),
+			dashSegment(2, "init_1.mp4", nil),
+			discontinuity,
+		}, [][]storage.SegmentID{{1, 2}, {3}}},
+		{"media time backwards", []storage.Segment{
+			dashSegment(1, "init_1.mp4", mediaTime(180000)),
+			dashSegment(2, "init_1.mp4", mediaTime(270000)),
+			dashSegment(3, "init_1.mp4", mediaTime(0)),
+		}, [][]storage.SegmentID{{1, 2}, {3}}},
+		{"media time unknown", []storage.Segment{
+			dashSegment(1, "init_1.mp4", mediaTime(0)),
+			dashSegment(2, "init_1.mp4", nil),
+		}, [][]storage.SegmentID{{1}, {2}}},
+		{"MPEG-TS left out", []storage.Segment{
+			dashSegment(1, "init_1.mp4", nil),
+			mpegTS,
+			dashSegment(3, "init_1.mp4", nil),
+		}, [][]storage.SegmentID{{1}, {3}}},
+		{"no fragmented MP4", []storage.Segment{mpegTS}, [][]storage.SegmentID{}},
+	} {
+		if got := runIDs(mpdRuns(test.segments)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got runs %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWriteMPD(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		segments []storage.Segment
+		offset   []uint64
+		timeline [][]mpdS
+		start    []string
+	}{
+		{"durations", []storage.Segment{
+			dashSegment(1, "init_1.mp4", nil),
+			dashSegment(2, "init_1.mp4", nil),
+		}, []uint64{0}, [][]mpdS{{{0, 90000}, {90000, 90000}}}, []string{"PT0.000S"}},
+		{"media times", []storage.Segment{
+			dashSegment(1, "init_1.mp4", mediaTime(900000)),
+			dashSegment(2, "init_1.mp4", mediaTime(990000)),
+			dashSegment(3, "init_1.mp4", mediaTime(1098000)),
+		}, []uint64{900000}, [][]mpdS{{{900000, 90000}, {990000, 108000}, {1098000, 90000}}}, []string{"PT0.000S"}},
+		{"two periods", []storage.Segment{
+			dashSegment(1, "init_1.mp4", mediaTime(0)),
+			dashSegment(2, "init_1.mp4", mediaTime(90000)),
+			dashSegment(3, "init_2.mp4", mediaTime(0)),
+		}, []uint64{0, 0}, [][]mpdS{{{0, 90000}, {90000, 90000}}, {{0, 90000}}}, []string{"PT0.000S", "PT2.000S"}},
+	} {
+		w := httptest.NewRecorder()
+		if err := writeMPD(w, dashStorage{}, test.segments, false); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var m mpd
+		if err := xml.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if m.Type != "static" || m.MediaPresentationDuration != mpdDuration(time.Duration(len(test.segments))*time.Second) {
+			t.Errorf("%s: got type %s and duration %s", test.name, m.Type, m.MediaPresentationDuration)
+		}
+		if len(m.Periods) != len(test.timeline) {
+			t.Fatalf("%s: got %d periods, want %d", test.name, len(m.Periods), len(test.timeline))
+		}
+
+		for i, p := range m.Periods {
+			list := p.AdaptationSet.Representation.SegmentList
+			if p.Start != test.start[i] {
+				t.Errorf("%s: period %d starts at %s, want %s", test.name, i, p.Start, test.start[i])
+			}
+			if list.Timescale != 90000 || list.PresentationTimeOffset != test.offset[i] {
+				t.Errorf("%s: period %d has timescale %d and offset %d", test.name, i, list.Timescale, list.PresentationTimeOffset)
+			}
+			if !reflect.DeepEqual(list.Timeline, test.timeline[i]) {
+				t.Errorf("%s: period %d has timeline %v, want %v", test.name, i, list.Timeline, test.timeline[i])
+			}
+			if len(list.URLs) != len(list.Timeline) {
+				t.Errorf("%s: period %d has %d URLs for %d segments", test.name, i, len(list.URLs), len(list.Timeline))
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if err := writeMPD(w, dashStorage{}, []storage.Segment{dashSegment(1, "", nil)}, false); err == nil {
+		t.Error("wrote a manifest without fragmented MP4 segments")
+	}
+}
+
+// TestWriteLiveMPD checks that live periods start at the time their first
+// segment was recorded.
+func TestWriteLiveMPD(t *testing.T) {
+	w := httptest.NewRecorder()
+	segments := []storage.Segment{dashSegment(1, "init_1.mp4", nil), dashSegment(2, "init_2.mp4", nil)}
+	if err := writeMPD(w, dashStorage{}, segments, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var m mpd
+	if err := xml.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != "dynamic" || m.AvailabilityStartTime != "1970-01-01T00:00:00Z" || m.TimeShiftBufferDepth != "PT2.000S" {
+		t.Errorf("got manifest %+v", m)
+	}
+	if len(m.Periods) != 2 || m.Periods[0].Start != "PT1500000001.000S" || m.Periods[1].Start != "PT1500000002.000S" {
+		t.Errorf("got periods %+v", m.Periods)
+	}
+}
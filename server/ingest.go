@@ -0,0 +1,352 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/replication"
+	"github.com/joshb/pi-camera-go/server/storage"
+	"github.com/joshb/pi-camera-go/server/util"
+)
+
+const (
+	ingestPrefix  = "/ingest/"
+	ingestDirName = "ingest"
+	maxIngestSize = 256 * 1024 * 1024
+)
+
+var ingestNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// ingestStore keeps the segments replicated from other instances, with a
+// separate storage namespace for each of their cameras.
+type ingestStore struct {
+	config        IngestConfig
+	storageConfig storage.Config
+
+	targets map[string]*ingestTarget
+	mutex   *sync.Mutex
+}
+
+// ingestTarget is a camera of another instance.
+type ingestTarget struct {
+	source  string
+	camera  string
+	storage storage.Storage
+
+	// mutex serializes the segments being added, so that a segment sent
+	// twice is only stored once.
+	mutex *sync.Mutex
+}
+
+type ingestStatus struct {
+	Source        string     `json:"source"`
+	Camera        string     `json:"camera"`
+	URL           string     `json:"url"`
+	LatestSegment *time.Time `json:"latestSegment,omitempty"`
+}
+
+func newIngestStore(config IngestConfig, storageConfig storage.Config) *ingestStore {
+	return &ingestStore{
+		config:        config,
+		storageConfig: storageConfig,
+		targets:       make(map[string]*ingestTarget),
+		mutex:         &sync.Mutex{},
+	}
+}
+
+// target returns the storage for a camera of another instance. If create
+// is false, nil is returned for cameras that have never sent a segment.
+func (i *ingestStore) target(source, camera string, create bool) (*ingestTarget, error) {
+	if !ingestNameRegexp.MatchString(source) || !ingestNameRegexp.MatchString(camera) {
+		return nil, errors.New("invalid source or camera name")
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	key := source + "/" + camera
+	if t, ok := i.targets[key]; ok {
+		return t, nil
+	}
+
+	namespace := path.Join(ingestDirName, source, camera)
+	if !create {
+		segmentDir, err := util.ConfigDir("segments")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path.Join(segmentDir, namespace)); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+
+	s, err := storage.New(i.storageConfig, namespace)
+	if err != nil {
+		return nil, err
+	}
+	s.Start()
+
+	t := &ingestTarget{source: source, camera: camera, storage: s, mutex: &sync.Mutex{}}
+	i.targets[key] = t
+	return t, nil
+}
+
+// statuses lists the cameras that have sent segments.
+func (i *ingestStore) statuses() ([]ingestStatus, error) {
+	ingestDir, err := util.ConfigDir("segments", ingestDirName)
+	if err != nil {
+		return nil, err
+	}
+
+	sources, err := ioutil.ReadDir(ingestDir)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]ingestStatus, 0)
+	for _, source := range sources {
+		if !source.IsDir() {
+			continue
+		}
+		cameras, err := ioutil.ReadDir(path.Join(ingestDir, source.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, camera := range cameras {
+			if !camera.IsDir() {
+				continue
+			}
+			t, err := i.target(source.Name(), camera.Name(), false)
+			if err != nil || t == nil {
+				continue
+			}
+
+			status := ingestStatus{
+				Source: t.source,
+				Camera: t.camera,
+				URL:    ingestPrefix + t.source + "/" + t.camera + "/",
+			}
+			if latest, ok := latestSegment(t.storage); ok {
+				status.LatestSegment = &latest.Time
+			}
+			statuses = append(statuses, status)
+		}
+	}
+
+	sort.Slice(statuses, func(a, b int) bool {
+		return statuses[a].URL < statuses[b].URL
+	})
+	return statuses, nil
+}
+
+func latestSegment(s storage.Storage) (storage.Segment, bool) {
+	segments := s.LatestSegments(2)
+	if len(segments) == 0 {
+		return storage.Segment{}, false
+	}
+
+	return segments[len(segments)-1], true
+}
+
+func (i *ingestStore) authorized(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(i.config.Token)) == 1
+}
+
+// serveAPI serves /api/ingest, which lists the ingested cameras, and
+// /api/ingest/{source}/{camera}, which accepts replicated segments.
+func (i *ingestStore) serveAPI(w http.ResponseWriter, req *http.Request, route string) {
+	if len(i.config.Token) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+
+	if route == "" {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !i.authorized(req) {
+			writeJSONError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+
+		statuses, err := i.statuses()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, statuses)
+		return
+	}
+
+	if req.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodPut)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !i.authorized(req) {
+		writeJSONError(w, http.StatusUnauthorized, errors.New("invalid token"))
+		return
+	}
+
+	parts := strings.Split(route, "/")
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+
+	t, err := i.target(parts[0], parts[1], true)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	status, err := t.ingest(req)
+	if err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+
+	writeJSON(w, status, map[string]bool{"duplicate": status == http.StatusOK})
+}
+
+// ingest stores a replicated segment. It returns 201 if the segment was
+// stored, 200 if it had already been stored, and 400 or 413 if the
+// request can never succeed, so that the sender can drop the segment.
+func (t *ingestTarget) ingest(req *http.Request) (int, error) {
+	created, err := time.Parse(time.RFC3339Nano, req.Header.Get(replication.HeaderCreated))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid %s header", replication.HeaderCreated)
+	}
+	modified, err := time.Parse(time.RFC3339Nano, req.Header.Get(replication.HeaderModified))
+	if err != nil || modified.Before(created) {
+		return http.StatusBadRequest, fmt.Errorf("invalid %s header", replication.HeaderModified)
+	}
+	checksum := req.Header.Get(replication.HeaderChecksum)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Segments are sent in order, so anything that is not newer than the
+	// latest segment has been stored before.
+	if latest, ok := latestSegment(t.storage); ok && !created.After(latest.Time) {
+		return http.StatusOK, nil
+	}
+
+	tempDir, err := util.ConfigDir(ingestDirName)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	tempFile, err := ioutil.TempFile(tempDir, "segment-*.ts")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer os.Remove(tempFile.Name())
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tempFile, hash), io.LimitReader(req.Body, maxIngestSize+1))
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if n > maxIngestSize {
+		return http.StatusRequestEntityTooLarge, errors.New("segment is too large")
+	}
+
+	if len(checksum) != 0 && hex.EncodeToString(hash.Sum(nil)) != checksum {
+		return http.StatusBadRequest, errors.New("checksum mismatch")
+	}
+	if err := storage.ValidateSegment(tempFile.Name()); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if req.Header.Get(replication.HeaderDiscontinuity) == "true" {
+		t.storage.Discontinuity()
+	}
+	if err := t.storage.AddSegment(tempFile.Name(), created, modified); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusCreated, nil
+}
+
+// serve serves an ingested camera's playlists and segments at
+// /ingest/{source}/{camera}/...
+func (i *ingestStore) serve(w http.ResponseWriter, req *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, ingestPrefix), "/", 3)
+	if len(parts) != 3 {
+		http.NotFound(w, req)
+		return
+	}
+
+	t, err := i.target(parts[0], parts[1], false)
+	if err != nil || t == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	p := parts[2]
+	switch {
+	case strings.HasPrefix(p, "segments/"):
+		t.storage.ServeSegment(w, req, strings.TrimPrefix(p, "segments/"))
+	case p == "live.m3u8" || p == "live.mpd":
+		segmentDuration := time.Duration(0)
+		if latest, ok := latestSegment(t.storage); ok {
+			segmentDuration = latest.Duration
+		}
+		if p == "live.mpd" {
+			serveLiveMPD(w, t.storage, segmentDuration)
+		} else {
+			serveLivePlaylist(w, t.storage, segmentDuration, false)
+		}
+	case p == "vod.m3u8":
+		serveVODPlaylist(w, req, t.storage, false)
+	case p == "vod.mpd":
+		serveVODMPD(w, req, t.storage)
+	default:
+		http.NotFound(w, req)
+	}
+}
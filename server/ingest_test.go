@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/joshb/pi-camera-go/server/storage"
+)
+
+func TestIngestAPIRequiresToken(t *testing.T) {
+	i := newIngestStore(IngestConfig{Token: "secret"}, storage.Config{})
+
+	for _, test := range []struct {
+		method, route, token string
+	}{
+		{http.MethodGet, "", ""},
+		{http.MethodGet, "", "wrong"},
+		{http.MethodPut, "node/front", ""},
+		{http.MethodPut, "node/front", "wrong"},
+	} {
+		req := httptest.NewRequest(test.method, "/api/ingest/"+test.route, nil)
+		if len(test.token) != 0 {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		i.serveAPI(w, req, test.route)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %q with token %q returned %d", test.method, test.route, test.token, w.Code)
+		}
+	}
+
+	// Without a token, the ingest API is disabled.
+	i = newIngestStore(IngestConfig{}, storage.Config{})
+	w := httptest.NewRecorder()
+	i.serveAPI(w, httptest.NewRequest(http.MethodGet, "/api/ingest", nil), "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET without a configured token returned %d", w.Code)
+	}
+}
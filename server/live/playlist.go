@@ -0,0 +1,249 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package live
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partHoldBack is how far behind the live edge players should stay.
+const partHoldBack = 3 * PartTarget
+
+// Available returns whether the stream has a complete segment, which it
+// needs before a playlist can be served.
+func (s *Stream) Available() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.segments) != 0 && (s.segments[0].complete || len(s.segments) > 1)
+}
+
+// targetDuration returns the longest segment duration, rounded to whole
+// seconds. The caller must hold the mutex.
+func (s *Stream) targetDuration() int {
+	target := 1
+	for _, seg := range s.segments {
+		if d := int(math.Round(seg.duration.Seconds())); seg.complete && d > target {
+			target = d
+		}
+	}
+	return target
+}
+
+// segment returns the segment with the given media sequence number, or
+// nil if it is not in memory. The caller must hold the mutex.
+func (s *Stream) segment(msn uint64) *segment {
+	for _, seg := range s.segments {
+		if seg.msn == msn {
+			return seg
+		}
+	}
+	return nil
+}
+
+// ready returns whether a segment, or a part of it if part is not
+// negative, has been written or has already been removed. The caller must
+// hold the mutex.
+func (s *Stream) ready(msn uint64, part int) bool {
+	if len(s.segments) != 0 && msn < s.segments[0].msn {
+		return true
+	}
+
+	seg := s.segment(msn)
+	if seg == nil {
+		return false
+	}
+	return seg.complete || (part >= 0 && part < len(seg.parts))
+}
+
+// wait blocks until a segment or part is ready, for at most three target
+// durations. It returns false if it timed out.
+func (s *Stream) wait(req *http.Request, msn uint64, part int) bool {
+	s.mutex.Lock()
+	timeout := time.Duration(3*s.targetDuration()) * time.Second
+	s.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mutex.Lock()
+		ready, updated := s.ready(msn, part), s.updated
+		s.mutex.Unlock()
+		if ready {
+			return true
+		}
+
+		select {
+		case <-updated:
+		case <-timer.C:
+			return false
+		case <-req.Context().Done():
+			return false
+		}
+	}
+}
+
+// ServePlaylist serves the LL-HLS playlist. If the request has the
+// _HLS_msn and optionally _HLS_part query parameters, the response is
+// held until the given segment or part is available.
+func (s *Stream) ServePlaylist(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if len(query.Get("_HLS_msn")) != 0 {
+		msn, err := strconv.ParseUint(query.Get("_HLS_msn"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		part := -1
+		if len(query.Get("_HLS_part")) != 0 {
+			part, err = strconv.Atoi(query.Get("_HLS_part"))
+			if err != nil || part < 0 {
+				http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Requests too far in the future are rejected rather than held.
+		s.mutex.Lock()
+		tooFar := msn > s.nextMSN+1
+		s.mutex.Unlock()
+		if tooFar {
+			http.Error(w, "_HLS_msn is too far in the future", http.StatusBadRequest)
+			return
+		}
+
+		if !s.wait(req, msn, part) {
+			http.Error(w, "timed out waiting for segment", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	s.writePlaylist(w)
+}
+
+// writePlaylist writes the playlist. Parts are only listed for the last
+// few segments. The caller must hold the mutex.
+func (s *Stream) writePlaylist(w io.Writer) {
+	io.WriteString(w, "#EXTM3U\n")
+	io.WriteString(w, "#EXT-X-VERSION:6\n")
+	io.WriteString(w, fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", s.targetDuration()))
+	io.WriteString(w, fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", partHoldBack.Seconds()))
+	io.WriteString(w, fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f\n", PartTarget.Seconds()))
+	io.WriteString(w, fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", s.segments[0].msn))
+	io.WriteString(w, fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", s.discontinuitySequence))
+
+	for i, seg := range s.segments {
+		if seg.discontinuity {
+			io.WriteString(w, "#EXT-X-DISCONTINUITY\n")
+		}
+		io.WriteString(w, fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.time.UTC().Format("2006-01-02T15:04:05.000Z")))
+
+		if i >= len(s.segments)-4 {
+			for j, p := range seg.parts {
+				tag := fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"ll/%d.%d.ts\"", p.duration.Seconds(), seg.msn, j)
+				if p.independent {
+					tag += ",INDEPENDENT=YES"
+				}
+				io.WriteString(w, tag+"\n")
+			}
+		}
+
+		if seg.complete {
+			io.WriteString(w, fmt.Sprintf("#EXTINF:%f,\n", seg.duration.Seconds()))
+			io.WriteString(w, fmt.Sprintf("ll/%d.ts\n", seg.msn))
+		}
+	}
+
+	// Hint at the next part, so that players can request it before it
+	// exists.
+	msn, part := s.nextMSN, 0
+	if current := s.current(); current != nil {
+		msn, part = current.msn, len(current.parts)
+	}
+	io.WriteString(w, fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"ll/%d.%d.ts\"\n", msn, part))
+}
+
+// ServeFile serves a segment ("{msn}.ts") or part ("{msn}.{part}.ts").
+// Requests for the next part are held until it is available.
+func (s *Stream) ServeFile(w http.ResponseWriter, req *http.Request, name string) {
+	fields := strings.Split(strings.TrimSuffix(name, ".ts"), ".")
+	if !strings.HasSuffix(name, ".ts") || len(fields) > 2 {
+		http.NotFound(w, req)
+		return
+	}
+	msn, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	part := -1
+	if len(fields) == 2 {
+		if part, err = strconv.Atoi(fields[1]); err != nil || part < 0 {
+			http.NotFound(w, req)
+			return
+		}
+
+		s.mutex.Lock()
+		upcoming := msn <= s.nextMSN
+		s.mutex.Unlock()
+		if upcoming && !s.wait(req, msn, part) {
+			http.NotFound(w, req)
+			return
+		}
+	}
+
+	s.mutex.Lock()
+	var data []byte
+	if seg := s.segment(msn); seg != nil {
+		if part < 0 && seg.complete {
+			data = seg.data()
+		} else if part >= 0 && part < len(seg.parts) {
+			data = seg.parts[part].data
+		}
+	}
+	s.mutex.Unlock()
+
+	if data == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
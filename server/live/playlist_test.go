@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package live
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+)
+
+const testFrameDuration = 100 * time.Millisecond
+
+// captureFrames passes frames n to m-1 of a 10 fps stream with a key
+// frame every second to the stream.
+func captureFrames(s *Stream, n, m int) {
+	for i := n; i < m; i++ {
+		frame := recorder.Frame{Time: time.Duration(i) * testFrameDuration}
+		if i%10 == 0 {
+			frame.KeyFrame = true
+			frame.Data = []byte{0, 0, 0, 1, 0x67, 1, 0, 0, 0, 1, 0x68, 2, 0, 0, 0, 1, 0x65, 3}
+		} else {
+			frame.Data = []byte{0, 0, 0, 1, 0x41, 4}
+		}
+		s.FrameCaptured(frame)
+	}
+}
+
+// servePlaylist starts a playlist request in the background.
+func servePlaylist(s *Stream, query string) (*httptest.ResponseRecorder, <-chan struct{}) {
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServePlaylist(w, httptest.NewRequest(http.MethodGet, "/ll/live.m3u8?"+query, nil))
+	}()
+	return w, done
+}
+
+func TestServePlaylist(t *testing.T) {
+	s := NewStream()
+	if s.Available() {
+		t.Fatal("stream is available without frames")
+	}
+
+	// The key frame at one second completes segment 0 and starts
+	// segment 1, which has no parts yet.
+	captureFrames(s, 0, 11)
+	if !s.Available() {
+		t.Fatal("stream is not available after a complete segment")
+	}
+
+	w, done := servePlaylist(s, "")
+	<-done
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "#EXT-X-MEDIA-SEQUENCE:0\n") || !strings.Contains(body, "ll/0.ts\n") {
+		t.Fatalf("got %d:\n%s", w.Code, body)
+	}
+	if !strings.Contains(body, `#EXT-X-PRELOAD-HINT:TYPE=PART,URI="ll/1.0.ts"`) {
+		t.Errorf("playlist does not hint at the next part:\n%s", body)
+	}
+
+	for _, test := range []struct {
+		query string
+		code  int
+	}{
+		// Segments and parts that exist are served immediately.
+		{"_HLS_msn=0", http.StatusOK},
+		{"_HLS_msn=0&_HLS_part=2", http.StatusOK},
+		{"_HLS_msn=x", http.StatusBadRequest},
+		{"_HLS_msn=1&_HLS_part=-1", http.StatusBadRequest},
+		{"_HLS_msn=1&_HLS_part=x", http.StatusBadRequest},
+
+		// The next segment is 2, so anything after 3 is too far ahead.
+		{"_HLS_msn=4", http.StatusBadRequest},
+	} {
+		w, done := servePlaylist(s, test.query)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("request with %s was held", test.query)
+		}
+		if w.Code != test.code {
+			t.Errorf("request with %s returned %d, want %d", test.query, w.Code, test.code)
+		}
+	}
+}
+
+// TestBlockingReload checks that a request for a part that does not exist
+// yet is held until the part is written.
+func TestBlockingReload(t *testing.T) {
+	s := NewStream()
+	captureFrames(s, 0, 11)
+
+	w, done := servePlaylist(s, "_HLS_msn=1&_HLS_part=0")
+	select {
+	case <-done:
+		t.Fatalf("request returned %d before the part was written", w.Code)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Two more frames fill the first part of segment 1.
+	captureFrames(s, 11, 13)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("request was not released when the part was written")
+	}
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `URI="ll/1.0.ts"`) {
+		t.Errorf("got %d:\n%s", w.Code, w.Body.String())
+	}
+}
+
+// TestBlockingReloadTimeout checks that a held request gives up after
+// three target durations.
+func TestBlockingReloadTimeout(t *testing.T) {
+	s := NewStream()
+	captureFrames(s, 0, 11)
+
+	start := time.Now()
+	w, done := servePlaylist(s, "_HLS_msn=2")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was never released")
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if d := time.Since(start); d < 3*time.Second {
+		t.Errorf("request timed out after %s, want 3s", d)
+	}
+}
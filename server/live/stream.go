@@ -0,0 +1,245 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package live serves the frames being captured as a Low-Latency HLS
+// stream. Segments and their partial segments are kept in memory only;
+// recorded segments are still stored and served by the storage package.
+package live
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+)
+
+const (
+	// PartTarget is the duration that partial segments are cut at.
+	PartTarget = 200 * time.Millisecond
+
+	// minSegmentDuration is how long a segment has to be before it is
+	// ended at the next key frame.
+	minSegmentDuration = time.Second
+
+	// maxSegments is the number of complete segments kept in memory.
+	maxSegments = 6
+)
+
+type part struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+type segment struct {
+	msn           uint64
+	time          time.Time
+	start         time.Duration
+	duration      time.Duration
+	discontinuity bool
+	complete      bool
+
+	parts []*part
+
+	// The part being written, which is not yet available.
+	partStart       time.Duration
+	partIndependent bool
+	partData        bytes.Buffer
+}
+
+// Stream builds an LL-HLS stream from captured frames. It is a recorder
+// subscriber.
+type Stream struct {
+	mutex *sync.Mutex
+
+	// updated is closed and replaced whenever a part is added, to wake
+	// up blocked requests.
+	updated chan struct{}
+
+	muxer    *tsMuxer
+	segments []*segment
+	nextMSN  uint64
+
+	// discontinuitySequence counts the discontinuities in segments that
+	// have been removed.
+	discontinuitySequence int
+
+	lastTime      time.Duration
+	frameDuration time.Duration
+	discontinuity bool
+	sps, pps      []byte
+}
+
+func NewStream() *Stream {
+	return &Stream{
+		mutex:   &sync.Mutex{},
+		updated: make(chan struct{}),
+		muxer:   newTSMuxer(),
+	}
+}
+
+// VideoRecorded implements recorder.Subscriber. The stream is built from
+// frames only, so recorded segments are ignored.
+func (s *Stream) VideoRecorded(filePath string, created, modified time.Time) {
+}
+
+// FrameCaptured implements recorder.FrameSubscriber.
+func (s *Stream) FrameCaptured(frame recorder.Frame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Frame times start over when the capture process is restarted.
+	current := s.current()
+	if len(s.segments) != 0 && frame.Time <= s.lastTime {
+		if current != nil {
+			s.endSegment(current, s.lastTime+s.frameDuration)
+			current = nil
+		}
+		s.discontinuity = true
+	} else if frame.Time > s.lastTime {
+		s.frameDuration = frame.Time - s.lastTime
+	}
+	s.lastTime = frame.Time
+
+	data := s.withParameterSets(frame)
+	if current == nil {
+		// Segments have to start with a key frame.
+		if !frame.KeyFrame {
+			return
+		}
+		current = s.startSegment(frame.Time)
+	} else if frame.KeyFrame && frame.Time-current.start+time.Millisecond >= minSegmentDuration {
+		s.endSegment(current, frame.Time)
+		current = s.startSegment(frame.Time)
+	} else if frame.Time-current.partStart+s.frameDuration > PartTarget+time.Millisecond {
+		// Parts may not be longer than the target, so a part ends when
+		// another frame would not fit, allowing for rounding.
+		s.endPart(current, frame.Time)
+		s.startPart(current, frame.Time, frame.KeyFrame)
+	}
+
+	// Convert to 90kHz units.
+	pts := int64(frame.Time) * 9 / 100000
+	s.muxer.writeFrame(&current.partData, pts, frame.KeyFrame, data)
+}
+
+// withParameterSets returns the frame's data, with the last seen SPS and
+// PPS added to key frames that lack them, so that every segment can be
+// decoded on its own.
+func (s *Stream) withParameterSets(frame recorder.Frame) []byte {
+	hasSPS, hasPPS := false, false
+	for _, nal := range frame.NALUnits() {
+		switch nal[0] & 0x1f {
+		case 7:
+			s.sps, hasSPS = nal, true
+		case 8:
+			s.pps, hasPPS = nal, true
+		}
+	}
+
+	if !frame.KeyFrame || (hasSPS && hasPPS) || s.sps == nil || s.pps == nil {
+		return frame.Data
+	}
+
+	data := make([]byte, 0, len(s.sps)+len(s.pps)+len(frame.Data)+8)
+	data = append(data, 0, 0, 0, 1)
+	data = append(data, s.sps...)
+	data = append(data, 0, 0, 0, 1)
+	data = append(data, s.pps...)
+	return append(data, frame.Data...)
+}
+
+// current returns the segment being written, or nil if there is none.
+// The caller must hold the mutex.
+func (s *Stream) current() *segment {
+	if len(s.segments) == 0 {
+		return nil
+	}
+	if last := s.segments[len(s.segments)-1]; !last.complete {
+		return last
+	}
+	return nil
+}
+
+// startSegment starts a new segment, removing the oldest one if there are
+// too many. The caller must hold the mutex.
+func (s *Stream) startSegment(t time.Duration) *segment {
+	seg := &segment{
+		msn:           s.nextMSN,
+		time:          time.Now(),
+		start:         t,
+		discontinuity: s.discontinuity,
+	}
+	s.nextMSN++
+	s.discontinuity = false
+	s.startPart(seg, t, true)
+
+	s.segments = append(s.segments, seg)
+	if len(s.segments) > maxSegments+1 {
+		if s.segments[0].discontinuity {
+			s.discontinuitySequence++
+		}
+		s.segments = s.segments[1:]
+	}
+
+	return seg
+}
+
+func (s *Stream) startPart(seg *segment, t time.Duration, independent bool) {
+	seg.partStart = t
+	seg.partIndependent = independent
+	seg.partData.Reset()
+	s.muxer.writeTables(&seg.partData)
+}
+
+// endPart makes the part being written available. The caller must hold
+// the mutex.
+func (s *Stream) endPart(seg *segment, end time.Duration) {
+	seg.parts = append(seg.parts, &part{
+		data:        append([]byte(nil), seg.partData.Bytes()...),
+		duration:    end - seg.partStart,
+		independent: seg.partIndependent,
+	})
+	seg.partData.Reset()
+
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+func (s *Stream) endSegment(seg *segment, end time.Duration) {
+	seg.duration = end - seg.start
+	seg.complete = true
+	s.endPart(seg, end)
+}
+
+// data returns the contents of a complete segment.
+func (seg *segment) data() []byte {
+	var buf bytes.Buffer
+	for _, p := range seg.parts {
+		buf.Write(p.data)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package live
+
+import (
+	"bytes"
+)
+
+// MPEG-TS constants. Every stream has a single H.264 program.
+const (
+	tsPacketSize  = 188
+	tsPayloadSize = tsPacketSize - 4
+
+	patPID   = 0x0000
+	pmtPID   = 0x1000
+	videoPID = 0x0100
+
+	streamTypeH264 = 0x1b
+
+	// Timestamps are offset so that the PCR, which runs slightly ahead
+	// of them, never has to be negative.
+	timestampOffset = 90000
+	pcrDelay        = 9000
+)
+
+var accessUnitDelimiter = []byte{0, 0, 0, 1, 9, 0xf0}
+
+// tsMuxer writes H.264 access units as MPEG-TS packets. Continuity
+// counters carry over between calls, so that the output of consecutive
+// calls can be played as a single stream.
+type tsMuxer struct {
+	continuity map[uint16]byte
+}
+
+func newTSMuxer() *tsMuxer {
+	return &tsMuxer{continuity: make(map[uint16]byte)}
+}
+
+// writeTables writes the program association and program map tables,
+// which let a player start decoding at this point.
+func (m *tsMuxer) writeTables(buf *bytes.Buffer) {
+	pat := []byte{
+		0x00,       // table_id
+		0xb0, 0x0d, // section_syntax_indicator, section_length
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // version_number, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, // program_number
+		0xe0 | pmtPID>>8, pmtPID & 0xff,
+	}
+	m.writeSection(buf, patPID, pat)
+
+	pmt := []byte{
+		0x02,       // table_id
+		0xb0, 0x12, // section_syntax_indicator, section_length
+		0x00, 0x01, // program_number
+		0xc1,       // version_number, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0xe0 | videoPID>>8, videoPID & 0xff, // PCR_PID
+		0xf0, 0x00, // program_info_length
+		streamTypeH264,
+		0xe0 | videoPID>>8, videoPID & 0xff,
+		0xf0, 0x00, // ES_info_length
+	}
+	m.writeSection(buf, pmtPID, pmt)
+}
+
+func (m *tsMuxer) writeSection(buf *bytes.Buffer, pid uint16, section []byte) {
+	crc := crc32MPEG(section)
+	payload := make([]byte, 0, tsPayloadSize)
+	payload = append(payload, 0) // pointer_field
+	payload = append(payload, section...)
+	payload = append(payload, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	for len(payload) < tsPayloadSize {
+		payload = append(payload, 0xff)
+	}
+
+	m.writeHeader(buf, pid, true, false)
+	buf.Write(payload)
+}
+
+func (m *tsMuxer) writeHeader(buf *bytes.Buffer, pid uint16, start, adaptationField bool) {
+	b1 := byte(pid >> 8)
+	if start {
+		b1 |= 0x40
+	}
+	control := byte(0x10)
+	if adaptationField {
+		control = 0x30
+	}
+
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0f
+	buf.Write([]byte{0x47, b1, byte(pid), control | cc})
+}
+
+// writeFrame writes an access unit as a PES packet. The presentation time
+// is in 90kHz units.
+func (m *tsMuxer) writeFrame(buf *bytes.Buffer, pts int64, keyFrame bool, data []byte) {
+	pts += timestampOffset
+
+	pes := make([]byte, 0, 14+len(accessUnitDelimiter)+len(data))
+	pes = append(pes,
+		0x00, 0x00, 0x01, 0xe0, // start code, stream_id
+		0x00, 0x00, // PES_packet_length, unbounded for video
+		0x80, // marker bits
+		0x80, // PTS_DTS_flags
+		0x05, // PES_header_data_length
+		byte(0x21|(pts>>29)&0x0e),
+		byte(pts>>22),
+		byte(0x01|(pts>>14)&0xfe),
+		byte(pts>>7),
+		byte(0x01|(pts<<1)&0xfe),
+	)
+	if !bytes.HasPrefix(data, accessUnitDelimiter[:5]) {
+		pes = append(pes, accessUnitDelimiter...)
+	}
+	pes = append(pes, data...)
+
+	// The first packet carries the PCR, and marks key frames as random
+	// access points.
+	pcr := pts - pcrDelay
+	first := []byte{
+		0x10, // PCR_flag
+		byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1),
+		byte(pcr<<7) | 0x7e, 0x00,
+	}
+	if keyFrame {
+		first[0] |= 0x40
+	}
+
+	for start := true; len(pes) > 0; start = false {
+		var field []byte
+		if start {
+			field = first
+		}
+
+		space := tsPayloadSize
+		if field != nil {
+			space -= 1 + len(field)
+		}
+
+		// Pad the last packet with stuffing bytes in the adaptation
+		// field.
+		if len(pes) < space {
+			stuffing := space - len(pes)
+			if field == nil {
+				if stuffing == 1 {
+					field = []byte{}
+				} else {
+					field = append([]byte{0x00}, bytes.Repeat([]byte{0xff}, stuffing-2)...)
+				}
+			} else {
+				field = append(field, bytes.Repeat([]byte{0xff}, stuffing)...)
+			}
+			space = len(pes)
+		}
+
+		m.writeHeader(buf, videoPID, start, field != nil)
+		if field != nil {
+			buf.WriteByte(byte(len(field)))
+			buf.Write(field)
+		}
+		buf.Write(pes[:space])
+		pes = pes[space:]
+	}
+}
+
+var crc32MPEGTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32MPEG computes the CRC used by MPEG-TS tables, which unlike the
+// IEEE CRC in hash/crc32 is not bit-reversed.
+func crc32MPEG(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc = crc<<8 ^ crc32MPEGTable[byte(crc>>24)^v]
+	}
+	return crc
+}
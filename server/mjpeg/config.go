@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mjpeg
+
+import (
+	"errors"
+)
+
+const (
+	// DefaultFramerate is the number of images per second if the
+	// configuration does not say.
+	DefaultFramerate = 5
+
+	// DefaultQuality is the JPEG quality if the configuration does not
+	// say.
+	DefaultQuality = 5
+)
+
+// Config configures the MJPEG stream.
+type Config struct {
+	// Framerate is the number of images per second. It defaults to
+	// DefaultFramerate.
+	Framerate int `json:"framerate"`
+
+	// Width and Height are the size of the images. The camera's
+	// resolution is used if both are zero, and the aspect ratio is kept
+	// if only one is set.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// Quality is the JPEG quality on ffmpeg's scale, from 2 (best) to
+	// 31 (smallest). It defaults to DefaultQuality.
+	Quality int `json:"quality"`
+}
+
+func (c Config) validate() error {
+	if c.Framerate < 0 || c.Width < 0 || c.Height < 0 {
+		return errors.New("invalid MJPEG framerate or size")
+	}
+	if c.Quality != 0 && (c.Quality < 2 || c.Quality > 31) {
+		return errors.New("MJPEG quality must be between 2 and 31")
+	}
+
+	return nil
+}
+
+func (c Config) framerate() int {
+	if c.Framerate == 0 {
+		return DefaultFramerate
+	}
+
+	return c.Framerate
+}
+
+func (c Config) quality() int {
+	if c.Quality == 0 {
+		return DefaultQuality
+	}
+
+	return c.Quality
+}
@@ -0,0 +1,368 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package mjpeg serves the frames being captured as a Motion JPEG stream,
+// for clients that can only show multipart/x-mixed-replace images. Frames
+// are decoded and encoded as JPEG images with ffmpeg, which only runs
+// while there are clients.
+package mjpeg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+)
+
+const (
+	boundary = "frame"
+
+	// maxQueuedFrames is the number of frames queued for ffmpeg. Frames
+	// are dropped until the next key frame if it falls further behind.
+	maxQueuedFrames = 30
+)
+
+// Stream is the MJPEG stream of one camera. It is a recorder subscriber.
+type Stream struct {
+	config Config
+
+	mutex   *sync.Mutex
+	clients map[chan []byte]bool
+	encoder *encoder
+
+	sps, pps []byte
+}
+
+// encoder is a running ffmpeg process.
+type encoder struct {
+	cancel context.CancelFunc
+	frames chan []byte
+
+	// started is set once a key frame has been queued, as the frames
+	// before it cannot be decoded.
+	started bool
+}
+
+func NewStream(config Config) (*Stream, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return &Stream{
+		config:  config,
+		mutex:   &sync.Mutex{},
+		clients: make(map[chan []byte]bool),
+	}, nil
+}
+
+// VideoRecorded implements recorder.Subscriber. Images are made from
+// frames only, so recorded segments are ignored.
+func (s *Stream) VideoRecorded(filePath string, created, modified time.Time) {
+}
+
+// FrameCaptured implements recorder.FrameSubscriber. Without clients,
+// there is no encoder and only the parameter sets of key frames are kept.
+func (s *Stream) FrameCaptured(frame recorder.Frame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !frame.KeyFrame {
+		if e := s.encoder; e != nil && e.started {
+			s.queue(e, frame.Data)
+		}
+		return
+	}
+
+	hasSPS, hasPPS := s.cacheParameterSets(frame)
+	if e := s.encoder; e != nil {
+		s.queue(e, s.withParameterSets(frame, hasSPS && hasPPS))
+	}
+}
+
+// queue queues a frame for ffmpeg, or drops it if ffmpeg has fallen
+// behind.
+func (s *Stream) queue(e *encoder, data []byte) {
+	select {
+	case e.frames <- data:
+		e.started = true
+	default:
+		e.started = false
+	}
+}
+
+// cacheParameterSets keeps the SPS and PPS of a key frame and reports
+// which of them it has.
+func (s *Stream) cacheParameterSets(frame recorder.Frame) (hasSPS, hasPPS bool) {
+	for _, nal := range frame.NALUnits() {
+		switch nal[0] & 0x1f {
+		case 7:
+			if !bytes.Equal(nal, s.sps) {
+				s.sps = append([]byte(nil), nal...)
+			}
+			hasSPS = true
+		case 8:
+			if !bytes.Equal(nal, s.pps) {
+				s.pps = append([]byte(nil), nal...)
+			}
+			hasPPS = true
+		}
+	}
+
+	return hasSPS, hasPPS
+}
+
+// withParameterSets returns a key frame's data, with the last seen SPS and
+// PPS added if it lacks them, so that ffmpeg can start decoding at any key
+// frame.
+func (s *Stream) withParameterSets(frame recorder.Frame, complete bool) []byte {
+	if complete || s.sps == nil || s.pps == nil {
+		return frame.Data
+	}
+
+	data := make([]byte, 0, len(s.sps)+len(s.pps)+len(frame.Data)+8)
+	data = append(data, 0, 0, 0, 1)
+	data = append(data, s.sps...)
+	data = append(data, 0, 0, 0, 1)
+	data = append(data, s.pps...)
+	return append(data, frame.Data...)
+}
+
+// ServeHTTP sends images to the client until it disconnects.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	images, err := s.addClient()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.removeClient(images)
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case image, ok := <-images:
+			if !ok {
+				return
+			}
+
+			fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", boundary, len(image))
+			w.Write(image)
+			if _, err := io.WriteString(w, "\r\n"); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// addClient returns a channel that receives the latest image, starting
+// ffmpeg for the first client.
+func (s *Stream) addClient() (chan []byte, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.sps == nil {
+		return nil, errors.New("live stream is not available")
+	}
+
+	images := make(chan []byte, 1)
+	s.clients[images] = true
+	if s.encoder == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.encoder = &encoder{cancel: cancel, frames: make(chan []byte, maxQueuedFrames)}
+		go s.runEncoder(ctx, s.encoder)
+	}
+
+	return images, nil
+}
+
+// removeClient stops ffmpeg once the last client has gone.
+func (s *Stream) removeClient(images chan []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.clients[images] {
+		return
+	}
+	delete(s.clients, images)
+	if len(s.clients) == 0 && s.encoder != nil {
+		s.encoder.cancel()
+		s.encoder = nil
+	}
+}
+
+func (s *Stream) args() []string {
+	filter := "fps=" + strconv.Itoa(s.config.framerate())
+	switch {
+	case s.config.Width > 0 && s.config.Height > 0:
+		filter += fmt.Sprintf(",scale=%d:%d", s.config.Width, s.config.Height)
+	case s.config.Width > 0:
+		filter += fmt.Sprintf(",scale=%d:-2", s.config.Width)
+	case s.config.Height > 0:
+		filter += fmt.Sprintf(",scale=-2:%d", s.config.Height)
+	}
+
+	// Frames are timed by when they arrive, since raw H.264 has no
+	// timestamps of its own.
+	return []string{
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-use_wallclock_as_timestamps", "1",
+		"-f", "h264", "-i", "pipe:0",
+		"-an", "-vf", filter, "-q:v", strconv.Itoa(s.config.quality()),
+		"-f", "mjpeg", "pipe:1",
+	}
+}
+
+// runEncoder feeds frames to ffmpeg and sends its images to the clients
+// until it is cancelled. If ffmpeg exits on its own, the clients are
+// disconnected.
+func (s *Stream) runEncoder(ctx context.Context, e *encoder) {
+	defer s.encoderStopped(e)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", s.args()...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Println("Unable to start MJPEG encoder:", err)
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Println("Unable to start MJPEG encoder:", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Println("Unable to start MJPEG encoder:", err)
+		return
+	}
+
+	go func() {
+		defer stdin.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case frame := <-e.frames:
+				if _, err := stdin.Write(frame); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	readImages(stdout, s.broadcast)
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		fmt.Println("MJPEG encoder stopped:", err)
+	}
+}
+
+// encoderStopped disconnects the clients if the encoder stopped while it
+// was still needed.
+func (s *Stream) encoderStopped(e *encoder) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.encoder != e {
+		return
+	}
+	e.cancel()
+	s.encoder = nil
+	for images := range s.clients {
+		close(images)
+		delete(s.clients, images)
+	}
+}
+
+// broadcast sends an image to every client, replacing any image that a
+// client has not taken yet.
+func (s *Stream) broadcast(image []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for images := range s.clients {
+		select {
+		case <-images:
+		default:
+		}
+		images <- image
+	}
+}
+
+var (
+	startOfImage = []byte{0xff, 0xd8}
+	endOfImage   = []byte{0xff, 0xd9}
+)
+
+// readImages splits the concatenated JPEG images written by ffmpeg. The
+// end of image marker cannot appear within an image, since 0xff bytes in
+// the compressed data are always followed by a zero byte.
+func readImages(r io.Reader, emit func(image []byte)) {
+	var buf []byte
+	chunk := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+
+		for {
+			start := bytes.Index(buf, startOfImage)
+			if start < 0 {
+				// Keep the last byte, which may start a marker.
+				if len(buf) > 1 {
+					buf = buf[len(buf)-1:]
+				}
+				break
+			}
+			end := bytes.Index(buf[start+2:], endOfImage)
+			if end < 0 {
+				buf = buf[start:]
+				break
+			}
+			end += start + 4
+			emit(append([]byte(nil), buf[start:end]...))
+			buf = buf[end:]
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
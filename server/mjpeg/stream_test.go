@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mjpeg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+)
+
+// fakeFFmpeg puts an ffmpeg on the PATH that creates the returned file
+// when it starts and then reads its input until it is closed.
+func fakeFFmpeg(t *testing.T) (started string) {
+	t.Helper()
+	dir := t.TempDir()
+	started = path.Join(dir, "started")
+	script := "#!/bin/sh\ntouch " + started + "\nexec cat > /dev/null\n"
+	if err := ioutil.WriteFile(path.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return started
+}
+
+func captureFrames(s *Stream, n int) {
+	for i := 0; i < n; i++ {
+		frame := recorder.Frame{Time: time.Duration(i) * 100 * time.Millisecond}
+		if i%10 == 0 {
+			frame.KeyFrame = true
+			frame.Data = []byte{0, 0, 0, 1, 0x67, 1, 0, 0, 0, 1, 0x68, 2, 0, 0, 0, 1, 0x65, 3}
+		} else {
+			frame.Data = []byte{0, 0, 0, 1, 0x41, 4}
+		}
+		s.FrameCaptured(frame)
+	}
+}
+
+// TestNoEncoderWithoutClients checks that frames are not encoded while
+// there are no clients, but that the parameter sets are still kept.
+func TestNoEncoderWithoutClients(t *testing.T) {
+	started := fakeFFmpeg(t)
+	s, err := NewStream(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captureFrames(s, 30)
+	time.Sleep(100 * time.Millisecond)
+	if s.encoder != nil {
+		t.Fatal("encoder was started without clients")
+	}
+	if _, err := os.Stat(started); !os.IsNotExist(err) {
+		t.Fatalf("ffmpeg was started without clients: %v", err)
+	}
+	if !bytes.Equal(s.sps, []byte{0x67, 1}) || !bytes.Equal(s.pps, []byte{0x68, 2}) {
+		t.Fatalf("got SPS %x and PPS %x", s.sps, s.pps)
+	}
+
+	// The encoder runs while there is a client and stops with the last
+	// one.
+	images, err := s.addClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ffmpeg was not started for a client")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	captureFrames(s, 10)
+
+	s.removeClient(images)
+	if err := os.Remove(started); err != nil {
+		t.Fatal(err)
+	}
+	captureFrames(s, 30)
+	time.Sleep(100 * time.Millisecond)
+
+	s.mutex.Lock()
+	encoder := s.encoder
+	s.mutex.Unlock()
+	if encoder != nil {
+		t.Error("encoder was not stopped with the last client")
+	}
+	if _, err := os.Stat(started); !os.IsNotExist(err) {
+		t.Errorf("ffmpeg was started again without clients: %v", err)
+	}
+}
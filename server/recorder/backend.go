@@ -0,0 +1,287 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// Config selects how video is captured.
+type Config struct {
+	// Backend is "rtsp", "rpicam-vid", "libcamera-vid", "raspivid" or
+	// "v4l2". If it is empty or "auto", the first of these that is
+	// available is used, in that order.
+	Backend string `json:"backend"`
+
+	// Device and Format are the ffmpeg input and input format used by
+	// the v4l2 backend. They default to /dev/video0 and v4l2; with the
+	// lavfi format, the device can be a test source such as
+	// "testsrc=size=640x480:rate=30".
+	Device string `json:"device"`
+	Format string `json:"format"`
+
+	// URL is the stream used by the rtsp backend, for example
+	// "rtsp://192.168.1.64:554/stream1". Username and Password are used
+	// if the camera asks for credentials; they can also be given in the
+	// URL.
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// Container is the container that segments are handed to
+	// subscribers in: "ts" (MPEG-TS, the default) or "fmp4"
+	// (fragmented MP4).
+	Container string `json:"container"`
+}
+
+const (
+	ContainerTS   = "ts"
+	ContainerFMP4 = "fmp4"
+)
+
+// container returns the configured container, checking that it is known.
+func (c Config) container() (string, error) {
+	switch c.Container {
+	case "", ContainerTS:
+		return ContainerTS, nil
+	case ContainerFMP4:
+		return ContainerFMP4, nil
+	default:
+		return "", errors.New("unknown container: " + c.Container)
+	}
+}
+
+// backend captures video into a new file named after segmentPath, a printf
+// format taking the segment number, every SegmentDuration milliseconds.
+// Files are either raw H.264, which is muxed into the configured container
+// before it is handed to subscribers, or MPEG-TS. Frames are only read
+// from raw H.264, so backends that write MPEG-TS can implement
+// frameFileWriter to have frames read.
+type backend interface {
+	name() string
+
+	// extension is ".h264" or ".ts".
+	extension() string
+
+	// check returns an error if the backend cannot be used.
+	check() error
+
+	// start starts capturing. The returned channel receives the result
+	// once capturing stops, which it must do when ctx is cancelled.
+	start(ctx context.Context, settings Settings, segmentPath string) (<-chan error, error)
+}
+
+// framesExtension is the extension of the raw H.264 files that frames are
+// read from.
+const framesExtension = ".h264"
+
+// frameFileWriter is implemented by backends that write MPEG-TS segments
+// and, alongside each one, the same video as raw H.264 in a file with the
+// same name but framesExtension.
+type frameFileWriter interface {
+	writesFrameFiles()
+}
+
+// readsFrames returns whether frames can be read from the files written by
+// a backend.
+func readsFrames(b backend) bool {
+	if _, ok := b.(frameFileWriter); ok {
+		return true
+	}
+
+	return b.extension() == framesExtension
+}
+
+// settingsChecker is implemented by backends that cannot apply every
+// setting, so that settings they would ignore are rejected instead.
+type settingsChecker interface {
+	checkSettings(settings Settings) error
+}
+
+// checkSettings returns an error if a backend cannot apply the settings.
+func checkSettings(b backend, settings Settings) error {
+	if c, ok := b.(settingsChecker); ok {
+		return c.checkSettings(settings)
+	}
+
+	return nil
+}
+
+// startCommand starts a capture program.
+func startCommand(ctx context.Context, program string, args []string) (<-chan error, error) {
+	cmd := exec.CommandContext(ctx, program, args...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	return done, nil
+}
+
+type raspividBackend struct{}
+
+func (raspividBackend) name() string {
+	return "raspivid"
+}
+
+func (raspividBackend) extension() string {
+	return ".h264"
+}
+
+func (b raspividBackend) check() error {
+	_, err := exec.LookPath(b.name())
+	return err
+}
+
+func (b raspividBackend) start(ctx context.Context, settings Settings, segmentPath string) (<-chan error, error) {
+	return startCommand(ctx, b.name(), b.args(settings, segmentPath))
+}
+
+func (raspividBackend) args(s Settings, segmentPath string) []string {
+	// Flushing after every frame lets live streaming read the segment
+	// while it is being written.
+	args := []string{
+		"--timeout", "0",
+		"--inline",
+		"--flush",
+		"--segment", strconv.Itoa(s.SegmentDuration),
+		"--width", strconv.Itoa(s.Width),
+		"--height", strconv.Itoa(s.Height),
+		"-b", strconv.Itoa(s.BitRate),
+		"-fps", strconv.Itoa(s.Framerate),
+	}
+	if len(s.Exposure) != 0 {
+		args = append(args, "-ex", s.Exposure)
+	}
+	if len(s.AWB) != 0 {
+		args = append(args, "-awb", s.AWB)
+	}
+
+	return append(args, "-o", segmentPath)
+}
+
+// libcameraBackend runs libcamera-vid, or rpicam-vid, which is the same
+// program renamed in later releases of Raspberry Pi OS.
+type libcameraBackend struct {
+	command string
+}
+
+// libcameraExposureModes and libcameraAWBModes map the raspivid modes
+// accepted in settings to their nearest libcamera equivalents. Modes that
+// have no equivalent are left at the camera's defaults.
+var libcameraExposureModes = map[string]string{
+	"auto": "normal", "night": "long", "nightpreview": "long",
+	"verylong": "long", "sports": "sport", "antishake": "sport",
+}
+
+var libcameraAWBModes = map[string]string{
+	"auto": "auto", "sun": "daylight", "cloud": "cloudy", "shade": "cloudy",
+	"tungsten": "tungsten", "fluorescent": "fluorescent",
+	"incandescent": "incandescent", "flash": "daylight", "horizon": "incandescent",
+}
+
+func (b libcameraBackend) name() string {
+	return b.command
+}
+
+func (libcameraBackend) extension() string {
+	return ".h264"
+}
+
+func (b libcameraBackend) check() error {
+	_, err := exec.LookPath(b.command)
+	return err
+}
+
+func (b libcameraBackend) start(ctx context.Context, settings Settings, segmentPath string) (<-chan error, error) {
+	return startCommand(ctx, b.command, b.args(settings, segmentPath))
+}
+
+func (libcameraBackend) args(s Settings, segmentPath string) []string {
+	// Inline headers make every segment decodable on its own, and
+	// flushing after every frame lets live streaming read the segment
+	// while it is being written.
+	args := []string{
+		"--nopreview",
+		"--timeout", "0",
+		"--inline",
+		"--flush",
+		"--segment", strconv.Itoa(s.SegmentDuration),
+		"--width", strconv.Itoa(s.Width),
+		"--height", strconv.Itoa(s.Height),
+		"--bitrate", strconv.Itoa(s.BitRate),
+		"--framerate", strconv.Itoa(s.Framerate),
+	}
+	if mode, ok := libcameraExposureModes[s.Exposure]; ok {
+		args = append(args, "--exposure", mode)
+	}
+	if mode, ok := libcameraAWBModes[s.AWB]; ok {
+		args = append(args, "--awb", mode)
+	}
+
+	return append(args, "-o", segmentPath)
+}
+
+// findBackend returns the backend named in the config, or the first
+// available backend if the name is empty or "auto".
+func findBackend(config Config) (backend, error) {
+	backends := []backend{
+		newRTSPBackend(config),
+		libcameraBackend{command: "rpicam-vid"},
+		libcameraBackend{command: "libcamera-vid"},
+		raspividBackend{},
+		newV4L2Backend(config),
+	}
+
+	if len(config.Backend) == 0 || config.Backend == "auto" {
+		for _, b := range backends {
+			if b.check() == nil {
+				return b, nil
+			}
+		}
+
+		return nil, errors.New("no supported capture program or device found")
+	}
+
+	for _, b := range backends {
+		if b.name() == config.Backend {
+			if err := b.check(); err != nil {
+				return nil, err
+			}
+			return b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown recorder backend: %s", config.Backend)
+}
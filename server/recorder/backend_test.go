@@ -0,0 +1,283 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProgramEnv makes the test binary act as the named program instead of
+// running the tests, so that capture programs can be faked on the PATH.
+const fakeProgramEnv = "PCG_TEST_FAKE_PROGRAM"
+
+// fakeArgsEnv names a file that fake programs append their arguments to.
+const fakeArgsEnv = "PCG_TEST_FAKE_ARGS"
+
+func TestMain(m *testing.M) {
+	program := os.Getenv(fakeProgramEnv)
+	if len(program) == 0 {
+		os.Exit(m.Run())
+	}
+
+	if argsPath := os.Getenv(fakeArgsEnv); len(argsPath) != 0 {
+		f, err := os.OpenFile(argsPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err == nil {
+			fmt.Fprintln(f, program, strings.Join(os.Args[1:], " "))
+			f.Close()
+		}
+	}
+
+	var err error
+	switch program {
+	case "rpicam-vid", "libcamera-vid":
+		err = fakeLibcameraVid(os.Args[1:])
+	case "ffmpeg":
+		err = fakeFFmpeg(os.Args[1:])
+	default:
+		err = errors.New("unknown fake program: " + program)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// installFakeProgram puts a program named name in dir that runs the test
+// binary as that program.
+func installFakeProgram(t *testing.T, dir, name string) {
+	t.Helper()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := fmt.Sprintf("#!/bin/sh\n%s=%s exec '%s' \"$@\"\n", fakeProgramEnv, name, executable)
+	if err := ioutil.WriteFile(path.Join(dir, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeLibcameraVid accepts the options of libcamera-vid that the backend
+// uses, and writes mock H.264 segments until it is killed.
+func fakeLibcameraVid(args []string) error {
+	flags := flag.NewFlagSet("libcamera-vid", flag.ContinueOnError)
+	flags.Bool("nopreview", false, "")
+	flags.Bool("inline", false, "")
+	flags.Bool("flush", false, "")
+	timeout := flags.Int("timeout", 5000, "")
+	segment := flags.Int("segment", 0, "")
+	width := flags.Int("width", 0, "")
+	height := flags.Int("height", 0, "")
+	flags.Int("bitrate", 0, "")
+	framerate := flags.Int("framerate", 30, "")
+	exposure := flags.String("exposure", "normal", "")
+	awb := flags.String("awb", "auto", "")
+	output := flags.String("o", "", "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *timeout != 0 || *segment <= 0 || len(*output) == 0 || flags.NArg() != 0 {
+		return errors.New("unexpected arguments: " + strings.Join(args, " "))
+	}
+	modes := map[string]bool{}
+	for _, mode := range libcameraExposureModes {
+		modes[mode] = true
+	}
+	for _, mode := range libcameraAWBModes {
+		modes[mode] = true
+	}
+	if !modes[*exposure] || !modes[*awb] {
+		return errors.New("unknown mode")
+	}
+
+	return writeMockSegments(*width, *height, *framerate, *segment, *output)
+}
+
+// writeMockSegments writes mock H.264 segments of the given duration in
+// milliseconds to files named after each of segmentPaths until it is
+// killed.
+func writeMockSegments(width, height, framerate, segmentDuration int, segmentPaths ...string) error {
+	stream := newMockStream(Settings{Width: width, Height: height})
+	framesPerSegment := segmentDuration * framerate / 1000
+	for i := 0; ; i++ {
+		data := stream.frame(i % framesPerSegment)
+		if i%framesPerSegment == 0 {
+			data = stream.keyFrame(i)
+		}
+
+		for _, segmentPath := range segmentPaths {
+			name := fmt.Sprintf(segmentPath, i/framesPerSegment)
+			f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = f.Write(data)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		time.Sleep(time.Second / time.Duration(framerate))
+	}
+}
+
+// fakeFFmpeg captures mock H.264 segments to each output of the tee muxer,
+// as used by the v4l2 backend, and otherwise copies its input to its
+// output, which is its last argument, in place of muxing it.
+func fakeFFmpeg(args []string) error {
+	options := map[string]string{}
+	for i := 0; i < len(args)-2; i++ {
+		if strings.HasPrefix(args[i], "-") {
+			options[args[i]] = args[i+1]
+		}
+	}
+
+	output := args[len(args)-1]
+	if options["-f"] == "tee" {
+		var width, height int
+		if _, err := fmt.Sscanf(options["-vf"], "scale=%d:%d", &width, &height); err != nil {
+			return err
+		}
+		framerate, err := strconv.Atoi(options["-r"])
+		if err != nil {
+			return err
+		}
+
+		// Each output is "[option=value:...]path".
+		var segmentPaths []string
+		seconds := 0.0
+		for _, teeOutput := range strings.Split(output, "|") {
+			end := strings.Index(teeOutput, "]")
+			if !strings.HasPrefix(teeOutput, "[") || end < 0 {
+				return errors.New("invalid tee output: " + teeOutput)
+			}
+			for _, option := range strings.Split(teeOutput[1:end], ":") {
+				if strings.HasPrefix(option, "segment_time=") {
+					if seconds, err = strconv.ParseFloat(strings.TrimPrefix(option, "segment_time="), 64); err != nil {
+						return err
+					}
+				}
+			}
+			segmentPaths = append(segmentPaths, teeOutput[end+1:])
+		}
+		if seconds <= 0 {
+			return errors.New("no segment time: " + output)
+		}
+
+		return writeMockSegments(width, height, framerate, int(seconds*1000), segmentPaths...)
+	}
+
+	b, err := ioutil.ReadFile(options["-i"])
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output, b, 0644)
+}
+
+func TestLibcameraBackend(t *testing.T) {
+	dir := t.TempDir()
+	installFakeProgram(t, dir, "rpicam-vid")
+	installFakeProgram(t, dir, "ffmpeg")
+	t.Setenv("PATH", dir)
+	t.Setenv(fakeArgsEnv, path.Join(dir, "args"))
+
+	b, err := findBackend(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.name() != "rpicam-vid" {
+		t.Fatalf("found backend %s, want rpicam-vid", b.name())
+	}
+
+	r := newTestRecorder(t, b)
+	r.settings.Exposure = "night"
+	r.settings.AWB = "sun"
+	subscriber := &testSubscriber{}
+	r.AddSubscriber(subscriber)
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	waitFor(t, 10*time.Second, "a segment", func() bool {
+		subscriber.mutex.Lock()
+		defer subscriber.mutex.Unlock()
+		return len(subscriber.segments) != 0
+	})
+
+	subscriber.mutex.Lock()
+	if !subscriber.frames[0].KeyFrame || len(subscriber.frames) < 8 {
+		t.Errorf("got %d frames, starting with %+v", len(subscriber.frames), subscriber.frames[0])
+	}
+	if name := path.Base(subscriber.segments[0]); name != "segment000000000000.ts" {
+		t.Errorf("got segment %s", name)
+	}
+	subscriber.mutex.Unlock()
+
+	argsFile, err := ioutil.ReadFile(path.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := string(argsFile)
+	for _, want := range []string{"rpicam-vid --nopreview", "--segment 1000", "--width 64", "--exposure long", "--awb daylight", "ffmpeg -framerate 10 -i"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("arguments do not contain %q:\n%s", want, args)
+		}
+	}
+}
+
+func TestFindBackend(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PATH", dir)
+	if _, err := findBackend(Config{}); err == nil {
+		t.Error("found a backend without any capture program")
+	}
+	if _, err := findBackend(Config{Backend: "rpicam-vid"}); err == nil {
+		t.Error("found rpicam-vid without it being installed")
+	}
+
+	installFakeProgram(t, dir, "libcamera-vid")
+	if b, err := findBackend(Config{}); err != nil || b.name() != "libcamera-vid" {
+		t.Errorf("found backend %v, %v, want libcamera-vid", b, err)
+	}
+	if b, err := findBackend(Config{URL: "rtsp://127.0.0.1:8554/stream"}); err != nil || b.name() != "rtsp" {
+		t.Errorf("found backend %v, %v, want rtsp", b, err)
+	}
+	if _, err := findBackend(Config{Backend: "other"}); err == nil {
+		t.Error("found an unknown backend")
+	}
+}
@@ -0,0 +1,323 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Frame is a single H.264 access unit read from the capture program's
+// output as it is written.
+type Frame struct {
+	// Time is the frame's presentation time, counted from the start of
+	// the capture process at the configured framerate.
+	Time     time.Duration
+	KeyFrame bool
+
+	// Data holds the frame's NAL units in Annex B format.
+	Data []byte
+}
+
+// FrameSubscriber is implemented by subscribers that need every frame as
+// soon as it has been captured, rather than whole segments. Frames are
+// only available from backends that write raw H.264.
+type FrameSubscriber interface {
+	FrameCaptured(frame Frame)
+}
+
+// NALUnits returns the frame's NAL units, without their start codes.
+func (f Frame) NALUnits() [][]byte {
+	var nals [][]byte
+	start := startCode(f.Data, 0)
+	for start >= 0 {
+		next := startCode(f.Data, start+3)
+		end := next
+		if next < 0 {
+			end = len(f.Data)
+		}
+
+		// Trailing zeros belong to the next four-byte start code.
+		for end > start+3 && f.Data[end-1] == 0 {
+			end--
+		}
+		if end > start+3 {
+			nals = append(nals, f.Data[start+3:end])
+		}
+		start = next
+	}
+
+	return nals
+}
+
+func frameSubscribers(subscribers []Subscriber) []FrameSubscriber {
+	var result []FrameSubscriber
+	for _, subscriber := range subscribers {
+		if s, ok := subscriber.(FrameSubscriber); ok {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+// NAL unit types used to find the boundaries between access units.
+const (
+	nalSlice     = 1
+	nalIDR       = 5
+	nalSEI       = 6
+	nalSPS       = 7
+	nalPPS       = 8
+	nalDelimiter = 9
+)
+
+// accessUnitParser splits an Annex B stream into access units. Data may
+// be written in pieces of any size; an access unit is emitted once the
+// first NAL unit of the next one has been seen.
+type accessUnitParser struct {
+	buf []byte
+
+	au       []byte
+	auHasVCL bool
+	auKey    bool
+}
+
+// startCode returns the index of the next three-byte start code in b at
+// or after i, or -1 if there is none.
+func startCode(b []byte, i int) int {
+	for ; i+2 < len(b); i++ {
+		if b[i] == 0 && b[i+1] == 0 && b[i+2] == 1 {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (p *accessUnitParser) write(data []byte, emit func(au []byte, keyFrame bool)) {
+	p.buf = append(p.buf, data...)
+
+	start := startCode(p.buf, 0)
+	if start < 0 {
+		return
+	}
+	for {
+		next := startCode(p.buf, start+3)
+		if next < 0 {
+			break
+		}
+
+		// Trailing zeros belong to the next four-byte start code.
+		end := next
+		for end > start+3 && p.buf[end-1] == 0 {
+			end--
+		}
+		p.nal(p.buf[start+3:end], emit)
+		start = next
+	}
+
+	p.buf = append(p.buf[:0], p.buf[start:]...)
+}
+
+// flush emits the access unit at the end of the stream.
+func (p *accessUnitParser) flush(emit func(au []byte, keyFrame bool)) {
+	if start := startCode(p.buf, 0); start >= 0 {
+		p.nal(p.buf[start+3:], emit)
+	}
+	p.buf = p.buf[:0]
+
+	if p.auHasVCL {
+		emit(p.au, p.auKey)
+	}
+	p.au, p.auHasVCL, p.auKey = nil, false, false
+}
+
+// h264Duration returns the duration of a raw H.264 file, which has no
+// timing of its own, by counting its frames.
+func h264Duration(filePath string, framerate int) (time.Duration, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var parser accessUnitParser
+	frames := 0
+	count := func(au []byte, keyFrame bool) {
+		frames++
+	}
+	if err := readAll(file, make([]byte, 64*1024), &parser, count); err != nil {
+		return 0, err
+	}
+	parser.flush(count)
+
+	return time.Duration(frames) * time.Second / time.Duration(framerate), nil
+}
+
+func (p *accessUnitParser) nal(nal []byte, emit func(au []byte, keyFrame bool)) {
+	if len(nal) == 0 {
+		return
+	}
+
+	nalType := nal[0] & 0x1f
+	vcl := nalType == nalSlice || nalType == nalIDR
+
+	// A new access unit starts with a non-VCL unit that follows a
+	// picture, or with the first slice (first_mb_in_slice of zero) of
+	// the next picture.
+	newAU := false
+	switch {
+	case nalType >= nalSEI && nalType <= nalDelimiter:
+		newAU = p.auHasVCL
+	case vcl:
+		newAU = p.auHasVCL && len(nal) > 1 && nal[1]&0x80 != 0
+	}
+	if newAU {
+		emit(p.au, p.auKey)
+		p.au, p.auHasVCL, p.auKey = nil, false, false
+	}
+
+	p.au = append(p.au, 0, 0, 0, 1)
+	p.au = append(p.au, nal...)
+	if vcl {
+		p.auHasVCL = true
+	}
+	if nalType == nalIDR {
+		p.auKey = true
+	}
+}
+
+// nextFile returns the name of the oldest raw H.264 file written by the
+// capture program after the given one, or an empty string if there is
+// none.
+func (r *recorderImpl) nextFile(after string) (string, error) {
+	files, err := ioutil.ReadDir(r.recorderDir)
+	if err != nil {
+		return "", err
+	}
+
+	for _, fileInfo := range files {
+		if strings.HasSuffix(fileInfo.Name(), framesExtension) && fileInfo.Name() > after {
+			return fileInfo.Name(), nil
+		}
+	}
+
+	return "", nil
+}
+
+// framesLoop follows the raw H.264 files written by the capture program as
+// they grow and hands each frame to the subscribers that want frames. It
+// does nothing until there is such a subscriber. The subscribers are looked
+// up again for every frame, so that ones added later are included.
+func (r *recorderImpl) framesLoop(ctx context.Context, settings Settings) {
+	for ctx.Err() == nil && len(frameSubscribers(r.currentSubscribers())) == 0 {
+		time.Sleep(time.Second)
+	}
+
+	frameDuration := time.Second / time.Duration(settings.Framerate)
+	frames := 0
+	emit := func(au []byte, keyFrame bool) {
+		frame := Frame{
+			Time:     time.Duration(frames) * frameDuration,
+			KeyFrame: keyFrame,
+			Data:     au,
+		}
+		frames++
+
+		for _, subscriber := range frameSubscribers(r.currentSubscribers()) {
+			subscriber.FrameCaptured(frame)
+		}
+	}
+
+	var parser accessUnitParser
+	var file *os.File
+	name := ""
+	buf := make([]byte, 64*1024)
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if file != nil {
+			if err := readAll(file, buf, &parser, emit); err != nil {
+				fmt.Println("Unable to read capture file:", err)
+			}
+		}
+
+		// Start with the file being written. Once the capture program
+		// has moved on to the next file, the current one is complete and
+		// can be read to the end.
+		var next string
+		var err error
+		if file == nil && len(name) == 0 {
+			next, err = r.newestFile(framesExtension)
+		} else {
+			next, err = r.nextFile(name)
+		}
+		if err != nil {
+			fmt.Println("Unable to find capture file:", err)
+		}
+		if len(next) == 0 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		if file != nil {
+			readAll(file, buf, &parser, emit)
+			file.Close()
+			file = nil
+		}
+
+		// A file that has already been muxed and removed is skipped.
+		name = next
+		if f, err := os.Open(path.Join(r.recorderDir, name)); err == nil {
+			file = f
+		}
+	}
+}
+
+// readAll reads a file from its current position to its end.
+func readAll(file *os.File, buf []byte, parser *accessUnitParser, emit func(au []byte, keyFrame bool)) error {
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			parser.write(buf[:n], emit)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSubscriber collects the frames and segments it is given.
+type testSubscriber struct {
+	mutex    sync.Mutex
+	frames   []Frame
+	segments []string
+}
+
+func (s *testSubscriber) VideoRecorded(filePath string, created, modified time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.segments = append(s.segments, filePath)
+}
+
+func (s *testSubscriber) FrameCaptured(frame Frame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.frames = append(s.frames, frame)
+}
+
+func (s *testSubscriber) frameCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.frames)
+}
+
+// waitFor polls cond until it returns true or the timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testSettings keeps generated frames small.
+var testSettings = Settings{
+	Width:           64,
+	Height:          48,
+	BitRate:         100000,
+	SegmentDuration: 1000,
+	Framerate:       10,
+}
+
+func newTestRecorder(t *testing.T, b backend) *recorderImpl {
+	return &recorderImpl{
+		backend:          b,
+		container:        ContainerTS,
+		recorderDir:      t.TempDir(),
+		settings:         testSettings,
+		profile:          DefaultProfile,
+		mutex:            &sync.Mutex{},
+		settingsMutex:    &sync.Mutex{},
+		filesMutex:       &sync.Mutex{},
+		subscribersMutex: &sync.Mutex{},
+	}
+}
+
+// writeFrames appends a key frame followed by count-1 other frames to the
+// named file in the recorder's directory.
+func writeFrames(t *testing.T, r *recorderImpl, name string, count int) {
+	t.Helper()
+	f, err := os.OpenFile(path.Join(r.recorderDir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stream := newMockStream(r.settings)
+	for i := 0; i < count; i++ {
+		data := stream.frame(i)
+		if i == 0 {
+			data = stream.keyFrame(0)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFrameNALUnits(t *testing.T) {
+	frame := Frame{Data: []byte{0, 0, 0, 1, 0x67, 1, 2, 0, 0, 1, 0x68, 3, 0, 0, 0, 1, 0x65, 4, 5}}
+	nals := frame.NALUnits()
+	if len(nals) != 3 {
+		t.Fatalf("got %d NAL units, want 3", len(nals))
+	}
+	for i, want := range []byte{0x67, 0x68, 0x65} {
+		if nals[i][0] != want {
+			t.Errorf("NAL unit %d starts with %#x, want %#x", i, nals[i][0], want)
+		}
+	}
+	if len(nals[1]) != 2 {
+		t.Errorf("second NAL unit is %d bytes, want 2", len(nals[1]))
+	}
+}
+
+func TestAccessUnitParser(t *testing.T) {
+	stream := newMockStream(testSettings)
+	var data []byte
+	data = append(data, stream.keyFrame(0)...)
+	for i := 1; i < 5; i++ {
+		data = append(data, stream.frame(i)...)
+	}
+	data = append(data, stream.keyFrame(1)...)
+
+	// Write the stream a few bytes at a time, so that start codes are
+	// split between writes.
+	var keyFrames []bool
+	var parser accessUnitParser
+	emit := func(au []byte, keyFrame bool) {
+		keyFrames = append(keyFrames, keyFrame)
+	}
+	for i := 0; i < len(data); i += 7 {
+		end := i + 7
+		if end > len(data) {
+			end = len(data)
+		}
+		parser.write(data[i:end], emit)
+	}
+
+	// The last access unit is only emitted once the next one starts.
+	want := []bool{true, false, false, false, false}
+	if len(keyFrames) != len(want) {
+		t.Fatalf("got %d access units, want %d", len(keyFrames), len(want))
+	}
+	for i := range want {
+		if keyFrames[i] != want[i] {
+			t.Errorf("access unit %d: key frame is %v, want %v", i, keyFrames[i], want[i])
+		}
+	}
+}
+
+// TestFramesLoopLateSubscriber checks that subscribers added after the
+// frames loop has started are given frames too, as they are when the live
+// stream and other outputs subscribe after the recorder starts.
+func TestFramesLoopLateSubscriber(t *testing.T) {
+	r := newTestRecorder(t, libcameraBackend{command: "rpicam-vid"})
+	name := "segment000000000000.h264"
+	writeFrames(t, r, name, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		r.framesLoop(ctx, r.settings)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The last two frames written are held back until the start of the
+	// next frame has been read.
+	first := &testSubscriber{}
+	r.AddSubscriber(first)
+	waitFor(t, 5*time.Second, "frames for the first subscriber", func() bool {
+		return first.frameCount() >= 8
+	})
+
+	second := &testSubscriber{}
+	r.AddSubscriber(second)
+	writeFrames(t, r, name, 10)
+	waitFor(t, 5*time.Second, "frames for the second subscriber", func() bool {
+		return second.frameCount() >= 10
+	})
+	if n := first.frameCount(); n < 18 {
+		t.Errorf("first subscriber got %d frames, want at least 18", n)
+	}
+	if second.frames[2].Time != first.frames[10].Time || !second.frames[2].KeyFrame {
+		t.Error("second subscriber did not get the key frame written after it subscribed")
+	}
+}
@@ -27,6 +27,7 @@ package recorder
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -34,57 +35,137 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/joshb/pi-camera-go/server/util"
 )
 
-type recorderImpl struct {
-	cancelFunc  context.CancelFunc
-	cmd         *exec.Cmd
+const settingsFileName = "settings.json"
 
-	recorderDir     string
-	segmentDuration time.Duration
-	width           int
-	height          int
-	bitRate         int
+// startupTime is how long a restarted capture process has to keep running
+// before it is considered to have started successfully.
+const startupTime = time.Second
 
-	subscribers []Subscriber
+type recorderImpl struct {
+	cancelFunc context.CancelFunc
+	done       <-chan error
+
+	backend     backend
+	container   string
+	recorderDir string
+	settings    Settings
+	profile     Profile
+
+	// timestampOffset is where the timestamps of the next fragmented MP4
+	// segment start, so that segments continue one another. It is
+	// guarded by filesMutex.
+	timestampOffset time.Duration
+
+	// subscribers is guarded by subscribersMutex, since subscribers may
+	// be added while the recorder's goroutines are reading it.
+	subscribers      []Subscriber
+	subscribersMutex *sync.Mutex
+
+	// mutex guards the capture process and is held while it is
+	// reconfigured, and filesMutex keeps the recorded files from being
+	// processed twice at once. Settings and profile are only changed
+	// with both mutex and settingsMutex held, so either is enough to
+	// read them; settingsMutex is never held for long.
+	mutex         *sync.Mutex
+	settingsMutex *sync.Mutex
+	filesMutex    *sync.Mutex
 }
 
-func New() (Recorder, error) {
-	recorderDir, err := util.ConfigDir("recorder")
+// New creates a recorder. Its files and settings are kept in a directory
+// named after the namespace, which may be empty if there is only one
+// recorder.
+func New(config Config, namespace string) (Recorder, error) {
+	container, err := config.container()
 	if err != nil {
 		return nil, err
 	}
 
+	backend, err := findBackend(config)
+	if err != nil {
+		return nil, err
+	}
+
+	recorderDir, err := util.ConfigDir("recorder", namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := loadSettings(path.Join(recorderDir, settingsFileName))
+	if err != nil {
+		fmt.Println("Unable to load recorder settings:", err)
+	}
+
+	println("Using recorder backend", backend.name())
 	return &recorderImpl{
-		recorderDir:     recorderDir,
-		segmentDuration: 5 * time.Second,
-		width:           640,
-		height:          480,
-		bitRate:         4000000,
+		backend:          backend,
+		container:        container,
+		recorderDir:      recorderDir,
+		settings:         settings,
+		profile:          DefaultProfile,
+		mutex:            &sync.Mutex{},
+		settingsMutex:    &sync.Mutex{},
+		filesMutex:       &sync.Mutex{},
+		subscribersMutex: &sync.Mutex{},
 	}, nil
 }
 
-func (r *recorderImpl) muxFile(name string) (string, error) {
+// activeSettings returns the configured settings with the current profile
+// applied. The caller must hold mutex or settingsMutex.
+func (r *recorderImpl) activeSettings() Settings {
+	return r.profile.Settings.merge(r.settings)
+}
+
+func (r *recorderImpl) muxFile(name string, settings Settings) (string, error) {
 	t := time.Now()
 
 	inPath := path.Join(r.recorderDir, name)
-	newName := strings.Replace(name, ".h264", ".ts", 1)
+	newName := strings.TrimSuffix(name, path.Ext(name)) + ".ts"
+	if r.container == ContainerFMP4 {
+		newName = strings.TrimSuffix(name, path.Ext(name)) + ".mp4"
+	}
 	outPath := path.Join(r.recorderDir, newName)
 
-	// Use ffmpeg to mux the file.
-	args := []string{
-		"-i", inPath,
-		"-codec", "copy",
-		outPath,
+	// Use ffmpeg to mux the file. Raw H.264 carries no timing, so the
+	// capture framerate must be given.
+	var args []string
+	if strings.HasSuffix(name, ".h264") {
+		args = append(args, "-framerate", strconv.Itoa(settings.Framerate))
+	}
+	args = append(args, "-i", inPath, "-codec", "copy")
+	if r.container == ContainerFMP4 {
+		// Write the moov box first and a fragment at every key frame,
+		// offsetting the timestamps so that each segment continues the
+		// previous one.
+		args = append(args,
+			"-f", "mp4",
+			"-movflags", "+frag_keyframe+empty_moov+default_base_moof",
+			"-output_ts_offset", strconv.FormatFloat(r.timestampOffset.Seconds(), 'f', 6, 64),
+		)
 	}
+	args = append(args, outPath)
 	cmd := exec.Command("ffmpeg", args...)
 	if err := cmd.Run(); err != nil {
 		return "", err
 	}
 
+	if r.container == ContainerFMP4 {
+		// Segments are not exactly as long as the segment duration,
+		// so raw H.264 segments are measured.
+		duration := settings.segmentDuration()
+		if strings.HasSuffix(name, ".h264") {
+			if d, err := h264Duration(inPath, settings.Framerate); err == nil && d > 0 {
+				duration = d
+			}
+		}
+		r.timestampOffset += duration
+	}
+
 	// Remove the input file.
 	if err := os.Remove(inPath); err != nil {
 		return "", err
@@ -96,6 +177,12 @@ func (r *recorderImpl) muxFile(name string) (string, error) {
 	return outPath, nil
 }
 
+// isCaptureFile returns whether a file in the recorder directory was
+// written by a capture program.
+func isCaptureFile(name string) bool {
+	return strings.HasSuffix(name, ".h264") || strings.HasSuffix(name, ".ts") || strings.HasSuffix(name, ".mp4")
+}
+
 func (r *recorderImpl) deleteFiles() error {
 	files, err := ioutil.ReadDir(r.recorderDir)
 	if err != nil {
@@ -103,7 +190,7 @@ func (r *recorderImpl) deleteFiles() error {
 	}
 
 	for _, fileInfo := range files {
-		if !strings.HasSuffix(fileInfo.Name(), ".h264") {
+		if !isCaptureFile(fileInfo.Name()) {
 			continue
 		}
 
@@ -116,17 +203,32 @@ func (r *recorderImpl) deleteFiles() error {
 	return nil
 }
 
-func (r *recorderImpl) checkFiles() error {
+func (r *recorderImpl) checkFiles(settings Settings) error {
+	r.filesMutex.Lock()
+	defer r.filesMutex.Unlock()
+
 	allFiles, err := ioutil.ReadDir(r.recorderDir)
 	if err != nil {
 		return err
 	}
 
-	// Build a list of .h264 files.
+	// Build a list of files written by the capture program, and of the
+	// raw H.264 files written alongside MPEG-TS segments for frames.
 	files := make([]os.FileInfo, 0, len(allFiles))
+	frameFiles := make([]os.FileInfo, 0)
 	for _, fileInfo := range allFiles {
-		if strings.HasSuffix(fileInfo.Name(), ".h264") {
+		if strings.HasSuffix(fileInfo.Name(), r.backend.extension()) {
 			files = append(files, fileInfo)
+		} else if strings.HasSuffix(fileInfo.Name(), framesExtension) {
+			frameFiles = append(frameFiles, fileInfo)
+		}
+	}
+
+	// Frames are only read from the newest of those. One that is still
+	// open is read to its end after it has been removed.
+	for i := 0; i < len(frameFiles)-1; i++ {
+		if err := os.Remove(path.Join(r.recorderDir, frameFiles[i].Name())); err != nil {
+			return err
 		}
 	}
 
@@ -138,14 +240,17 @@ func (r *recorderImpl) checkFiles() error {
 
 	// Notify subscribers of any new video files and then remove them.
 	for _, fileInfo := range files[:filesLen-1] {
-		filePath, err := r.muxFile(fileInfo.Name())
-		if err != nil {
-			return err
+		filePath := path.Join(r.recorderDir, fileInfo.Name())
+		if strings.HasSuffix(filePath, ".h264") || r.container != ContainerTS {
+			filePath, err = r.muxFile(fileInfo.Name(), settings)
+			if err != nil {
+				return err
+			}
 		}
 
 		created := time.Now()
-		modified := created.Add(r.segmentDuration)
-		for _, subscriber := range r.subscribers {
+		modified := created.Add(settings.segmentDuration())
+		for _, subscriber := range r.currentSubscribers() {
 			subscriber.VideoRecorded(filePath, created, modified)
 		}
 
@@ -158,9 +263,9 @@ func (r *recorderImpl) checkFiles() error {
 	return nil
 }
 
-func (r *recorderImpl) checkFilesLoop() {
-	for r.cmd != nil {
-		if err := r.checkFiles(); err != nil {
+func (r *recorderImpl) checkFilesLoop(ctx context.Context, settings Settings) {
+	for ctx.Err() == nil {
+		if err := r.checkFiles(settings); err != nil {
 			fmt.Println("Error when checking files:", err)
 		}
 
@@ -168,46 +273,246 @@ func (r *recorderImpl) checkFilesLoop() {
 	}
 }
 
+// newestFile returns the name of the most recent file with the given
+// extension written by the capture program, or an empty string if there is
+// none.
+func (r *recorderImpl) newestFile(extension string) (string, error) {
+	files, err := ioutil.ReadDir(r.recorderDir)
+	if err != nil {
+		return "", err
+	}
+
+	newest := ""
+	for _, fileInfo := range files {
+		if strings.HasSuffix(fileInfo.Name(), extension) && fileInfo.Name() > newest {
+			newest = fileInfo.Name()
+		}
+	}
+
+	return newest, nil
+}
+
+// waitForSegmentBoundary waits until the capture process starts a new
+// segment file, so that stopping it does not cut a segment short.
+func (r *recorderImpl) waitForSegmentBoundary(segmentDuration time.Duration) error {
+	current, err := r.newestFile(r.backend.extension())
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(2 * segmentDuration)
+	for time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+
+		newest, err := r.newestFile(r.backend.extension())
+		if err != nil {
+			return err
+		}
+		if newest != current {
+			return nil
+		}
+	}
+
+	return errors.New("timed out waiting for a segment boundary")
+}
+
 func (r *recorderImpl) Start() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.start()
+}
+
+// start starts the capture process. The caller must hold the mutex.
+func (r *recorderImpl) start() error {
+	if r.done != nil {
+		return errors.New("recorder is already running")
+	}
+
 	if err := r.deleteFiles(); err != nil {
 		return err
 	}
 
-	var ctx context.Context
+	settings := r.activeSettings()
+	if err := checkSettings(r.backend, settings); err != nil {
+		return err
+	}
+
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	segmentPath := path.Join(r.recorderDir, "segment%012d.h264")
-	args := []string{
-		"--segment", strconv.Itoa(int(r.segmentDuration / time.Millisecond)),
-		"--timeout", "0",
-		"--width", strconv.Itoa(r.width),
-		"--height", strconv.Itoa(r.height),
-		"-b", strconv.Itoa(r.bitRate),
-		"-o", segmentPath,
-	}
-	cmd := exec.CommandContext(ctx, "raspivid", args...)
-
-	if err := cmd.Start(); err != nil {
+	segmentPath := path.Join(r.recorderDir, "segment%012d"+r.backend.extension())
+	done, err := r.backend.start(ctx, settings, segmentPath)
+	if err != nil {
+		cancelFunc()
 		return err
 	}
 
 	r.cancelFunc = cancelFunc
-	r.cmd = cmd
+	r.done = done
 
-	go r.checkFilesLoop()
+	go r.checkFilesLoop(ctx, settings)
+	if readsFrames(r.backend) {
+		go r.framesLoop(ctx, settings)
+	}
 	return nil
 }
 
 func (r *recorderImpl) Stop() error {
-	cancelFunc, cmd := r.cancelFunc, r.cmd
-	r.cancelFunc, r.cmd = nil, nil
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.stop()
+}
+
+// stop stops the capture process. The caller must hold the mutex.
+func (r *recorderImpl) stop() error {
+	cancelFunc, done := r.cancelFunc, r.done
+	if done == nil {
+		return nil
+	}
+
+	r.cancelFunc, r.done = nil, nil
 	cancelFunc()
-	return cmd.Wait()
+	return <-done
+}
+
+// startChecked starts the capture process and makes sure that it keeps
+// running, since the capture program exits shortly after starting if it does not
+// accept its arguments. The caller must hold the mutex.
+func (r *recorderImpl) startChecked() error {
+	if err := r.start(); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-r.done:
+		r.cancelFunc()
+		r.cancelFunc, r.done = nil, nil
+		if err == nil {
+			err = errors.New("capture process exited")
+		}
+		return err
+	case <-time.After(startupTime):
+		return nil
+	}
+}
+
+// reconfigure switches to the given settings and profile, restarting the
+// capture process at a segment boundary if it is running. If the capture
+// process cannot be restarted, the previous settings and profile are
+// restored. The settings in use stay visible until the capture process is
+// restarted. The caller must hold the mutex, but not settingsMutex.
+func (r *recorderImpl) reconfigure(settings Settings, profile Profile) error {
+	if err := checkSettings(r.backend, profile.Settings.merge(settings)); err != nil {
+		return err
+	}
+
+	previousSettings, previousProfile := r.settings, r.profile
+	previous := r.activeSettings()
+
+	if r.done == nil {
+		r.setSettings(settings, profile)
+		return nil
+	}
+
+	// Restart the capture process at a segment boundary, after handing
+	// the last complete segment to the subscribers.
+	if err := r.waitForSegmentBoundary(previous.segmentDuration()); err != nil {
+		fmt.Println("Restarting recorder mid-segment:", err)
+	}
+	if err := r.checkFiles(previous); err != nil {
+		fmt.Println("Error when checking files:", err)
+	}
+	r.stop()
+
+	r.setSettings(settings, profile)
+	if err := r.startChecked(); err != nil {
+		r.setSettings(previousSettings, previousProfile)
+		if err := r.start(); err != nil {
+			fmt.Println("Unable to restart recorder with previous settings:", err)
+		}
+		return err
+	}
+
+	notifyDiscontinuity(r.currentSubscribers())
+	return nil
+}
+
+// setSettings replaces the settings and profile. The caller must hold the
+// mutex.
+func (r *recorderImpl) setSettings(settings Settings, profile Profile) {
+	r.settingsMutex.Lock()
+	defer r.settingsMutex.Unlock()
+
+	r.settings, r.profile = settings, profile
+}
+
+func (r *recorderImpl) Settings() Settings {
+	r.settingsMutex.Lock()
+	defer r.settingsMutex.Unlock()
+
+	return r.settings
+}
+
+func (r *recorderImpl) Configure(settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.reconfigure(settings, r.profile); err != nil {
+		return err
+	}
+
+	println("Applied new recorder settings")
+	if err := saveSettings(path.Join(r.recorderDir, settingsFileName), settings); err != nil {
+		return errors.New("settings were applied but could not be saved: " + err.Error())
+	}
+
+	return nil
+}
+
+func (r *recorderImpl) Profile() Profile {
+	r.settingsMutex.Lock()
+	defer r.settingsMutex.Unlock()
+
+	return r.profile
+}
+
+func (r *recorderImpl) SetProfile(profile Profile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.reconfigure(r.settings, profile); err != nil {
+		return err
+	}
+
+	println("Switched to recorder profile", profile.Name)
+	return nil
 }
 
 func (r *recorderImpl) SegmentDuration() time.Duration {
-	return r.segmentDuration
+	r.settingsMutex.Lock()
+	defer r.settingsMutex.Unlock()
+
+	return r.activeSettings().segmentDuration()
 }
 
 func (r *recorderImpl) AddSubscriber(subscriber Subscriber) {
+	r.subscribersMutex.Lock()
+	defer r.subscribersMutex.Unlock()
 	r.subscribers = append(r.subscribers, subscriber)
-}
\ No newline at end of file
+}
+
+// currentSubscribers returns a copy of the subscribers that is safe to
+// iterate over without holding subscribersMutex.
+func (r *recorderImpl) currentSubscribers() []Subscriber {
+	r.subscribersMutex.Lock()
+	defer r.subscribersMutex.Unlock()
+	return append([]Subscriber(nil), r.subscribers...)
+}
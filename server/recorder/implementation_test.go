@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// segmentBackend is a backend that writes an empty segment file at every
+// segment boundary. It exits immediately if the framerate is 5.
+type segmentBackend struct {
+	mutex  sync.Mutex
+	starts []Settings
+}
+
+func (b *segmentBackend) name() string      { return "segments" }
+func (b *segmentBackend) extension() string { return ".ts" }
+func (b *segmentBackend) check() error      { return nil }
+
+func (b *segmentBackend) start(ctx context.Context, settings Settings, segmentPath string) (<-chan error, error) {
+	b.mutex.Lock()
+	b.starts = append(b.starts, settings)
+	b.mutex.Unlock()
+
+	done := make(chan error, 1)
+	if settings.Framerate == 5 {
+		done <- errors.New("unsupported framerate")
+		return done, nil
+	}
+
+	go func() {
+		for i := 0; ; i++ {
+			if err := ioutil.WriteFile(fmt.Sprintf(segmentPath, i), nil, 0644); err != nil {
+				done <- err
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				done <- nil
+				return
+			case <-time.After(settings.segmentDuration()):
+			}
+		}
+	}()
+
+	return done, nil
+}
+
+func (b *segmentBackend) startedWith() []Settings {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]Settings(nil), b.starts...)
+}
+
+// TestSetProfile checks that the recorder can be queried while it waits
+// to restart the capture process with a new profile.
+func TestSetProfile(t *testing.T) {
+	b := &segmentBackend{}
+	r := newTestRecorder(t, b)
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	profile := Profile{Name: "long", Settings: Settings{SegmentDuration: 2000}}
+	done := make(chan error, 1)
+	go func() {
+		done <- r.SetProfile(profile)
+	}()
+
+	// The new profile becomes visible once the capture process has been
+	// restarted with it, and it is never reverted.
+	switched := false
+	for waiting := true; waiting; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			waiting = false
+		case <-time.After(50 * time.Millisecond):
+			start := time.Now()
+			d := r.SegmentDuration()
+			if time.Since(start) > 100*time.Millisecond {
+				t.Fatal("SegmentDuration blocked while switching profiles")
+			}
+			if d == 2*time.Second {
+				switched = true
+			} else if d != time.Second || switched {
+				t.Fatalf("got segment duration %v while switching profiles", d)
+			}
+		}
+	}
+
+	if d := r.SegmentDuration(); d != 2*time.Second {
+		t.Errorf("got segment duration %v after the restart", d)
+	}
+	if starts := b.startedWith(); len(starts) != 2 || starts[1].SegmentDuration != 2000 || starts[1].Width != testSettings.Width {
+		t.Errorf("capture process was started with %+v", starts)
+	}
+}
+
+// TestSetProfileFailure checks that the previous profile is restored if
+// the capture process does not accept the new one.
+func TestSetProfileFailure(t *testing.T) {
+	b := &segmentBackend{}
+	r := newTestRecorder(t, b)
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	if err := r.SetProfile(Profile{Name: "slow", Settings: Settings{Framerate: 5}}); err == nil {
+		t.Fatal("switched to a profile that the capture process does not accept")
+	}
+	if name := r.Profile().Name; name != DefaultProfile.Name {
+		t.Errorf("got profile %s after a failed switch", name)
+	}
+	if starts := b.startedWith(); len(starts) != 3 || starts[2] != testSettings {
+		t.Errorf("capture process was started with %+v", starts)
+	}
+	if r.done == nil {
+		t.Error("capture process was not restarted")
+	}
+}
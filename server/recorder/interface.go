@@ -33,10 +33,37 @@ type Subscriber interface {
 	VideoRecorded(filePath string, created, modified time.Time)
 }
 
+// DiscontinuitySubscriber is implemented by subscribers that need to know
+// when the capture process was restarted with different parameters, so
+// that the next segment does not continue the previous one.
+type DiscontinuitySubscriber interface {
+	Discontinuity()
+}
+
+func notifyDiscontinuity(subscribers []Subscriber) {
+	for _, subscriber := range subscribers {
+		if s, ok := subscriber.(DiscontinuitySubscriber); ok {
+			s.Discontinuity()
+		}
+	}
+}
+
 type Recorder interface {
 	Start() error
 	Stop() error
 
 	SegmentDuration() time.Duration
 	AddSubscriber(subscriber Subscriber)
+
+	// Profile returns the current profile. SetProfile switches to a new
+	// profile, restarting the capture process at a segment boundary if
+	// it is running.
+	Profile() Profile
+	SetProfile(profile Profile) error
+
+	// Settings returns the configured settings. Configure applies new
+	// settings in the same way as SetProfile and saves them, so that
+	// they are used again the next time the recorder is created.
+	Settings() Settings
+	Configure(settings Settings) error
 }
@@ -26,32 +26,104 @@
 package recorder
 
 import (
+	"sync"
 	"time"
 )
 
 type mockRecorder struct {
 	running bool
+	settings Settings
+	profile Profile
 	subscribers []Subscriber
+
+	// subscribersMutex guards the subscribers, which are also read by
+	// the goroutine generating frames.
+	subscribersMutex *sync.Mutex
+
+	// stopFrames stops the generated frames while the recorder is
+	// running.
+	stopFrames chan struct{}
 }
 
 func NewMock() Recorder {
-	return &mockRecorder{}
+	return &mockRecorder{settings: DefaultSettings, profile: DefaultProfile, subscribersMutex: &sync.Mutex{}}
 }
 
 func (r *mockRecorder) Start() error {
 	r.running = true
+	r.startFrames()
 	return nil
 }
 
 func (r *mockRecorder) Stop() error {
 	r.running = false
+	r.stopFramesLoop()
 	return nil
 }
 
+func (r *mockRecorder) startFrames() {
+	r.stopFrames = make(chan struct{})
+	subscribers := func() []FrameSubscriber {
+		return frameSubscribers(r.currentSubscribers())
+	}
+	go mockFramesLoop(r.profile.Settings.merge(r.settings), subscribers, r.stopFrames)
+}
+
+func (r *mockRecorder) stopFramesLoop() {
+	if r.stopFrames != nil {
+		close(r.stopFrames)
+		r.stopFrames = nil
+	}
+}
+
 func (r *mockRecorder) SegmentDuration() time.Duration {
-	return 5 * time.Second
+	return r.profile.Settings.merge(r.settings).segmentDuration()
 }
 
 func (r *mockRecorder) AddSubscriber(subscriber Subscriber) {
+	r.subscribersMutex.Lock()
+	defer r.subscribersMutex.Unlock()
 	r.subscribers = append(r.subscribers, subscriber)
 }
+
+func (r *mockRecorder) currentSubscribers() []Subscriber {
+	r.subscribersMutex.Lock()
+	defer r.subscribersMutex.Unlock()
+	return append([]Subscriber(nil), r.subscribers...)
+}
+
+func (r *mockRecorder) Profile() Profile {
+	return r.profile
+}
+
+func (r *mockRecorder) SetProfile(profile Profile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
+	r.profile = profile
+	if r.running {
+		r.stopFramesLoop()
+		r.startFrames()
+		notifyDiscontinuity(r.currentSubscribers())
+	}
+	return nil
+}
+
+func (r *mockRecorder) Settings() Settings {
+	return r.settings
+}
+
+func (r *mockRecorder) Configure(settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	r.settings = settings
+	if r.running {
+		r.stopFramesLoop()
+		r.startFrames()
+		notifyDiscontinuity(r.currentSubscribers())
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"time"
+)
+
+// The mock recorder generates a small but valid H.264 stream, so that
+// live streaming can be tried without a camera. Key frames are coded with
+// I_PCM macroblocks, which hold raw samples and need no encoder, and the
+// frames between them repeat the key frame with skipped macroblocks.
+
+// bitWriter writes the bit strings that H.264 syntax elements are made of.
+type bitWriter struct {
+	buf   []byte
+	nbits uint
+}
+
+func (b *bitWriter) u(n uint, v uint32) {
+	for i := int(n) - 1; i >= 0; i-- {
+		if b.nbits%8 == 0 {
+			b.buf = append(b.buf, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			b.buf[len(b.buf)-1] |= 0x80 >> (b.nbits % 8)
+		}
+		b.nbits++
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code.
+func (b *bitWriter) ue(v uint32) {
+	v++
+	n := uint(0)
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	b.u(n, 0)
+	b.u(n+1, v)
+}
+
+func (b *bitWriter) align() {
+	for b.nbits%8 != 0 {
+		b.u(1, 0)
+	}
+}
+
+// trailing writes the RBSP trailing bits.
+func (b *bitWriter) trailing() {
+	b.u(1, 1)
+	b.align()
+}
+
+// nal returns a NAL unit with the given header byte and RBSP, with
+// emulation prevention bytes inserted and a start code in front.
+func nal(header byte, rbsp []byte) []byte {
+	out := []byte{0, 0, 0, 1, header}
+	zeros := 0
+	for _, v := range rbsp {
+		if zeros == 2 && v <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, v)
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// mockStream generates the frames of the mock recorder's stream.
+type mockStream struct {
+	widthInMBs, heightInMBs int
+	sps, pps                []byte
+}
+
+func newMockStream(settings Settings) *mockStream {
+	s := &mockStream{
+		widthInMBs:  (settings.Width + 15) / 16,
+		heightInMBs: (settings.Height + 15) / 16,
+	}
+
+	// Constrained Baseline profile, level 3.1.
+	var b bitWriter
+	b.u(8, 66)
+	b.u(8, 0xe0)
+	b.u(8, 31)
+	b.ue(0) // seq_parameter_set_id
+	b.ue(0) // log2_max_frame_num_minus4
+	b.ue(2) // pic_order_cnt_type
+	b.ue(1) // max_num_ref_frames
+	b.u(1, 0)
+	b.ue(uint32(s.widthInMBs - 1))
+	b.ue(uint32(s.heightInMBs - 1))
+	b.u(1, 1) // frame_mbs_only_flag
+	b.u(1, 1) // direct_8x8_inference_flag
+	b.u(1, 0) // frame_cropping_flag
+	b.u(1, 0) // vui_parameters_present_flag
+	b.trailing()
+	s.sps = nal(0x67, b.buf)
+
+	b = bitWriter{}
+	b.ue(0)   // pic_parameter_set_id
+	b.ue(0)   // seq_parameter_set_id
+	b.u(1, 0) // entropy_coding_mode_flag
+	b.u(1, 0) // bottom_field_pic_order_in_frame_present_flag
+	b.ue(0)   // num_slice_groups_minus1
+	b.ue(0)   // num_ref_idx_l0_default_active_minus1
+	b.ue(0)   // num_ref_idx_l1_default_active_minus1
+	b.u(1, 0) // weighted_pred_flag
+	b.u(2, 0) // weighted_bipred_idc
+	b.ue(0)   // pic_init_qp_minus26
+	b.ue(0)   // pic_init_qs_minus26
+	b.ue(0)   // chroma_qp_index_offset
+	b.u(1, 1) // deblocking_filter_control_present_flag
+	b.u(1, 0) // constrained_intra_pred_flag
+	b.u(1, 0) // redundant_pic_cnt_present_flag
+	b.trailing()
+	s.pps = nal(0x68, b.buf)
+
+	return s
+}
+
+// keyFrame returns an IDR frame, with the SPS and PPS, showing a bar at a
+// position that moves with n.
+func (s *mockStream) keyFrame(n int) []byte {
+	var b bitWriter
+	b.ue(0)   // first_mb_in_slice
+	b.ue(7)   // slice_type: I
+	b.ue(0)   // pic_parameter_set_id
+	b.u(4, 0) // frame_num
+	b.ue(0)   // idr_pic_id
+	b.u(1, 0) // no_output_of_prior_pics_flag
+	b.u(1, 0) // long_term_reference_flag
+	b.ue(0)   // slice_qp_delta
+	b.ue(1)   // disable_deblocking_filter_idc
+
+	bar := n % s.widthInMBs
+	for y := 0; y < s.heightInMBs; y++ {
+		for x := 0; x < s.widthInMBs; x++ {
+			b.ue(25) // mb_type: I_PCM
+			b.align()
+
+			luma := uint32(16 + 200*y/s.heightInMBs)
+			if x == bar {
+				luma = 235
+			}
+			for i := 0; i < 256; i++ {
+				b.u(8, luma)
+			}
+			for i := 0; i < 128; i++ {
+				b.u(8, 128)
+			}
+		}
+	}
+	b.trailing()
+
+	frame := append([]byte(nil), s.sps...)
+	frame = append(frame, s.pps...)
+	return append(frame, nal(0x65, b.buf)...)
+}
+
+// frame returns a P frame that repeats the previous frame. frameNum counts
+// the frames since the last key frame.
+func (s *mockStream) frame(frameNum int) []byte {
+	var b bitWriter
+	b.ue(0)                                    // first_mb_in_slice
+	b.ue(5)                                    // slice_type: P
+	b.ue(0)                                    // pic_parameter_set_id
+	b.u(4, uint32(frameNum%16))                // frame_num
+	b.u(1, 0)                                  // num_ref_idx_active_override_flag
+	b.u(1, 0)                                  // ref_pic_list_modification_flag_l0
+	b.u(1, 0)                                  // adaptive_ref_pic_marking_mode_flag
+	b.ue(0)                                    // slice_qp_delta
+	b.ue(1)                                    // disable_deblocking_filter_idc
+	b.ue(uint32(s.widthInMBs * s.heightInMBs)) // mb_skip_run
+	b.trailing()
+
+	return nal(0x41, b.buf)
+}
+
+// mockFramesLoop hands generated frames to the frame subscribers until
+// stop is closed, with a key frame every second.
+func mockFramesLoop(settings Settings, subscribers func() []FrameSubscriber, stop <-chan struct{}) {
+	stream := newMockStream(settings)
+	frameDuration := time.Second / time.Duration(settings.Framerate)
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+
+	for n := 0; ; n++ {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		frame := Frame{Time: time.Duration(n) * frameDuration}
+		if i := n % settings.Framerate; i == 0 {
+			frame.KeyFrame = true
+			frame.Data = stream.keyFrame(n / settings.Framerate)
+		} else {
+			frame.Data = stream.frame(i)
+		}
+
+		for _, subscriber := range subscribers() {
+			subscriber.FrameCaptured(frame)
+		}
+	}
+}
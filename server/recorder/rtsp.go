@@ -0,0 +1,872 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rtspDefaultPort    = "554"
+	rtspDialTimeout    = 10 * time.Second
+	rtspReadTimeout    = 10 * time.Second
+	rtspSessionTimeout = 60 * time.Second
+	rtspMinBackoff     = time.Second
+	rtspMaxBackoff     = 30 * time.Second
+	rtspUserAgent      = "pi-camera-go"
+
+	// rtpClockRate is the RTP clock rate of H.264 video.
+	rtpClockRate = 90000
+)
+
+// rtspBackend pulls H.264 video from an RTSP camera, interleaved over the
+// RTSP connection, and writes it as raw H.264 segments that start with a
+// key frame. The stream is reconnected whenever it is lost, until capture
+// is stopped.
+//
+// The camera's own settings are used, so only the segment duration and
+// framerate settings apply, and the framerate must match the camera's.
+type rtspBackend struct {
+	url      string
+	username string
+	password string
+}
+
+func newRTSPBackend(config Config) rtspBackend {
+	return rtspBackend{
+		url:      config.URL,
+		username: config.Username,
+		password: config.Password,
+	}
+}
+
+func (rtspBackend) name() string {
+	return "rtsp"
+}
+
+func (rtspBackend) extension() string {
+	return ".h264"
+}
+
+func (b rtspBackend) check() error {
+	if len(b.url) == 0 {
+		return errors.New("no RTSP URL configured")
+	}
+
+	u, err := url.Parse(b.url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "rtsp" {
+		return fmt.Errorf("unsupported RTSP URL: %s", b.url)
+	}
+
+	return nil
+}
+
+func (b rtspBackend) start(ctx context.Context, settings Settings, segmentPath string) (<-chan error, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		b.run(ctx, settings, segmentPath)
+		done <- nil
+	}()
+
+	return done, nil
+}
+
+// run streams from the camera until ctx is cancelled, waiting longer
+// between each failed attempt to connect.
+func (b rtspBackend) run(ctx context.Context, settings Settings, segmentPath string) {
+	w := &h264SegmentWriter{
+		segmentPath: segmentPath,
+		duration:    uint32(settings.SegmentDuration * (rtpClockRate / 1000)),
+	}
+	defer w.close()
+
+	backoff := rtspMinBackoff
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := b.stream(ctx, w)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// The next segment starts at the next key frame.
+		w.close()
+		fmt.Println("RTSP stream ended:", err)
+
+		if time.Since(started) > rtspMaxBackoff {
+			backoff = rtspMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > rtspMaxBackoff {
+			backoff = rtspMaxBackoff
+		}
+	}
+}
+
+// stream connects to the camera and writes its video until the connection
+// fails or ctx is cancelled.
+func (b rtspBackend) stream(ctx context.Context, w *h264SegmentWriter) error {
+	u, err := url.Parse(b.url)
+	if err != nil {
+		return err
+	}
+
+	username, password := b.username, b.password
+	if u.User != nil && len(username) == 0 {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	u.User = nil
+
+	host := u.Host
+	if len(u.Port()) == 0 {
+		host = net.JoinHostPort(u.Hostname(), rtspDefaultPort)
+	}
+
+	dialer := net.Dialer{Timeout: rtspDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Closing the connection interrupts any read in progress.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	c := &rtspConn{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		username: username,
+		password: password,
+		mutex:    &sync.Mutex{},
+	}
+
+	resp, err := c.request("DESCRIBE", u.String(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return err
+	}
+
+	base := u.String()
+	if value := resp.header.Get("Content-Base"); len(value) != 0 {
+		base = value
+	} else if value := resp.header.Get("Content-Location"); len(value) != 0 {
+		base = value
+	}
+
+	track, err := parseSDP(string(resp.body), base)
+	if err != nil {
+		return err
+	}
+
+	resp, err = c.request("SETUP", track.control, map[string]string{
+		"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1",
+	})
+	if err != nil {
+		return err
+	}
+
+	sessionTimeout := rtspSessionTimeout
+	parts := strings.Split(resp.header.Get("Session"), ";")
+	c.session = strings.TrimSpace(parts[0])
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, "timeout=") {
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(part, "timeout=")); err == nil && seconds > 0 {
+				sessionTimeout = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	if len(c.session) == 0 {
+		return errors.New("RTSP server did not return a session")
+	}
+
+	if _, err := c.request("PLAY", track.aggregateControl, map[string]string{"Range": "npt=0.000-"}); err != nil {
+		return err
+	}
+
+	println("Streaming from", u.String())
+	w.setParameterSets(track.sps, track.pps)
+	go c.keepAlive(u.String(), sessionTimeout/2, stop)
+
+	depacketizer := &h264Depacketizer{}
+	for {
+		channel, packet, err := c.readInterleaved()
+		if err != nil {
+			return err
+		}
+		if channel != 0 {
+			// Channel 1 carries RTCP, which is not needed.
+			continue
+		}
+
+		rtp, err := parseRTP(packet)
+		if err != nil {
+			return err
+		}
+		if rtp.payloadType != track.payloadType {
+			continue
+		}
+
+		nals := depacketizer.depacketize(rtp.sequenceNumber, rtp.payload)
+		for i, nal := range nals {
+			marker := rtp.marker && i == len(nals)-1
+			if err := w.writeNAL(rtp.timestamp, nal, marker); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rtspConn is a connection to an RTSP server.
+type rtspConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	username string
+	password string
+	auth     *rtspAuth
+	session  string
+
+	// mutex guards writes and the sequence number, since keep-alive
+	// requests are sent while the stream is being read.
+	mutex *sync.Mutex
+	cseq  int
+}
+
+type rtspResponse struct {
+	statusCode int
+	status     string
+	header     textproto.MIMEHeader
+	body       []byte
+}
+
+// send writes a request without waiting for its response.
+func (c *rtspConn) send(method, uri string, header map[string]string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.cseq++
+	req := fmt.Sprintf("%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: %s\r\n", method, uri, c.cseq, rtspUserAgent)
+	if c.auth != nil {
+		req += "Authorization: " + c.auth.authorization(method, uri, c.username, c.password) + "\r\n"
+	}
+	if len(c.session) != 0 {
+		req += "Session: " + c.session + "\r\n"
+	}
+	for key, value := range header {
+		req += key + ": " + value + "\r\n"
+	}
+	req += "\r\n"
+
+	c.conn.SetWriteDeadline(time.Now().Add(rtspReadTimeout))
+	_, err := io.WriteString(c.conn, req)
+	return err
+}
+
+// request sends a request and reads its response, authenticating and
+// sending it again if the server asks for credentials.
+func (c *rtspConn) request(method, uri string, header map[string]string) (*rtspResponse, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.send(method, uri, header); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.statusCode == 401 && attempt == 0 && len(c.username) != 0 {
+			c.auth, err = parseAuthChallenge(resp.header["Www-Authenticate"])
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.statusCode != 200 {
+			return nil, fmt.Errorf("RTSP %s failed: %s", method, resp.status)
+		}
+
+		return resp, nil
+	}
+}
+
+// keepAlive sends a request on the given interval so that the server
+// does not end the session.
+func (c *rtspConn) keepAlive(uri string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.send("OPTIONS", uri, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readResponse reads a response, skipping any interleaved data before it.
+func (c *rtspConn) readResponse() (*rtspResponse, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(rtspReadTimeout))
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+		if _, _, err := c.readFrame(); err != nil {
+			return nil, err
+		}
+	}
+
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "RTSP/") {
+		return nil, fmt.Errorf("invalid RTSP response: %s", line)
+	}
+	statusCode, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTSP response: %s", line)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &rtspResponse{
+		statusCode: statusCode,
+		status:     strings.Join(fields[1:], " "),
+		header:     header,
+	}
+	if value := header.Get("Content-Length"); len(value) != 0 {
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid RTSP content length: %s", value)
+		}
+		resp.body = make([]byte, length)
+		if _, err := io.ReadFull(c.reader, resp.body); err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// readInterleaved returns the next interleaved packet, skipping responses
+// to keep-alive requests.
+func (c *rtspConn) readInterleaved() (byte, []byte, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(rtspReadTimeout))
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if b[0] == '$' {
+			return c.readFrame()
+		}
+
+		if _, err := c.readResponse(); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// readFrame reads an interleaved frame: a '$', the channel, the length
+// and the data.
+func (c *rtspConn) readFrame() (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return 0, nil, err
+	}
+
+	return header[1], data, nil
+}
+
+// rtspAuth holds the server's challenge for Basic or Digest
+// authentication.
+type rtspAuth struct {
+	digest bool
+	realm  string
+	nonce  string
+	opaque string
+	qop    bool
+	nc     int
+}
+
+var authParamRegexp = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+// parseAuthChallenge chooses Digest authentication if the server offers
+// it, and Basic authentication otherwise.
+func parseAuthChallenge(challenges []string) (*rtspAuth, error) {
+	var basic *rtspAuth
+	for _, challenge := range challenges {
+		fields := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+		switch strings.ToLower(fields[0]) {
+		case "digest":
+			auth := &rtspAuth{digest: true}
+			if len(fields) < 2 {
+				return nil, errors.New("invalid RTSP digest challenge")
+			}
+			for _, match := range authParamRegexp.FindAllStringSubmatch(fields[1], -1) {
+				value := match[2] + match[3]
+				switch strings.ToLower(match[1]) {
+				case "realm":
+					auth.realm = value
+				case "nonce":
+					auth.nonce = value
+				case "opaque":
+					auth.opaque = value
+				case "qop":
+					for _, qop := range strings.Split(value, ",") {
+						if strings.TrimSpace(qop) == "auth" {
+							auth.qop = true
+						}
+					}
+				}
+			}
+			return auth, nil
+		case "basic":
+			basic = &rtspAuth{}
+		}
+	}
+
+	if basic == nil {
+		return nil, errors.New("unsupported RTSP authentication")
+	}
+
+	return basic, nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *rtspAuth) authorization(method, uri, username, password string) string {
+	if !a.digest {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	ha1 := md5Hex(username + ":" + a.realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, a.realm, a.nonce, uri)
+	if a.qop {
+		a.nc++
+		cnonceBytes := make([]byte, 8)
+		rand.Read(cnonceBytes)
+		cnonce := hex.EncodeToString(cnonceBytes)
+		nc := fmt.Sprintf("%08x", a.nc)
+		response := md5Hex(ha1 + ":" + a.nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, response)
+	} else {
+		header += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+a.nonce+":"+ha2))
+	}
+	if len(a.opaque) != 0 {
+		header += fmt.Sprintf(`, opaque="%s"`, a.opaque)
+	}
+
+	return header
+}
+
+// sdpTrack is the H.264 video track of a session description.
+type sdpTrack struct {
+	control          string
+	aggregateControl string
+	payloadType      uint8
+	sps              []byte
+	pps              []byte
+}
+
+// parseSDP finds the first H.264 video track in a session description and
+// resolves its control URLs against base.
+func parseSDP(sdp, base string) (*sdpTrack, error) {
+	var track *sdpTrack
+	sessionControl, videoControl := "", ""
+	inMedia, inVideo := false, false
+	payloadTypes := make(map[string]bool)
+
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			// Only the first H.264 video track is used.
+			inMedia = true
+			if track != nil {
+				inVideo = false
+				break
+			}
+			videoControl = ""
+			payloadTypes = make(map[string]bool)
+			fields := strings.Fields(strings.TrimPrefix(line, "m="))
+			inVideo = len(fields) >= 4 && fields[0] == "video"
+			if inVideo {
+				for _, pt := range fields[3:] {
+					payloadTypes[pt] = true
+				}
+			}
+		case strings.HasPrefix(line, "a=control:"):
+			control := strings.TrimPrefix(line, "a=control:")
+			if !inMedia {
+				sessionControl = control
+			} else if inVideo {
+				videoControl = control
+			}
+		case inVideo && track == nil && strings.HasPrefix(line, "a=rtpmap:"):
+			fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))
+			if len(fields) == 2 && payloadTypes[fields[0]] && strings.HasPrefix(strings.ToUpper(fields[1]), "H264/") {
+				pt, err := strconv.Atoi(fields[0])
+				if err != nil {
+					return nil, err
+				}
+				track = &sdpTrack{payloadType: uint8(pt)}
+			}
+		case inVideo && strings.HasPrefix(line, "a=fmtp:"):
+			fields := strings.SplitN(strings.TrimPrefix(line, "a=fmtp:"), " ", 2)
+			if track == nil || len(fields) < 2 || fields[0] != strconv.Itoa(int(track.payloadType)) {
+				break
+			}
+			for _, param := range strings.Split(fields[1], ";") {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "sprop-parameter-sets=") {
+					continue
+				}
+				sets := strings.Split(strings.TrimPrefix(param, "sprop-parameter-sets="), ",")
+				for _, set := range sets {
+					nal, err := base64.StdEncoding.DecodeString(set)
+					if err != nil || len(nal) == 0 {
+						continue
+					}
+					switch nal[0] & 0x1f {
+					case 7:
+						track.sps = nal
+					case 8:
+						track.pps = nal
+					}
+				}
+			}
+		}
+	}
+
+	if track == nil {
+		return nil, errors.New("RTSP stream has no H.264 video")
+	}
+
+	track.control = resolveControl(base, videoControl)
+	track.aggregateControl = resolveControl(base, sessionControl)
+	return track, nil
+}
+
+// resolveControl resolves a control attribute against the base URL.
+func resolveControl(base, control string) string {
+	if len(control) == 0 || control == "*" {
+		return base
+	}
+	if strings.HasPrefix(control, "rtsp://") {
+		return control
+	}
+	if strings.HasSuffix(base, "/") {
+		return base + control
+	}
+
+	return base + "/" + control
+}
+
+type rtpPacket struct {
+	marker         bool
+	payloadType    uint8
+	sequenceNumber uint16
+	timestamp      uint32
+	payload        []byte
+}
+
+func parseRTP(b []byte) (*rtpPacket, error) {
+	if len(b) < 12 || b[0]>>6 != 2 {
+		return nil, errors.New("invalid RTP packet")
+	}
+
+	p := &rtpPacket{
+		marker:         b[1]&0x80 != 0,
+		payloadType:    b[1] & 0x7f,
+		sequenceNumber: binary.BigEndian.Uint16(b[2:]),
+		timestamp:      binary.BigEndian.Uint32(b[4:]),
+	}
+
+	offset := 12 + 4*int(b[0]&0x0f)
+	if b[0]&0x10 != 0 {
+		if len(b) < offset+4 {
+			return nil, errors.New("invalid RTP header extension")
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(b[offset+2:]))
+	}
+	end := len(b)
+	if b[0]&0x20 != 0 && end > 0 {
+		end -= int(b[end-1])
+	}
+	if offset > end {
+		return nil, errors.New("invalid RTP packet")
+	}
+
+	p.payload = b[offset:end]
+	return p, nil
+}
+
+// h264Depacketizer turns RTP payloads into NAL units, as described in RFC
+// 6184. Single NAL unit packets, STAP-A and FU-A are supported.
+type h264Depacketizer struct {
+	fragments    []byte
+	nextSequence uint16
+	started      bool
+}
+
+func (d *h264Depacketizer) depacketize(sequenceNumber uint16, payload []byte) [][]byte {
+	// A fragmented NAL unit that is missing a packet cannot be used.
+	if d.started && sequenceNumber != d.nextSequence {
+		d.fragments = nil
+	}
+	d.started = true
+	d.nextSequence = sequenceNumber + 1
+
+	if len(payload) == 0 {
+		return nil
+	}
+
+	nalType := payload[0] & 0x1f
+	switch {
+	case nalType >= 1 && nalType <= 23:
+		return [][]byte{payload}
+	case nalType == 24:
+		// STAP-A: NAL units, each preceded by its size.
+		nals := make([][]byte, 0, 2)
+		payload = payload[1:]
+		for len(payload) >= 2 {
+			size := int(binary.BigEndian.Uint16(payload))
+			if size == 0 || size > len(payload)-2 {
+				break
+			}
+			nals = append(nals, payload[2:2+size])
+			payload = payload[2+size:]
+		}
+		return nals
+	case nalType == 28:
+		// FU-A: a fragment of a NAL unit, whose header is rebuilt from
+		// the indicator and fragment header.
+		if len(payload) < 2 {
+			return nil
+		}
+		if payload[1]&0x80 != 0 {
+			d.fragments = append([]byte{payload[0]&0xe0 | payload[1]&0x1f}, payload[2:]...)
+		} else if d.fragments != nil {
+			d.fragments = append(d.fragments, payload[2:]...)
+		}
+		if payload[1]&0x40 != 0 && d.fragments != nil {
+			nal := d.fragments
+			d.fragments = nil
+			return [][]byte{nal}
+		}
+	}
+
+	return nil
+}
+
+// h264SegmentWriter groups NAL units into access units and writes them to
+// segment files in Annex B format. A new segment is started at the first
+// key frame after the segment duration has passed, so that every segment
+// can be decoded on its own.
+type h264SegmentWriter struct {
+	segmentPath string
+	duration    uint32
+	number      int
+
+	file      *os.File
+	startTime uint32
+
+	accessUnit     [][]byte
+	accessUnitTime uint32
+
+	sps []byte
+	pps []byte
+}
+
+var annexBStartCode = []byte{0, 0, 0, 1}
+
+func (w *h264SegmentWriter) setParameterSets(sps, pps []byte) {
+	if sps != nil {
+		w.sps = sps
+	}
+	if pps != nil {
+		w.pps = pps
+	}
+}
+
+// writeNAL adds a NAL unit with the given RTP timestamp. The marker is set
+// on the last NAL unit of an access unit.
+func (w *h264SegmentWriter) writeNAL(timestamp uint32, nal []byte, marker bool) error {
+	if len(w.accessUnit) != 0 && timestamp != w.accessUnitTime {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	switch nal[0] & 0x1f {
+	case 7:
+		w.sps = nal
+	case 8:
+		w.pps = nal
+	}
+
+	w.accessUnit = append(w.accessUnit, nal)
+	w.accessUnitTime = timestamp
+	if marker {
+		return w.flush()
+	}
+
+	return nil
+}
+
+// flush writes the current access unit.
+func (w *h264SegmentWriter) flush() error {
+	accessUnit := w.accessUnit
+	w.accessUnit = nil
+
+	keyFrame, hasSPS := false, false
+	for _, nal := range accessUnit {
+		switch nal[0] & 0x1f {
+		case 5:
+			keyFrame = true
+		case 7:
+			hasSPS = true
+		}
+	}
+
+	if keyFrame && (w.file == nil || w.accessUnitTime-w.startTime >= w.duration) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+
+		// Make sure that the segment starts with the parameter sets.
+		if !hasSPS && w.sps != nil && w.pps != nil {
+			accessUnit = append([][]byte{w.sps, w.pps}, accessUnit...)
+		}
+	}
+
+	// Nothing is written until the first key frame.
+	if w.file == nil {
+		return nil
+	}
+
+	for _, nal := range accessUnit {
+		if _, err := w.file.Write(annexBStartCode); err != nil {
+			return err
+		}
+		if _, err := w.file.Write(nal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rotate closes the current segment file and starts a new one.
+func (w *h264SegmentWriter) rotate() error {
+	w.closeFile()
+
+	w.number++
+	file, err := os.Create(fmt.Sprintf(w.segmentPath, w.number))
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.startTime = w.accessUnitTime
+	return nil
+}
+
+func (w *h264SegmentWriter) closeFile() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// close discards any incomplete access unit and closes the current
+// segment file, so that the next segment starts at a key frame.
+func (w *h264SegmentWriter) close() {
+	w.accessUnit = nil
+	w.closeFile()
+}
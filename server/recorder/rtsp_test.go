@@ -0,0 +1,309 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/textproto"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRTSPServer stands in for an RTSP camera. It asks for Digest
+// credentials, serves a single H.264 track interleaved over the RTSP
+// connection, and drops the first connection after a few frames.
+type testRTSPServer struct {
+	listener net.Listener
+	settings Settings
+
+	mutex       sync.Mutex
+	connections int
+	requests    []string
+}
+
+func startTestRTSPServer(t *testing.T, settings Settings) *testRTSPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testRTSPServer{listener: listener, settings: settings}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *testRTSPServer) url() string {
+	return "rtsp://" + s.listener.Addr().String() + "/stream"
+}
+
+func (s *testRTSPServer) connectionCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.connections
+}
+
+// authorized checks a Digest authorization for the user "camera" with
+// the password "secret".
+func (s *testRTSPServer) authorized(method, authorization string) bool {
+	if !strings.HasPrefix(authorization, "Digest ") {
+		return false
+	}
+	params := map[string]string{}
+	for _, match := range authParamRegexp.FindAllStringSubmatch(authorization, -1) {
+		params[match[1]] = match[2] + match[3]
+	}
+
+	ha1 := md5Hex("camera:test:secret")
+	ha2 := md5Hex(method + ":" + params["uri"])
+	response := md5Hex(ha1 + ":nonce:" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+	return params["username"] == "camera" && params["qop"] == "auth" && params["response"] == response
+}
+
+func (s *testRTSPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	s.mutex.Lock()
+	s.connections++
+	dropAfter := 0
+	if s.connections == 1 {
+		dropAfter = 15
+	}
+	s.mutex.Unlock()
+
+	var writeMutex sync.Mutex
+	write := func(b []byte) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		_, err := conn.Write(b)
+		return err
+	}
+
+	stream := newMockStream(s.settings)
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return
+		}
+		method := fields[0]
+
+		s.mutex.Lock()
+		s.requests = append(s.requests, method+" "+fields[1])
+		s.mutex.Unlock()
+
+		status, extra, body := "200 OK", "", ""
+		switch {
+		case !s.authorized(method, header.Get("Authorization")):
+			status = "401 Unauthorized"
+			extra = "WWW-Authenticate: Basic realm=\"test\"\r\nWWW-Authenticate: Digest realm=\"test\", nonce=\"nonce\", qop=\"auth\"\r\n"
+		case method == "DESCRIBE":
+			sprop := base64.StdEncoding.EncodeToString(stream.sps[4:]) + "," + base64.StdEncoding.EncodeToString(stream.pps[4:])
+			body = "v=0\r\ns=Test\r\na=control:*\r\nm=audio 0 RTP/AVP 0\r\na=control:trackID=0\r\n" +
+				"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\na=fmtp:96 packetization-mode=1;sprop-parameter-sets=" + sprop + "\r\na=control:trackID=1\r\n"
+			extra = "Content-Type: application/sdp\r\nContent-Base: " + s.url() + "/\r\n"
+		case method == "SETUP":
+			if fields[1] != s.url()+"/trackID=1" {
+				status = "404 Not Found"
+			}
+			extra = "Session: 12345678;timeout=60\r\nTransport: " + header.Get("Transport") + "\r\n"
+		case method == "PLAY":
+			extra = "Session: 12345678\r\n"
+		}
+
+		resp := fmt.Sprintf("RTSP/1.0 %s\r\nCSeq: %s\r\n%sContent-Length: %d\r\n\r\n%s", status, header.Get("Cseq"), extra, len(body), body)
+		if err := write([]byte(resp)); err != nil {
+			return
+		}
+		if method == "PLAY" && status == "200 OK" {
+			go func() {
+				s.play(stream, write, dropAfter)
+				if dropAfter != 0 {
+					conn.Close()
+				}
+			}()
+		}
+	}
+}
+
+// play sends frames until the connection fails, or until dropAfter
+// frames have been sent if it is not zero.
+func (s *testRTSPServer) play(stream *mockStream, write func([]byte) error, dropAfter int) {
+	var sequenceNumber uint16
+	packet := func(timestamp uint32, marker bool, payload []byte) error {
+		b := make([]byte, 16, 16+len(payload))
+		b[0], b[1] = '$', 0
+		binary.BigEndian.PutUint16(b[2:], uint16(12+len(payload)))
+		b[4], b[5] = 0x80, 96
+		if marker {
+			b[5] |= 0x80
+		}
+		binary.BigEndian.PutUint16(b[6:], sequenceNumber)
+		binary.BigEndian.PutUint32(b[8:], timestamp)
+		binary.BigEndian.PutUint32(b[12:], 0x12345678)
+		sequenceNumber++
+		return write(append(b, payload...))
+	}
+
+	framesPerKeyFrame := s.settings.Framerate
+	for i := 0; dropAfter == 0 || i < dropAfter; i++ {
+		timestamp := uint32(i * rtpClockRate / s.settings.Framerate)
+		frame := Frame{Data: stream.frame(i % framesPerKeyFrame)}
+		if i%framesPerKeyFrame == 0 {
+			frame.Data = stream.keyFrame(i)
+		}
+
+		units := frame.NALUnits()
+		for j, unit := range units {
+			last := j == len(units)-1
+			var err error
+			switch {
+			case unit == nil:
+			case unit[0]&0x1f == 7 && j+1 < len(units):
+				// Send the parameter sets together as a STAP-A.
+				next := units[j+1]
+				stap := []byte{24, 0, byte(len(unit))}
+				stap = append(stap, unit...)
+				stap = append(stap, byte(len(next)>>8), byte(len(next)))
+				units[j+1] = nil
+				err = packet(timestamp, false, append(stap, next...))
+			case len(unit) <= 1000:
+				err = packet(timestamp, last, unit)
+			default:
+				// Fragment large NAL units as FU-A.
+				data := unit[1:]
+				for offset := 0; offset < len(data) && err == nil; offset += 1000 {
+					end := offset + 1000
+					if end > len(data) {
+						end = len(data)
+					}
+					header := unit[0] & 0x1f
+					if offset == 0 {
+						header |= 0x80
+					}
+					if end == len(data) {
+						header |= 0x40
+					}
+					fu := append([]byte{unit[0]&0xe0 | 28, header}, data[offset:end]...)
+					err = packet(timestamp, last && end == len(data), fu)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+
+		time.Sleep(time.Second / time.Duration(s.settings.Framerate))
+	}
+}
+
+func TestRTSPBackend(t *testing.T) {
+	dir := t.TempDir()
+	installFakeProgram(t, dir, "ffmpeg")
+	t.Setenv("PATH", dir)
+
+	server := startTestRTSPServer(t, testSettings)
+	r := newTestRecorder(t, newRTSPBackend(Config{URL: server.url(), Username: "camera", Password: "secret"}))
+	subscriber := &testSubscriber{}
+	r.AddSubscriber(subscriber)
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	// The first connection is dropped after 15 frames, and the stream
+	// continues after reconnecting.
+	waitFor(t, 15*time.Second, "a segment after reconnecting", func() bool {
+		subscriber.mutex.Lock()
+		defer subscriber.mutex.Unlock()
+		return len(subscriber.segments) >= 2 && server.connectionCount() >= 2
+	})
+
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+	if name := path.Base(subscriber.segments[0]); name != "segment000000000001.ts" {
+		t.Errorf("got segment %s", name)
+	}
+	if len(subscriber.frames) < 15 || !subscriber.frames[0].KeyFrame {
+		t.Fatalf("got %d frames", len(subscriber.frames))
+	}
+
+	// Key frames carry the parameter sets, and are reassembled from their
+	// fragments.
+	first := subscriber.frames[0].NALUnits()
+	if len(first) != 3 || first[0][0]&0x1f != 7 || first[1][0]&0x1f != 8 || first[2][0]&0x1f != 5 {
+		t.Errorf("first frame has %d NAL units", len(first))
+	}
+	if units := (Frame{Data: newMockStream(testSettings).keyFrame(0)}).NALUnits(); len(first) == 3 && string(first[2]) != string(units[2]) {
+		t.Error("key frame was not reassembled")
+	}
+
+	server.mutex.Lock()
+	requests := strings.Join(server.requests, "\n")
+	server.mutex.Unlock()
+	for _, want := range []string{"DESCRIBE " + server.url(), "SETUP " + server.url() + "/trackID=1", "PLAY " + server.url() + "/"} {
+		if !strings.Contains(requests, want) {
+			t.Errorf("requests do not include %s:\n%s", want, requests)
+		}
+	}
+}
+
+func TestParseSDP(t *testing.T) {
+	track, err := parseSDP("m=video 0 RTP/AVP 97\r\na=rtpmap:97 H264/90000\r\na=control:rtsp://camera/video\r\n", "rtsp://camera/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if track.payloadType != 97 || track.control != "rtsp://camera/video" || track.aggregateControl != "rtsp://camera/" {
+		t.Errorf("got track %+v", track)
+	}
+	if _, err := parseSDP("m=audio 0 RTP/AVP 0\r\n", "rtsp://camera/"); err == nil {
+		t.Error("found H.264 in an audio-only description")
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/util"
+)
+
+// Settings are the parameters of the capture process.
+type Settings struct {
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+	BitRate int `json:"bitRate"`
+
+	// SegmentDuration is the length of each segment in milliseconds.
+	SegmentDuration int `json:"segmentDuration"`
+
+	// Framerate is the number of frames captured per second.
+	Framerate int `json:"framerate"`
+
+	// Exposure and AWB select the exposure and automatic white balance
+	// modes, e.g. "night" and "auto". They are left at the camera's
+	// defaults if empty.
+	Exposure string `json:"exposure,omitempty"`
+	AWB      string `json:"awb,omitempty"`
+}
+
+// DefaultSettings are used for any settings that have not been configured.
+var DefaultSettings = Settings{
+	Width:           640,
+	Height:          480,
+	BitRate:         4000000,
+	SegmentDuration: 5000,
+	Framerate:       30,
+}
+
+// Profile is a named set of settings, e.g. for day and night. Any settings
+// that a profile leaves unset are taken from the recorder's configured
+// settings.
+type Profile struct {
+	Name string `json:"name"`
+	Settings
+}
+
+// DefaultProfile is the profile used when no other has been selected. It
+// uses the configured settings as they are.
+var DefaultProfile = Profile{Name: "default"}
+
+var exposureModes = map[string]bool{
+	"off": true, "auto": true, "night": true, "nightpreview": true,
+	"backlight": true, "spotlight": true, "sports": true, "snow": true,
+	"beach": true, "verylong": true, "fixedfps": true, "antishake": true,
+	"fireworks": true,
+}
+
+var awbModes = map[string]bool{
+	"off": true, "auto": true, "sun": true, "cloud": true, "shade": true,
+	"tungsten": true, "fluorescent": true, "incandescent": true,
+	"flash": true, "horizon": true, "greyworld": true,
+}
+
+// merge returns the settings with any unset values taken from base.
+func (s Settings) merge(base Settings) Settings {
+	if s.Width == 0 {
+		s.Width = base.Width
+	}
+	if s.Height == 0 {
+		s.Height = base.Height
+	}
+	if s.BitRate == 0 {
+		s.BitRate = base.BitRate
+	}
+	if s.SegmentDuration == 0 {
+		s.SegmentDuration = base.SegmentDuration
+	}
+	if s.Framerate == 0 {
+		s.Framerate = base.Framerate
+	}
+	if len(s.Exposure) == 0 {
+		s.Exposure = base.Exposure
+	}
+	if len(s.AWB) == 0 {
+		s.AWB = base.AWB
+	}
+
+	return s
+}
+
+// Validate checks that the settings are usable.
+func (s Settings) Validate() error {
+	if s.Width < 64 || s.Width > 1920 || s.Height < 64 || s.Height > 1080 {
+		return fmt.Errorf("unsupported resolution %dx%d", s.Width, s.Height)
+	}
+	if s.BitRate <= 0 || s.BitRate > 25000000 {
+		return fmt.Errorf("unsupported bit rate %d", s.BitRate)
+	}
+	if s.SegmentDuration < 1000 || s.SegmentDuration > 60000 {
+		return fmt.Errorf("unsupported segment duration %d ms", s.SegmentDuration)
+	}
+	if s.Framerate < 1 || s.Framerate > 90 {
+		return fmt.Errorf("unsupported framerate %d", s.Framerate)
+	}
+	if len(s.Exposure) != 0 && !exposureModes[s.Exposure] {
+		return fmt.Errorf("unsupported exposure mode %s", s.Exposure)
+	}
+	if len(s.AWB) != 0 && !awbModes[s.AWB] {
+		return fmt.Errorf("unsupported white balance mode %s", s.AWB)
+	}
+
+	return nil
+}
+
+// Validate checks that the profile has a name and usable settings.
+func (p Profile) Validate() error {
+	if len(p.Name) == 0 {
+		return errors.New("profile requires a name")
+	}
+
+	return p.Settings.merge(DefaultSettings).Validate()
+}
+
+func (s Settings) segmentDuration() time.Duration {
+	return time.Duration(s.SegmentDuration) * time.Millisecond
+}
+
+// loadSettings reads the settings saved by saveSettings, falling back to
+// the default settings if there are none.
+func loadSettings(filePath string) (Settings, error) {
+	b, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return DefaultSettings, nil
+	} else if err != nil {
+		return DefaultSettings, err
+	}
+
+	var settings Settings
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return DefaultSettings, err
+	}
+
+	settings = settings.merge(DefaultSettings)
+	if err := settings.Validate(); err != nil {
+		return DefaultSettings, err
+	}
+
+	return settings, nil
+}
+
+func saveSettings(filePath string, settings Settings) error {
+	b, err := json.Marshal(&settings)
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(filePath, b)
+}
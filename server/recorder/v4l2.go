@@ -0,0 +1,256 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultV4L2Device = "/dev/video0"
+	defaultV4L2Format = "v4l2"
+)
+
+// v4l2Backend captures from a video device, such as a USB webcam, with
+// ffmpeg, which encodes the video once and splits it into MPEG-TS
+// segments that are ready to be served. The same segments are also
+// written as raw H.264, which frames are read from while they are
+// captured.
+type v4l2Backend struct {
+	device string
+	format string
+}
+
+func newV4L2Backend(config Config) v4l2Backend {
+	b := v4l2Backend{device: config.Device, format: config.Format}
+	if len(b.device) == 0 {
+		b.device = defaultV4L2Device
+	}
+	if len(b.format) == 0 {
+		b.format = defaultV4L2Format
+	}
+
+	return b
+}
+
+func (v4l2Backend) name() string {
+	return "v4l2"
+}
+
+func (v4l2Backend) extension() string {
+	return ".ts"
+}
+
+func (v4l2Backend) writesFrameFiles() {
+}
+
+// checkSettings rejects exposure and white balance modes, which ffmpeg
+// cannot set on a video device.
+func (v4l2Backend) checkSettings(s Settings) error {
+	if len(s.Exposure) != 0 {
+		return errors.New("the v4l2 backend cannot set the exposure mode")
+	}
+	if len(s.AWB) != 0 {
+		return errors.New("the v4l2 backend cannot set the white balance mode")
+	}
+
+	return nil
+}
+
+// check makes sure that ffmpeg is installed and the device exists. Test
+// sources need no device.
+func (b v4l2Backend) check() error {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return err
+	}
+	if b.format != defaultV4L2Format {
+		return nil
+	}
+
+	_, err := os.Stat(b.device)
+	return err
+}
+
+func (b v4l2Backend) start(ctx context.Context, settings Settings, segmentPath string) (<-chan error, error) {
+	return startCommand(ctx, "ffmpeg", b.args(settings, segmentPath))
+}
+
+func (b v4l2Backend) args(s Settings, segmentPath string) []string {
+	size := strconv.Itoa(s.Width) + "x" + strconv.Itoa(s.Height)
+	seconds := strconv.FormatFloat(float64(s.SegmentDuration)/1000, 'f', -1, 64)
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-f", b.format}
+	if b.format == defaultV4L2Format {
+		args = append(args, "-video_size", size, "-framerate", strconv.Itoa(s.Framerate))
+	} else {
+		// Test sources generate frames as fast as they can unless they
+		// are read at their native rate.
+		args = append(args, "-re")
+	}
+	args = append(args, "-i", b.device)
+
+	// Start every segment with a key frame and the parameter sets, so
+	// that segments can be played on their own. The tee muxer writes the
+	// encoded video twice: as MPEG-TS segments, and as raw H.264 files
+	// that are flushed after every frame, so that it can be streamed
+	// live.
+	framesPath := strings.TrimSuffix(segmentPath, path.Ext(segmentPath)) + framesExtension
+	segment := "f=segment:segment_time=" + seconds
+	args = append(args,
+		"-an",
+		"-vf", "scale="+strconv.Itoa(s.Width)+":"+strconv.Itoa(s.Height),
+		"-r", strconv.Itoa(s.Framerate),
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-tune", "zerolatency",
+		"-pix_fmt", "yuv420p",
+		"-x264-params", "repeat-headers=1",
+		"-b:v", strconv.Itoa(s.BitRate),
+		"-maxrate", strconv.Itoa(s.BitRate),
+		"-bufsize", strconv.Itoa(2*s.BitRate),
+		"-force_key_frames", "expr:gte(t,n_forced*"+seconds+")",
+		"-map", "0:v",
+		"-f", "tee",
+		"["+segment+":segment_format=mpegts]"+segmentPath+
+			"|["+segment+":segment_format=h264:segment_format_options=flush_packets=1]"+framesPath,
+	)
+
+	return args
+}
+
+// Device is a video device and the formats that it can capture.
+type Device struct {
+	Path    string   `json:"path"`
+	Name    string   `json:"name"`
+	Formats []Format `json:"formats"`
+}
+
+// Format is a pixel or compressed format supported by a device, with the
+// frame sizes it supports. A size is either WxH or, for devices with
+// stepwise sizes, a range such as "{32-4096, 2}x{32-2304, 2}".
+type Format struct {
+	Format      string   `json:"format"`
+	Description string   `json:"description"`
+	Compressed  bool     `json:"compressed"`
+	Sizes       []string `json:"sizes"`
+}
+
+var formatLineRegexp = regexp.MustCompile(`^\[.*\] (Raw|Compressed)\s*:\s*(\S+)\s*:\s*(.+?)\s*:\s*([^:]*)$`)
+
+// ListDevices returns the video devices and their capabilities. Listing
+// capabilities requires ffmpeg.
+func ListDevices() ([]Device, error) {
+	paths, err := filepath.Glob("/dev/video*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return deviceNumber(paths[i]) < deviceNumber(paths[j])
+	})
+
+	devices := make([]Device, 0, len(paths))
+	for _, devicePath := range paths {
+		formats, err := listFormats(devicePath)
+		if err != nil {
+			return nil, err
+		}
+
+		devices = append(devices, Device{
+			Path:    devicePath,
+			Name:    deviceName(devicePath),
+			Formats: formats,
+		})
+	}
+
+	return devices, nil
+}
+
+func deviceNumber(devicePath string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(path.Base(devicePath), "video"))
+	return n
+}
+
+func deviceName(devicePath string) string {
+	b, err := ioutil.ReadFile(path.Join("/sys/class/video4linux", path.Base(devicePath), "name"))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// listFormats asks ffmpeg for the formats supported by a device. Devices
+// that cannot capture video, such as metadata devices, have none.
+func listFormats(devicePath string) ([]Format, error) {
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-nostdin",
+		"-f", "v4l2", "-list_formats", "all", "-i", devicePath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	// ffmpeg always exits with an error after listing formats.
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, err
+		}
+	}
+
+	formats := make([]Format, 0)
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		match := formatLineRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+
+		formats = append(formats, Format{
+			Format:      match[2],
+			Description: match[3],
+			Compressed:  match[1] == "Compressed",
+			Sizes:       parseSizes(match[4]),
+		})
+	}
+
+	return formats, nil
+}
+
+func parseSizes(s string) []string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") {
+		return []string{s}
+	}
+
+	return strings.Fields(s)
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package recorder
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestV4L2Args(t *testing.T) {
+	b := newV4L2Backend(Config{})
+	args := strings.Join(b.args(testSettings, "/tmp/segment%012d.ts"), " ")
+	for _, want := range []string{
+		"-f v4l2 -video_size 64x48 -framerate 10 -i /dev/video0",
+		"-x264-params repeat-headers=1",
+		"-force_key_frames expr:gte(t,n_forced*1)",
+		"-map 0:v -f tee [f=segment:segment_time=1:segment_format=mpegts]/tmp/segment%012d.ts|" +
+			"[f=segment:segment_time=1:segment_format=h264:segment_format_options=flush_packets=1]/tmp/segment%012d.h264",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("arguments do not contain %q: %s", want, args)
+		}
+	}
+
+	b = newV4L2Backend(Config{Format: "lavfi", Device: "testsrc"})
+	if args := strings.Join(b.args(testSettings, "segment%d.ts"), " "); !strings.Contains(args, "-f lavfi -re -i testsrc") {
+		t.Errorf("got arguments %s for a test source", args)
+	}
+}
+
+func TestV4L2Backend(t *testing.T) {
+	dir := t.TempDir()
+	installFakeProgram(t, dir, "ffmpeg")
+	t.Setenv("PATH", dir)
+	t.Setenv(fakeArgsEnv, path.Join(dir, "args"))
+
+	b, err := findBackend(Config{Format: "lavfi", Device: "testsrc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.name() != "v4l2" {
+		t.Fatalf("found backend %s, want v4l2", b.name())
+	}
+
+	r := newTestRecorder(t, b)
+	subscriber := &testSubscriber{}
+	r.AddSubscriber(subscriber)
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	waitFor(t, 10*time.Second, "two segments", func() bool {
+		subscriber.mutex.Lock()
+		defer subscriber.mutex.Unlock()
+		return len(subscriber.segments) >= 2
+	})
+
+	subscriber.mutex.Lock()
+	if name := path.Base(subscriber.segments[0]); name != "segment000000000000.ts" {
+		t.Errorf("got segment %s", name)
+	}
+	if len(subscriber.frames) < 8 || !subscriber.frames[0].KeyFrame {
+		t.Errorf("got %d frames from the v4l2 backend", len(subscriber.frames))
+	}
+	subscriber.mutex.Unlock()
+
+	// Segments are handed over as ffmpeg wrote them, without muxing
+	// them again, and the raw H.264 files that frames are read from are
+	// removed once they are complete.
+	args, err := ioutil.ReadFile(path.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs := strings.Count(string(args), "ffmpeg "); runs != 1 {
+		t.Errorf("ffmpeg was run %d times:\n%s", runs, args)
+	}
+	files, err := filepath.Glob(path.Join(r.recorderDir, "*.h264"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 2 {
+		t.Errorf("got %d raw H.264 files", len(files))
+	}
+}
+
+// TestV4L2Settings checks that settings that the v4l2 backend cannot apply
+// are rejected rather than ignored.
+func TestV4L2Settings(t *testing.T) {
+	r := newTestRecorder(t, newV4L2Backend(Config{Format: "lavfi", Device: "testsrc"}))
+
+	settings := testSettings
+	settings.Exposure = "night"
+	if err := r.Configure(settings); err == nil {
+		t.Error("configured an exposure mode")
+	}
+	settings = testSettings
+	settings.AWB = "sun"
+	if err := r.Configure(settings); err == nil {
+		t.Error("configured a white balance mode")
+	}
+	if err := r.SetProfile(Profile{Name: "night", Settings: Settings{Exposure: "night"}}); err == nil {
+		t.Error("switched to a profile with an exposure mode")
+	}
+	if s := r.Settings(); s != testSettings || r.Profile().Name != DefaultProfile.Name {
+		t.Errorf("settings were changed to %+v", s)
+	}
+
+	// Saved settings that cannot be applied keep the recorder from
+	// starting.
+	r.settings.AWB = "auto"
+	if err := r.Start(); err == nil {
+		r.Stop()
+		t.Error("started with a white balance mode")
+	}
+}
+
+// TestV4L2TestSource records ffmpeg's test source, which needs ffmpeg with
+// libx264.
+func TestV4L2TestSource(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+
+	r := newTestRecorder(t, newV4L2Backend(Config{Format: "lavfi", Device: "testsrc=size=64x64:rate=10"}))
+	r.settings.Height = 64
+	subscriber := &testSubscriber{}
+	r.AddSubscriber(subscriber)
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	waitFor(t, 15*time.Second, "two segments", func() bool {
+		subscriber.mutex.Lock()
+		defer subscriber.mutex.Unlock()
+		return len(subscriber.segments) >= 2
+	})
+
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+	if name := path.Base(subscriber.segments[0]); name != "segment000000000000.ts" {
+		t.Errorf("got segment %s", name)
+	}
+
+	// Every key frame carries the parameter sets, so that each segment
+	// and live stream can start from it.
+	keyFrames := 0
+	for _, frame := range subscriber.frames {
+		if !frame.KeyFrame {
+			continue
+		}
+		keyFrames++
+		hasSPS := false
+		for _, unit := range frame.NALUnits() {
+			hasSPS = hasSPS || unit[0]&0x1f == 7
+		}
+		if !hasSPS {
+			t.Errorf("key frame at %v has no SPS", frame.Time)
+		}
+	}
+	if keyFrames < 2 || !subscriber.frames[0].KeyFrame {
+		t.Errorf("got %d key frames in %d frames", keyFrames, len(subscriber.frames))
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package replication
+
+// Config configures replication of new segments to a remote pi-camera-go
+// instance or another HTTP endpoint that accepts the same requests.
+type Config struct {
+	// URL is the base URL of the remote endpoint, for example
+	// "https://backup.example.com:10042/api/ingest". Segments are sent
+	// with PUT requests to <URL>/<source>/<camera>.
+	URL string `json:"url"`
+
+	// Token is sent as a bearer token with every request.
+	Token string `json:"token"`
+
+	// Source names this instance at the remote end. It defaults to the
+	// host name.
+	Source string `json:"source"`
+
+	// MaxQueueSize is the most data, in bytes, to keep queued while the
+	// remote endpoint is unreachable. The oldest segments are dropped
+	// once it is exceeded. It defaults to 1 GB.
+	MaxQueueSize int64 `json:"maxQueueSize"`
+
+	// InsecureSkipVerify accepts any certificate from the remote
+	// endpoint, which is needed if it uses the generated self-signed
+	// certificate.
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+}
+
+// Enabled returns whether replication is configured.
+func (c Config) Enabled() bool {
+	return len(c.URL) != 0
+}
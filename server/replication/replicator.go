@@ -0,0 +1,420 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package replication
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/util"
+)
+
+// Headers that carry a segment's metadata in replication requests.
+const (
+	HeaderCreated       = "X-Segment-Created"
+	HeaderModified      = "X-Segment-Modified"
+	HeaderChecksum      = "X-Segment-Checksum"
+	HeaderDiscontinuity = "X-Segment-Discontinuity"
+)
+
+const (
+	defaultMaxQueueSize = 1024 * 1024 * 1024 // 1 GB
+
+	entrySuffix    = ".json"
+	segmentSuffix  = ".ts"
+	tempFileSuffix = ".tmp"
+
+	uploadTimeout = 5 * time.Minute
+	minBackoff    = 5 * time.Second
+	maxBackoff    = 5 * time.Minute
+)
+
+// queueEntry is the metadata of a queued segment. It is written after the
+// segment file, so a segment without an entry was never fully queued.
+type queueEntry struct {
+	Created       time.Time `json:"created"`
+	Modified      time.Time `json:"modified"`
+	Size          int64     `json:"size"`
+	Checksum      string    `json:"checksum"`
+	Discontinuity bool      `json:"discontinuity"`
+}
+
+// Replicator is a recorder subscriber that queues each new segment on disk
+// and uploads it to the remote endpoint, oldest first. Segments stay
+// queued until they have been accepted, so that replication catches up
+// after the network has been down.
+type Replicator struct {
+	url          string
+	token        string
+	maxQueueSize int64
+	queueDir     string
+	client       *http.Client
+
+	discontinuity bool
+	mutex         *sync.Mutex
+	wake          chan struct{}
+}
+
+// New creates a replicator for the named camera. Each camera has its own
+// queue.
+func New(config Config, camera string) (*Replicator, error) {
+	source := config.Source
+	if len(source) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		source = hostname
+	}
+
+	if _, err := url.Parse(config.URL); err != nil {
+		return nil, err
+	}
+
+	queueDir, err := util.ConfigDir("replication", camera)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	r := &Replicator{
+		url:          strings.TrimSuffix(config.URL, "/") + "/" + url.PathEscape(source) + "/" + url.PathEscape(camera),
+		token:        config.Token,
+		maxQueueSize: defaultMaxQueueSize,
+		queueDir:     queueDir,
+		client:       &http.Client{Transport: transport, Timeout: uploadTimeout},
+		mutex:        &sync.Mutex{},
+		wake:         make(chan struct{}, 1),
+	}
+	if config.MaxQueueSize > 0 {
+		r.maxQueueSize = config.MaxQueueSize
+	}
+
+	if err := r.removeIncomplete(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Start begins uploading queued segments.
+func (r *Replicator) Start() {
+	go r.uploadLoop()
+}
+
+func (r *Replicator) VideoRecorded(filePath string, created, modified time.Time) {
+	r.mutex.Lock()
+	discontinuity := r.discontinuity
+	r.discontinuity = false
+	r.mutex.Unlock()
+
+	if err := r.enqueue(filePath, created, modified, discontinuity); err != nil {
+		fmt.Println("Unable to queue segment for replication:", err)
+		return
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Replicator) Discontinuity() {
+	r.mutex.Lock()
+	r.discontinuity = true
+	r.mutex.Unlock()
+}
+
+// enqueue copies a segment into the queue, since the recorder removes it
+// once every subscriber has seen it.
+func (r *Replicator) enqueue(filePath string, created, modified time.Time, discontinuity bool) error {
+	name := fmt.Sprintf("%020d", created.UnixNano())
+	segmentPath := path.Join(r.queueDir, name+segmentSuffix)
+
+	inFile, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	tempPath := segmentPath + tempFileSuffix
+	outFile, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(outFile, hash), inFile)
+	if err == nil {
+		err = outFile.Sync()
+	}
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, segmentPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	b, err := json.Marshal(&queueEntry{
+		Created:       created,
+		Modified:      modified,
+		Size:          size,
+		Checksum:      hex.EncodeToString(hash.Sum(nil)),
+		Discontinuity: discontinuity,
+	})
+	if err == nil {
+		err = util.WriteFileAtomic(path.Join(r.queueDir, name+entrySuffix), b)
+	}
+	if err != nil {
+		os.Remove(segmentPath)
+		return err
+	}
+
+	return r.trimQueue()
+}
+
+// queuedNames returns the names of the queued segments, oldest first.
+func (r *Replicator) queuedNames() ([]string, int64, error) {
+	files, err := ioutil.ReadDir(r.queueDir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	names := make([]string, 0, len(files))
+	size := int64(0)
+	for _, fileInfo := range files {
+		if strings.HasSuffix(fileInfo.Name(), entrySuffix) {
+			names = append(names, strings.TrimSuffix(fileInfo.Name(), entrySuffix))
+		} else if strings.HasSuffix(fileInfo.Name(), segmentSuffix) {
+			size += fileInfo.Size()
+		}
+	}
+	sort.Strings(names)
+
+	return names, size, nil
+}
+
+// trimQueue drops the oldest segments while the queue is over its size
+// limit.
+func (r *Replicator) trimQueue() error {
+	names, size, err := r.queuedNames()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if size <= r.maxQueueSize {
+			break
+		}
+
+		fileInfo, err := os.Stat(path.Join(r.queueDir, name+segmentSuffix))
+		if err == nil {
+			size -= fileInfo.Size()
+		}
+		fmt.Println("Replication queue is full, dropping segment", name)
+		if err := r.removeEntry(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeIncomplete removes segments that were being queued when the
+// process stopped.
+func (r *Replicator) removeIncomplete() error {
+	files, err := ioutil.ReadDir(r.queueDir)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]bool)
+	for _, fileInfo := range files {
+		if strings.HasSuffix(fileInfo.Name(), entrySuffix) {
+			entries[strings.TrimSuffix(fileInfo.Name(), entrySuffix)] = true
+		}
+	}
+
+	for _, fileInfo := range files {
+		name := fileInfo.Name()
+		complete := strings.HasSuffix(name, entrySuffix) ||
+			(strings.HasSuffix(name, segmentSuffix) && entries[strings.TrimSuffix(name, segmentSuffix)])
+		if !complete {
+			if err := os.Remove(path.Join(r.queueDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeEntry removes a segment from the queue, entry first so that a
+// crash cannot leave an entry without its segment.
+func (r *Replicator) removeEntry(name string) error {
+	if err := os.Remove(path.Join(r.queueDir, name+entrySuffix)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path.Join(r.queueDir, name+segmentSuffix)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// uploadLoop uploads queued segments whenever there are any, waiting
+// longer after each failure.
+func (r *Replicator) uploadLoop() {
+	backoff := minBackoff
+	for {
+		err := r.uploadQueued()
+		if err == nil {
+			backoff = minBackoff
+			<-r.wake
+			continue
+		}
+
+		fmt.Println("Unable to replicate segments, retrying in", backoff.String()+":", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// uploadQueued uploads queued segments until the queue is empty.
+func (r *Replicator) uploadQueued() error {
+	for {
+		names, _, err := r.queuedNames()
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return nil
+		}
+
+		for _, name := range names {
+			if err := r.upload(name); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// errRejected is returned for segments that the remote end will never
+// accept, which are dropped rather than retried forever.
+var errRejected = errors.New("segment was rejected")
+
+func (r *Replicator) upload(name string) error {
+	b, err := ioutil.ReadFile(path.Join(r.queueDir, name+entrySuffix))
+	if err != nil {
+		return err
+	}
+	var entry queueEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		fmt.Println("Dropping unreadable replication entry", name+":", err)
+		return r.removeEntry(name)
+	}
+
+	err = r.put(name, entry)
+	if err == errRejected {
+		fmt.Println("Dropping segment", name, "rejected by replication endpoint")
+	} else if err != nil {
+		return err
+	}
+
+	return r.removeEntry(name)
+}
+
+func (r *Replicator) put(name string, entry queueEntry) error {
+	file, err := os.Open(path.Join(r.queueDir, name+segmentSuffix))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	req, err := http.NewRequest(http.MethodPut, r.url, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = entry.Size
+
+	// Queued segments are MPEG-TS or fragmented MP4 files, which start
+	// with the MPEG-TS sync byte or an MP4 box respectively.
+	contentType := "video/mp2t"
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, 0); err == nil && b[0] != 0x47 {
+		contentType = "video/mp4"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(HeaderCreated, entry.Created.Format(time.RFC3339Nano))
+	req.Header.Set(HeaderModified, entry.Modified.Format(time.RFC3339Nano))
+	req.Header.Set(HeaderChecksum, entry.Checksum)
+	if entry.Discontinuity {
+		req.Header.Set(HeaderDiscontinuity, "true")
+	}
+	if len(r.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return errRejected
+	default:
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+}
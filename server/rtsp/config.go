@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rtsp
+
+// DefaultRTPPort is the UDP port that RTP is sent from if the
+// configuration does not say. RTCP uses the next port.
+const DefaultRTPPort = 8000
+
+// Config configures the RTSP server.
+type Config struct {
+	// Address is the address to listen on, for example ":8554". The
+	// RTSP server is disabled if it is empty.
+	Address string `json:"address"`
+
+	// Username and Password are required to play the streams, using
+	// digest authentication, if the username is set.
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// RTPPort is the UDP port that RTP is sent from to clients that do
+	// not use interleaved TCP. It defaults to DefaultRTPPort, and RTCP
+	// uses the next port.
+	RTPPort int `json:"rtpPort"`
+}
+
+// Enabled returns whether the RTSP server is configured.
+func (c Config) Enabled() bool {
+	return len(c.Address) != 0
+}
+
+func (c Config) rtpPort() int {
+	if c.RTPPort == 0 {
+		return DefaultRTPPort
+	}
+
+	return c.RTPPort
+}
@@ -0,0 +1,619 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package rtsp serves the frames being captured over RTSP, for NVRs and
+// players that do not support HLS. Frames are sent as they were encoded
+// by the camera, over interleaved TCP or UDP, to any number of clients.
+package rtsp
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	realm = "pi-camera-go"
+
+	// trackControl is the control URL of the video track, relative to
+	// the stream's URL.
+	trackControl = "trackID=0"
+
+	// sessionTimeout is how long a client may go without sending
+	// anything on its connection before it is closed. Clients that
+	// receive RTP over UDP have to send keep-alive requests.
+	sessionTimeout = 60 * time.Second
+	writeTimeout   = 10 * time.Second
+
+	publicMethods = "OPTIONS, DESCRIBE, SETUP, PLAY, PAUSE, TEARDOWN, GET_PARAMETER"
+)
+
+// Server is an RTSP server for the streams of every camera.
+type Server struct {
+	config Config
+
+	mutex   *sync.Mutex
+	streams map[string]*Stream
+
+	listener    net.Listener
+	rtp, rtcp   *net.UDPConn
+	connections map[*conn]bool
+	stopped     bool
+}
+
+func New(config Config) (*Server, error) {
+	port := config.rtpPort()
+	if port <= 0 || port%2 != 0 || port >= 65535 {
+		return nil, fmt.Errorf("invalid RTP port %d; it must be even", port)
+	}
+
+	return &Server{
+		config:      config,
+		mutex:       &sync.Mutex{},
+		streams:     make(map[string]*Stream),
+		connections: make(map[*conn]bool),
+	}, nil
+}
+
+// Handle serves the stream at the given path, for example "/live".
+func (s *Server) Handle(path string, stream *Stream) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.streams[path] = stream
+}
+
+// Start listens for clients on the configured address and its UDP ports.
+func (s *Server) Start() error {
+	host, _, err := net.SplitHostPort(s.config.Address)
+	if err != nil {
+		return err
+	}
+
+	port := s.config.rtpPort()
+	if s.rtp, err = net.ListenUDP("udp", udpAddr(host, port)); err != nil {
+		return err
+	}
+	if s.rtcp, err = net.ListenUDP("udp", udpAddr(host, port+1)); err != nil {
+		s.rtp.Close()
+		return err
+	}
+	if s.listener, err = net.Listen("tcp", s.config.Address); err != nil {
+		s.rtp.Close()
+		s.rtcp.Close()
+		return err
+	}
+
+	go s.discardRTCP()
+	go s.accept()
+	return nil
+}
+
+func udpAddr(host string, port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+}
+
+// Stop closes the server and all of its connections.
+func (s *Server) Stop() {
+	s.mutex.Lock()
+	s.stopped = true
+	connections := make([]*conn, 0, len(s.connections))
+	for c := range s.connections {
+		connections = append(connections, c)
+	}
+	s.mutex.Unlock()
+
+	s.listener.Close()
+	s.rtp.Close()
+	s.rtcp.Close()
+	for _, c := range connections {
+		c.conn.Close()
+	}
+}
+
+func (s *Server) accept() {
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			stopped := s.stopped
+			s.mutex.Unlock()
+			if stopped {
+				return
+			}
+			fmt.Println("Unable to accept RTSP connection:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		c, err := s.newConn(netConn)
+		if err != nil {
+			netConn.Close()
+			continue
+		}
+		go c.serve()
+	}
+}
+
+// discardRTCP reads the receiver reports sent by UDP clients, which are
+// not used.
+func (s *Server) discardRTCP() {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := s.rtcp.ReadFromUDP(buf); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) stream(path string) *Stream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.streams[strings.TrimSuffix(path, "/")]
+}
+
+// conn is a client connection. Each connection has at most one session,
+// which ends when the connection is closed.
+type conn struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+	nonce  string
+
+	// mutex guards writes, since interleaved packets are written by the
+	// session's goroutine.
+	mutex *sync.Mutex
+
+	stream  *Stream
+	session *session
+	playing bool
+
+	// The client's UDP address, or the interleaved channel for RTP over
+	// the connection if it is nil.
+	rtpAddr *net.UDPAddr
+	channel byte
+}
+
+type request struct {
+	method string
+	uri    string
+	header textproto.MIMEHeader
+}
+
+type response struct {
+	statusCode int
+	header     map[string]string
+	body       string
+}
+
+var statusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	401: "Unauthorized",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	459: "Aggregate Operation Not Allowed",
+	461: "Unsupported Transport",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	503: "Service Unavailable",
+}
+
+func (s *Server) newConn(netConn net.Conn) (*conn, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	c := &conn{
+		server: s,
+		conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		nonce:  hex.EncodeToString(b),
+		mutex:  &sync.Mutex{},
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return nil, errors.New("server is stopped")
+	}
+	s.connections[c] = true
+	return c, nil
+}
+
+func (c *conn) serve() {
+	defer c.close()
+
+	for {
+		req, err := c.readRequest()
+		if err != nil {
+			return
+		}
+
+		resp := c.handle(req)
+		if resp.header == nil {
+			resp.header = make(map[string]string)
+		}
+		resp.header["CSeq"] = req.header.Get("CSeq")
+		if err := c.writeResponse(resp); err != nil {
+			return
+		}
+
+		// Packets may only be sent once the client has the response to
+		// PLAY.
+		if req.method == "PLAY" && resp.statusCode == 200 && !c.playing {
+			c.playing = true
+			c.stream.play(c.session)
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.conn.Close()
+	c.endSession()
+
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	delete(c.server.connections, c)
+}
+
+func (c *conn) endSession() {
+	if c.session == nil {
+		return
+	}
+
+	if c.playing {
+		c.stream.pause(c.session)
+	}
+	close(c.session.packets)
+	c.session, c.playing = nil, false
+}
+
+// readRequest reads the next request, skipping any interleaved RTCP sent
+// by the client.
+func (c *conn) readRequest() (*request, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(sessionTimeout))
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+
+		var header [4]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return nil, err
+		}
+		if _, err := c.reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+			return nil, err
+		}
+	}
+
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "RTSP/") {
+		return nil, fmt.Errorf("invalid RTSP request: %s", line)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Requests from clients have no use for a body.
+	if value := header.Get("Content-Length"); len(value) != 0 {
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid RTSP content length: %s", value)
+		}
+		if _, err := c.reader.Discard(length); err != nil {
+			return nil, err
+		}
+	}
+
+	return &request{method: fields[0], uri: fields[1], header: header}, nil
+}
+
+func (c *conn) writeResponse(resp response) error {
+	text := statusText[resp.statusCode]
+	msg := fmt.Sprintf("RTSP/1.0 %d %s\r\n", resp.statusCode, text)
+	for key, value := range resp.header {
+		msg += key + ": " + value + "\r\n"
+	}
+	if len(resp.body) != 0 {
+		msg += fmt.Sprintf("Content-Length: %d\r\n", len(resp.body))
+	}
+	msg += "\r\n" + resp.body
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := io.WriteString(c.conn, msg)
+	return err
+}
+
+// writePackets sends a session's packets until the session ends.
+func (c *conn) writePackets(session *session) {
+	rtpAddr := c.rtpAddr
+	for packet := range session.packets {
+		if rtpAddr != nil {
+			// Errors are only temporary, as the client's ports may not
+			// be open yet.
+			c.server.rtp.WriteToUDP(packet, rtpAddr)
+			continue
+		}
+
+		frame := make([]byte, 4, 4+len(packet))
+		frame[0] = '$'
+		frame[1] = c.channel
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(packet)))
+		frame = append(frame, packet...)
+
+		c.mutex.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err := c.conn.Write(frame)
+		c.mutex.Unlock()
+		if err != nil {
+			// Closing the connection ends the session.
+			c.conn.Close()
+			for range session.packets {
+			}
+			return
+		}
+	}
+}
+
+func (c *conn) handle(req *request) response {
+	if req.method == "OPTIONS" {
+		return response{statusCode: 200, header: map[string]string{"Public": publicMethods}}
+	}
+
+	if !c.authorized(req) {
+		return response{statusCode: 401, header: map[string]string{
+			"WWW-Authenticate": fmt.Sprintf(`Digest realm="%s", nonce="%s"`, realm, c.nonce),
+		}}
+	}
+
+	u, err := url.Parse(req.uri)
+	if err != nil {
+		return response{statusCode: 400}
+	}
+
+	switch req.method {
+	case "DESCRIBE":
+		return c.describe(req, u)
+	case "SETUP":
+		return c.setup(req, u)
+	}
+
+	// The remaining methods apply to the session.
+	if c.session == nil {
+		return response{statusCode: 455}
+	}
+	if id := strings.SplitN(req.header.Get("Session"), ";", 2)[0]; strings.TrimSpace(id) != c.session.id {
+		return response{statusCode: 454}
+	}
+	header := map[string]string{"Session": c.session.id}
+
+	switch req.method {
+	case "PLAY":
+		uri := strings.TrimSuffix(strings.TrimSuffix(req.uri, "/"+trackControl), "/")
+		header["Range"] = "npt=0.000-"
+		header["RTP-Info"] = fmt.Sprintf("url=%s/%s;seq=%d;rtptime=%d",
+			uri, trackControl, c.session.sequence, c.stream.rtpTime(c.session))
+		return response{statusCode: 200, header: header}
+	case "PAUSE":
+		if c.playing {
+			c.stream.pause(c.session)
+			c.playing = false
+		}
+		return response{statusCode: 200, header: header}
+	case "TEARDOWN":
+		c.endSession()
+		return response{statusCode: 200}
+	case "GET_PARAMETER", "SET_PARAMETER":
+		return response{statusCode: 200, header: header}
+	default:
+		return response{statusCode: 501, header: map[string]string{"Public": publicMethods}}
+	}
+}
+
+func (c *conn) describe(req *request, u *url.URL) response {
+	stream := c.server.stream(u.Path)
+	if stream == nil {
+		return response{statusCode: 404}
+	}
+
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	sdp := stream.sdp(host)
+	if len(sdp) == 0 {
+		// Nothing has been captured yet, or the recorder backend does
+		// not provide frames.
+		return response{statusCode: 503}
+	}
+
+	return response{
+		statusCode: 200,
+		header: map[string]string{
+			"Content-Type": "application/sdp",
+			"Content-Base": strings.TrimSuffix(req.uri, "/") + "/",
+		},
+		body: sdp,
+	}
+}
+
+func (c *conn) setup(req *request, u *url.URL) response {
+	// The track may be set up with its own URL or the stream's.
+	path := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/"+trackControl)
+	stream := c.server.stream(path)
+	if stream == nil {
+		return response{statusCode: 404}
+	}
+	if c.session != nil {
+		// There is only one track, which is already set up.
+		return response{statusCode: 459}
+	}
+
+	transport, rtpAddr, channel, ok := c.parseTransport(req.header.Get("Transport"))
+	if !ok {
+		return response{statusCode: 461}
+	}
+
+	session, err := newSession()
+	if err != nil {
+		return response{statusCode: 500}
+	}
+
+	c.stream, c.session = stream, session
+	c.rtpAddr, c.channel = rtpAddr, channel
+	go c.writePackets(session)
+	return response{statusCode: 200, header: map[string]string{
+		"Transport": transport + fmt.Sprintf(";ssrc=%08X", session.ssrc),
+		"Session":   fmt.Sprintf("%s;timeout=%d", session.id, int(sessionTimeout/time.Second)),
+	}}
+}
+
+var portRangeRegexp = regexp.MustCompile(`^(\d+)(?:-(\d+))?$`)
+
+// parseTransport chooses the first unicast transport offered by the
+// client, returning the transport to reply with and the address or
+// interleaved channel to send RTP to.
+func (c *conn) parseTransport(header string) (string, *net.UDPAddr, byte, bool) {
+	for _, spec := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+		protocol := strings.ToUpper(params[0])
+
+		ports := ""
+		multicast := false
+		for _, param := range params[1:] {
+			switch {
+			case param == "multicast":
+				multicast = true
+			case protocol == "RTP/AVP/TCP" && strings.HasPrefix(param, "interleaved="):
+				ports = strings.TrimPrefix(param, "interleaved=")
+			case protocol != "RTP/AVP/TCP" && strings.HasPrefix(param, "client_port="):
+				ports = strings.TrimPrefix(param, "client_port=")
+			}
+		}
+		if multicast {
+			continue
+		}
+
+		switch protocol {
+		case "RTP/AVP/TCP":
+			channel := 0
+			if m := portRangeRegexp.FindStringSubmatch(ports); m != nil {
+				channel, _ = strconv.Atoi(m[1])
+			}
+			if channel > 254 {
+				continue
+			}
+			return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1), nil, byte(channel), true
+		case "RTP/AVP", "RTP/AVP/UDP":
+			m := portRangeRegexp.FindStringSubmatch(ports)
+			if m == nil {
+				continue
+			}
+			rtpPort, _ := strconv.Atoi(m[1])
+			rtcpPort := rtpPort + 1
+			if len(m[2]) != 0 {
+				rtcpPort, _ = strconv.Atoi(m[2])
+			}
+			if rtpPort <= 0 || rtpPort > 65535 || rtcpPort <= 0 || rtcpPort > 65535 {
+				continue
+			}
+
+			ip := c.conn.RemoteAddr().(*net.TCPAddr).IP
+			serverPort := c.server.config.rtpPort()
+			transport := fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d",
+				rtpPort, rtcpPort, serverPort, serverPort+1)
+			return transport, &net.UDPAddr{IP: ip, Port: rtpPort}, 0, true
+		}
+	}
+
+	return "", nil, 0, false
+}
+
+var authParamRegexp = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// authorized checks the request's digest credentials, if the server has
+// any.
+func (c *conn) authorized(req *request) bool {
+	config := c.server.config
+	if len(config.Username) == 0 {
+		return true
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(req.header.Get("Authorization")), " ", 2)
+	if len(fields) != 2 || strings.ToLower(fields[0]) != "digest" {
+		return false
+	}
+	params := make(map[string]string)
+	for _, match := range authParamRegexp.FindAllStringSubmatch(fields[1], -1) {
+		params[strings.ToLower(match[1])] = match[2] + match[3]
+	}
+
+	if params["username"] != config.Username || params["realm"] != realm || params["nonce"] != c.nonce {
+		return false
+	}
+
+	ha1 := md5Hex(config.Username + ":" + realm + ":" + config.Password)
+	ha2 := md5Hex(req.method + ":" + params["uri"])
+	expected := md5Hex(ha1 + ":" + c.nonce + ":" + ha2)
+	if params["qop"] == "auth" {
+		expected = md5Hex(ha1 + ":" + c.nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(params["response"]), []byte(expected)) == 1
+}
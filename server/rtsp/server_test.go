@@ -0,0 +1,369 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rtsp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+)
+
+const (
+	testUsername = "viewer"
+	testPassword = "secret"
+)
+
+// freeRTPPort returns an even UDP port whose next port is also free.
+func freeRTPPort(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		if port%2 != 0 || port >= 65534 {
+			rtp.Close()
+			continue
+		}
+		rtcp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port + 1})
+		rtp.Close()
+		if err != nil {
+			continue
+		}
+		rtcp.Close()
+		return port
+	}
+
+	t.Fatal("no free RTP port found")
+	return 0
+}
+
+// startServer starts a server for the mock recorder's frames. The stream
+// subscribes after the recorder has started, as it does in the server.
+func startServer(t *testing.T) string {
+	t.Helper()
+	s, err := New(Config{
+		Address:  "127.0.0.1:0",
+		Username: testUsername,
+		Password: testPassword,
+		RTPPort:  freeRTPPort(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+
+	r := recorder.NewMock()
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Stop() })
+
+	stream := NewStream()
+	s.Handle("/live", stream)
+	r.AddSubscriber(stream)
+
+	return s.listener.Addr().String()
+}
+
+// client is a minimal RTSP client that answers digest challenges.
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	cseq   int
+
+	username, password string
+	nonce              string
+}
+
+func dial(t *testing.T, addr, username, password string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &client{
+		t:        t,
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		username: username,
+		password: password,
+	}
+}
+
+var nonceRegexp = regexp.MustCompile(`nonce="([^"]*)"`)
+
+// do sends a request and returns the response's status code, header and
+// body, retrying once with credentials if the server asks for them.
+func (c *client) do(method, uri string, header map[string]string) (int, textproto.MIMEHeader, string) {
+	c.t.Helper()
+	for {
+		c.cseq++
+		msg := fmt.Sprintf("%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, uri, c.cseq)
+		for key, value := range header {
+			msg += key + ": " + value + "\r\n"
+		}
+		if len(c.nonce) != 0 {
+			ha1 := md5Hex(c.username + ":" + realm + ":" + c.password)
+			ha2 := md5Hex(method + ":" + uri)
+			msg += fmt.Sprintf("Authorization: Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\", response=\"%s\"\r\n",
+				c.username, realm, c.nonce, uri, md5Hex(ha1+":"+c.nonce+":"+ha2))
+		}
+		if _, err := io.WriteString(c.conn, msg+"\r\n"); err != nil {
+			c.t.Fatal(err)
+		}
+
+		status, respHeader, body := c.readResponse()
+		if got := respHeader.Get("CSeq"); got != strconv.Itoa(c.cseq) {
+			c.t.Fatalf("%s: got CSeq %q, want %d", method, got, c.cseq)
+		}
+		if status == 401 && len(c.nonce) == 0 && len(c.username) != 0 {
+			m := nonceRegexp.FindStringSubmatch(respHeader.Get("WWW-Authenticate"))
+			if m == nil {
+				c.t.Fatalf("%s: no nonce in challenge", method)
+			}
+			c.nonce = m[1]
+			continue
+		}
+
+		return status, respHeader, body
+	}
+}
+
+func (c *client) readResponse() (int, textproto.MIMEHeader, string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "RTSP/1.0" {
+		c.t.Fatalf("invalid status line %q", line)
+	}
+	status, _ := strconv.Atoi(fields[1])
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body := make([]byte, 0)
+	if value := header.Get("Content-Length"); len(value) != 0 {
+		length, _ := strconv.Atoi(value)
+		body = make([]byte, length)
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+
+	return status, header, string(body)
+}
+
+// describe waits for the stream to have its parameter sets and returns
+// its session description.
+func (c *client) describe(uri string) string {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, header, body := c.do("DESCRIBE", uri, map[string]string{"Accept": "application/sdp"})
+		if status == 200 {
+			if got := header.Get("Content-Type"); got != "application/sdp" {
+				c.t.Errorf("DESCRIBE: got content type %q", got)
+			}
+			return body
+		}
+		if status != 503 || time.Now().After(deadline) {
+			c.t.Fatalf("DESCRIBE: got status %d", status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// setupAndPlay sets up the track with the given transport, starts
+// playing and returns the session ID and the SSRC the server chose.
+func (c *client) setupAndPlay(uri, transport string) (string, uint32) {
+	c.t.Helper()
+	status, header, _ := c.do("SETUP", uri+"/"+trackControl, map[string]string{"Transport": transport})
+	if status != 200 {
+		c.t.Fatalf("SETUP: got status %d", status)
+	}
+	session := strings.SplitN(header.Get("Session"), ";", 2)[0]
+	m := regexp.MustCompile(`ssrc=([0-9A-F]{8})`).FindStringSubmatch(header.Get("Transport"))
+	if m == nil {
+		c.t.Fatalf("SETUP: no SSRC in transport %q", header.Get("Transport"))
+	}
+	ssrc, _ := strconv.ParseUint(m[1], 16, 32)
+
+	status, header, _ = c.do("PLAY", uri, map[string]string{"Session": session})
+	if status != 200 {
+		c.t.Fatalf("PLAY: got status %d", status)
+	}
+	if !strings.Contains(header.Get("RTP-Info"), trackControl) {
+		c.t.Errorf("PLAY: got RTP-Info %q", header.Get("RTP-Info"))
+	}
+
+	return session, uint32(ssrc)
+}
+
+// checkPackets reads RTP packets until a whole key frame has been
+// received, checking their headers and sequence numbers.
+func checkPackets(t *testing.T, ssrc uint32, read func() []byte) {
+	t.Helper()
+	var sequence uint16
+	keyFrame := false
+	for i := 0; i < 10000; i++ {
+		packet := read()
+		if len(packet) < 13 {
+			t.Fatalf("packet of %d bytes is too short", len(packet))
+		}
+		if packet[0]>>6 != 2 || packet[1]&0x7f != payloadType {
+			t.Fatalf("invalid RTP header % x", packet[:2])
+		}
+		if got := binary.BigEndian.Uint32(packet[8:]); got != ssrc {
+			t.Fatalf("got SSRC %08X, want %08X", got, ssrc)
+		}
+		if got := binary.BigEndian.Uint16(packet[2:]); i != 0 && got != sequence+1 {
+			t.Fatalf("got sequence number %d after %d", got, sequence)
+		}
+		sequence = binary.BigEndian.Uint16(packet[2:])
+
+		// The first packets sent are the parameter sets and key frame,
+		// which is fragmented.
+		payload := packet[12:]
+		nalType := payload[0] & 0x1f
+		if i == 0 && nalType != 7 {
+			t.Fatalf("first packet has NAL unit type %d, want an SPS", nalType)
+		}
+		if nalType == 28 && payload[1]&0x1f == 5 {
+			keyFrame = true
+		}
+		if keyFrame && packet[1]&0x80 != 0 {
+			return
+		}
+	}
+
+	t.Fatal("no complete key frame received")
+}
+
+func TestServer(t *testing.T) {
+	addr := startServer(t)
+	uri := "rtsp://" + addr + "/live"
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		c := dial(t, addr, "", "")
+		if status, _, _ := c.do("OPTIONS", uri, nil); status != 200 {
+			t.Errorf("OPTIONS: got status %d, want 200", status)
+		}
+		if status, _, _ := c.do("DESCRIBE", uri, nil); status != 401 {
+			t.Errorf("DESCRIBE: got status %d, want 401", status)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		c := dial(t, addr, testUsername, testPassword)
+		if status, _, _ := c.do("DESCRIBE", "rtsp://"+addr+"/missing", nil); status != 404 {
+			t.Errorf("DESCRIBE: got status %d, want 404", status)
+		}
+	})
+
+	t.Run("TCP", func(t *testing.T) {
+		c := dial(t, addr, testUsername, testPassword)
+		sdp := c.describe(uri)
+		for _, want := range []string{"a=rtpmap:96 H264/90000", "sprop-parameter-sets=", "a=control:" + trackControl} {
+			if !strings.Contains(sdp, want) {
+				t.Errorf("session description does not contain %q:\n%s", want, sdp)
+			}
+		}
+
+		_, ssrc := c.setupAndPlay(uri, "RTP/AVP/TCP;unicast;interleaved=0-1")
+		checkPackets(t, ssrc, func() []byte {
+			c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var header [4]byte
+			if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+				t.Fatal(err)
+			}
+			if header[0] != '$' || header[1] != 0 {
+				t.Fatalf("invalid interleaved frame header % x", header)
+			}
+			packet := make([]byte, binary.BigEndian.Uint16(header[2:]))
+			if _, err := io.ReadFull(c.reader, packet); err != nil {
+				t.Fatal(err)
+			}
+			return packet
+		})
+	})
+
+	t.Run("UDP", func(t *testing.T) {
+		rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rtp.Close()
+		rtp.SetReadBuffer(8 * 1024 * 1024)
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+
+		c := dial(t, addr, testUsername, testPassword)
+		c.describe(uri)
+		session, ssrc := c.setupAndPlay(uri, fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1))
+		buf := make([]byte, 2048)
+		checkPackets(t, ssrc, func() []byte {
+			rtp.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := rtp.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return buf[:n]
+		})
+
+		if status, _, _ := c.do("TEARDOWN", uri, nil); status != 454 {
+			t.Errorf("TEARDOWN without a session ID: got status %d, want 454", status)
+		}
+		if status, _, _ := c.do("TEARDOWN", uri, map[string]string{"Session": session}); status != 200 {
+			t.Errorf("TEARDOWN: got status %d, want 200", status)
+		}
+		if status, _, _ := c.do("PLAY", uri, map[string]string{"Session": session}); status != 455 {
+			t.Errorf("PLAY after TEARDOWN: got status %d, want 455", status)
+		}
+	})
+}
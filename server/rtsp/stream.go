@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rtsp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+)
+
+const (
+	// payloadType is the dynamic RTP payload type used for H.264.
+	payloadType = 96
+
+	// maxPayloadSize keeps RTP packets within a typical MTU. Larger NAL
+	// units are sent as FU-A fragments.
+	maxPayloadSize = 1400
+
+	// maxQueuedPackets is the number of packets queued for each client.
+	// Frames are dropped for clients that fall further behind, until the
+	// next key frame.
+	maxQueuedPackets = 1024
+)
+
+// Stream is the live stream of one camera. It is a recorder subscriber.
+type Stream struct {
+	mutex    *sync.Mutex
+	sessions map[*session]bool
+
+	sps, pps      []byte
+	started       bool
+	lastTime      time.Duration
+	frameDuration time.Duration
+
+	// timestamp is the RTP time of the latest frame, which keeps
+	// increasing when the capture process is restarted.
+	timestamp uint32
+}
+
+func NewStream() *Stream {
+	return &Stream{
+		mutex:    &sync.Mutex{},
+		sessions: make(map[*session]bool),
+	}
+}
+
+// VideoRecorded implements recorder.Subscriber. Only frames are streamed,
+// so recorded segments are ignored.
+func (s *Stream) VideoRecorded(filePath string, created, modified time.Time) {
+}
+
+// FrameCaptured implements recorder.FrameSubscriber.
+func (s *Stream) FrameCaptured(frame recorder.Frame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Frame times start over when the capture process is restarted, in
+	// which case the last frame is assumed to have the usual duration.
+	if frame.Time > s.lastTime {
+		s.frameDuration = frame.Time - s.lastTime
+	}
+	if s.started {
+		s.timestamp += uint32(int64(s.frameDuration) * 9 / 100000)
+	}
+	s.started = true
+	s.lastTime = frame.Time
+
+	var nals [][]byte
+	hasSPS, hasPPS := false, false
+	for _, nal := range frame.NALUnits() {
+		switch nal[0] & 0x1f {
+		case 7:
+			s.sps, hasSPS = append([]byte(nil), nal...), true
+		case 8:
+			s.pps, hasPPS = append([]byte(nil), nal...), true
+		case 9:
+			// Access unit delimiters are not needed over RTP.
+			continue
+		}
+		nals = append(nals, nal)
+	}
+	if len(s.sessions) == 0 {
+		return
+	}
+
+	// Clients can start decoding at any key frame, so key frames are
+	// sent with the parameter sets.
+	if frame.KeyFrame && !(hasSPS && hasPPS) && s.sps != nil && s.pps != nil {
+		nals = append([][]byte{s.sps, s.pps}, nals...)
+	}
+
+	for session := range s.sessions {
+		session.writeFrame(s.timestamp, frame.KeyFrame, nals)
+	}
+}
+
+// sdp returns the session description of the stream, or an empty string
+// if no parameter sets have been captured yet.
+func (s *Stream) sdp(host string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.sps) < 4 || s.pps == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\n")
+	fmt.Fprintf(&b, "o=- 0 0 IN IP4 %s\r\n", host)
+	fmt.Fprintf(&b, "s=pi-camera-go\r\n")
+	fmt.Fprintf(&b, "c=IN IP4 0.0.0.0\r\n")
+	fmt.Fprintf(&b, "t=0 0\r\n")
+	fmt.Fprintf(&b, "a=control:*\r\n")
+	fmt.Fprintf(&b, "a=range:npt=now-\r\n")
+	fmt.Fprintf(&b, "m=video 0 RTP/AVP %d\r\n", payloadType)
+	fmt.Fprintf(&b, "a=rtpmap:%d H264/90000\r\n", payloadType)
+	fmt.Fprintf(&b, "a=fmtp:%d packetization-mode=1;profile-level-id=%s;sprop-parameter-sets=%s,%s\r\n",
+		payloadType, hex.EncodeToString(s.sps[1:4]),
+		base64.StdEncoding.EncodeToString(s.sps), base64.StdEncoding.EncodeToString(s.pps))
+	fmt.Fprintf(&b, "a=control:%s\r\n", trackControl)
+	return b.String()
+}
+
+func (s *Stream) play(session *session) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions[session] = true
+}
+
+// rtpTime returns the session's RTP time of the latest frame.
+func (s *Stream) rtpTime(session *session) uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.timestamp + session.timestampBase
+}
+
+func (s *Stream) pause(session *session) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, session)
+	session.started = false
+}
+
+// session is a client's RTP session. Packets are queued and sent by their
+// own goroutine, so that a slow client does not hold up the others.
+type session struct {
+	id string
+
+	ssrc          uint32
+	sequence      uint16
+	timestampBase uint32
+
+	// started is set once a key frame has been queued, as the frames
+	// before it cannot be decoded.
+	started bool
+	packets chan []byte
+}
+
+func newSession() (*session, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return &session{
+		id:            hex.EncodeToString(b[:8]),
+		ssrc:          binary.BigEndian.Uint32(b[8:]),
+		sequence:      binary.BigEndian.Uint16(b[12:]),
+		timestampBase: binary.BigEndian.Uint32(b[16:]),
+		packets:       make(chan []byte, maxQueuedPackets),
+	}, nil
+}
+
+// writeFrame queues a frame's RTP packets. The caller must hold the
+// stream's mutex.
+func (s *session) writeFrame(timestamp uint32, keyFrame bool, nals [][]byte) {
+	if !s.started && !keyFrame {
+		return
+	}
+
+	packets := s.packetize(timestamp+s.timestampBase, nals)
+	if len(s.packets)+len(packets) > cap(s.packets) {
+		s.started = false
+		return
+	}
+	s.started = true
+
+	for _, packet := range packets {
+		s.packets <- packet
+		s.sequence++
+	}
+}
+
+// packetize returns the RTP packets of an access unit, as described in
+// RFC 6184, starting at the session's sequence number.
+func (s *session) packetize(timestamp uint32, nals [][]byte) [][]byte {
+	var packets [][]byte
+	add := func(marker bool, payload ...[]byte) {
+		packet := make([]byte, 12, 12+maxPayloadSize)
+		packet[0] = 0x80
+		packet[1] = payloadType
+		if marker {
+			packet[1] |= 0x80
+		}
+		binary.BigEndian.PutUint16(packet[2:], s.sequence+uint16(len(packets)))
+		binary.BigEndian.PutUint32(packet[4:], timestamp)
+		binary.BigEndian.PutUint32(packet[8:], s.ssrc)
+		for _, p := range payload {
+			packet = append(packet, p...)
+		}
+		packets = append(packets, packet)
+	}
+
+	for i, nal := range nals {
+		last := i == len(nals)-1
+		if len(nal) <= maxPayloadSize {
+			add(last, nal)
+			continue
+		}
+
+		// Fragment the NAL unit, with its header split between the FU
+		// indicator and the FU header.
+		indicator := nal[0]&0xe0 | 28
+		for data, first := nal[1:], true; len(data) != 0; first = false {
+			n := len(data)
+			if n > maxPayloadSize-2 {
+				n = maxPayloadSize - 2
+			}
+			header := nal[0] & 0x1f
+			if first {
+				header |= 0x80
+			}
+			if n == len(data) {
+				header |= 0x40
+			}
+			add(last && n == len(data), []byte{indicator, header}, data[:n])
+			data = data[n:]
+		}
+	}
+
+	return packets
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package schedule
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+)
+
+const checkInterval = 10 * time.Second
+
+type schedulerImpl struct {
+	config   Config
+	schedule *schedule
+	clock    Clock
+	recorder recorder.Recorder
+	profiles []recorder.Profile
+
+	recording bool
+	override  *Override
+	profile   string
+	stop      chan struct{}
+	mutex     *sync.Mutex
+}
+
+// New creates a scheduler for a recorder, which switches between the given
+// profiles. If recording is true, the recorder has already been started.
+func New(config Config, r recorder.Recorder, profiles []recorder.Profile, recording bool, clock Clock) (Scheduler, error) {
+	s, err := parseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure that every scheduled profile exists.
+	names := []string{s.defaultProfile}
+	for _, w := range s.profiles {
+		names = append(names, w.profile)
+	}
+	for _, name := range names {
+		if _, err := FindProfile(profiles, name); len(name) != 0 && err != nil {
+			return nil, err
+		}
+	}
+
+	return &schedulerImpl{
+		config:    config,
+		schedule:  s,
+		clock:     clock,
+		recorder:  r,
+		profiles:  profiles,
+		recording: recording,
+		profile:   r.Profile().Name,
+		mutex:     &sync.Mutex{},
+	}, nil
+}
+
+// FindProfile returns the profile with the given name. The default profile
+// is always available.
+func FindProfile(profiles []recorder.Profile, name string) (recorder.Profile, error) {
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+	if name == recorder.DefaultProfile.Name {
+		return recorder.DefaultProfile, nil
+	}
+
+	return recorder.Profile{}, fmt.Errorf("unknown profile: %s", name)
+}
+
+func (s *schedulerImpl) Start() {
+	s.mutex.Lock()
+	if s.stop != nil {
+		s.mutex.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	s.stop = stop
+	s.mutex.Unlock()
+
+	s.Update()
+	go s.loop(stop)
+}
+
+func (s *schedulerImpl) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+func (s *schedulerImpl) loop(stop chan struct{}) {
+	ticker := s.clock.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			s.Update()
+		}
+	}
+}
+
+// shouldRecord reports whether the recorder should be running at the
+// given time. The caller must hold the mutex.
+func (s *schedulerImpl) shouldRecord(now time.Time) bool {
+	if s.override != nil {
+		if now.Before(s.override.Until) {
+			return s.override.Record
+		}
+
+		s.override = nil
+	}
+
+	return s.schedule.active(now)
+}
+
+func (s *schedulerImpl) Update() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	s.updateProfile(now)
+
+	record := s.shouldRecord(now)
+	if record == s.recording {
+		return
+	}
+
+	if record {
+		println("Starting recorder for schedule")
+		if err := s.recorder.Start(); err != nil {
+			fmt.Println("Unable to start recorder:", err)
+			return
+		}
+	} else {
+		println("Stopping recorder for schedule")
+		if err := s.recorder.Stop(); err != nil {
+			fmt.Println("Error when stopping recorder:", err)
+		}
+	}
+
+	s.recording = record
+}
+
+// updateProfile switches the recorder to the scheduled profile when the
+// schedule moves from one profile to another, so that a profile selected
+// manually stays in place until the next scheduled change. The caller must
+// hold the mutex.
+func (s *schedulerImpl) updateProfile(now time.Time) {
+	name := s.schedule.profileAt(now)
+	if len(name) == 0 || name == s.profile {
+		return
+	}
+
+	s.profile = name
+	if s.recorder.Profile().Name == name {
+		return
+	}
+
+	profile, err := FindProfile(s.profiles, name)
+	if err == nil {
+		err = s.recorder.SetProfile(profile)
+	}
+	if err != nil {
+		fmt.Println("Unable to switch to profile", name+":", err)
+	}
+}
+
+func (s *schedulerImpl) Status() Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	s.shouldRecord(now) // expires the override if necessary
+
+	status := Status{
+		Config:           s.config,
+		InWindow:         s.schedule.active(now),
+		Recording:        s.recording,
+		Profile:          s.recorder.Profile().Name,
+		ScheduledProfile: s.schedule.profileAt(now),
+	}
+	if s.override != nil {
+		override := *s.override
+		status.Override = &override
+	}
+	if next, err := s.schedule.nextChange(now); err == nil {
+		status.NextChange = next
+	}
+
+	return status
+}
+
+func (s *schedulerImpl) SetOverride(record bool, duration time.Duration) {
+	s.mutex.Lock()
+	s.override = &Override{
+		Record: record,
+		Until:  s.clock.Now().Add(duration),
+	}
+	s.mutex.Unlock()
+
+	s.Update()
+}
+
+func (s *schedulerImpl) ClearOverride() {
+	s.mutex.Lock()
+	s.override = nil
+	s.mutex.Unlock()
+
+	s.Update()
+}
@@ -0,0 +1,293 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package schedule
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+)
+
+// fakeClock is a Clock whose time only moves when set. Setting it fires
+// all of its tickers.
+type fakeClock struct {
+	now     time.Time
+	tickers []*fakeTicker
+	mutex   sync.Mutex
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	t.stopped = true
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// set moves the clock to the given time and fires the tickers. Each tick
+// is sent twice: the second send is only received once the scheduler has
+// finished handling the first, so the update has happened when set
+// returns.
+func (c *fakeClock) set(now time.Time) {
+	c.mutex.Lock()
+	c.now = now
+	tickers := append([]*fakeTicker(nil), c.tickers...)
+	c.mutex.Unlock()
+
+	for _, t := range tickers {
+		t.c <- now
+		t.c <- now
+	}
+}
+
+func (c *fakeClock) stopped() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, t := range c.tickers {
+		if !t.stopped {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *fakeClock) tickerCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.tickers)
+}
+
+// fakeRecorder records calls to Start, Stop and SetProfile.
+type fakeRecorder struct {
+	recorder.Recorder
+
+	running bool
+	profile recorder.Profile
+	mutex   sync.Mutex
+}
+
+func (r *fakeRecorder) Start() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.running = true
+	return nil
+}
+
+func (r *fakeRecorder) Stop() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.running = false
+	return nil
+}
+
+func (r *fakeRecorder) Profile() recorder.Profile {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.profile
+}
+
+func (r *fakeRecorder) SetProfile(profile recorder.Profile) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.profile = profile
+	return nil
+}
+
+func (r *fakeRecorder) isRunning() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.running
+}
+
+func at(hour, minute int) time.Time {
+	// 2018-06-04 is a Monday.
+	return time.Date(2018, 6, 4, hour, minute, 0, 0, time.UTC)
+}
+
+func newTestScheduler(t *testing.T, config Config, r *fakeRecorder, clock *fakeClock) Scheduler {
+	t.Helper()
+	config.Timezone = "UTC"
+	s, err := New(config, r, []recorder.Profile{{Name: "day"}, {Name: "night"}}, r.running, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	t.Cleanup(s.Stop)
+	for clock.tickerCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	return s
+}
+
+func TestSchedulerWindows(t *testing.T) {
+	config := Config{Windows: []Window{{Start: "08:00", End: "17:00"}}}
+	r := &fakeRecorder{}
+	clock := &fakeClock{now: at(7, 0)}
+	s := newTestScheduler(t, config, r, clock)
+
+	if r.isRunning() {
+		t.Error("recorder was started outside the window")
+	}
+	if status := s.Status(); status.InWindow || !status.NextChange.Equal(at(8, 0)) {
+		t.Errorf("got status %+v at 07:00", status)
+	}
+
+	clock.set(at(8, 0))
+	if !r.isRunning() {
+		t.Error("recorder was not started in the window")
+	}
+
+	clock.set(at(17, 0))
+	if r.isRunning() {
+		t.Error("recorder was not stopped after the window")
+	}
+
+	s.Stop()
+	for !clock.stopped() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerOverride(t *testing.T) {
+	config := Config{Windows: []Window{{Days: []string{"Monday"}, Start: "08:00", End: "17:00"}}}
+	r := &fakeRecorder{}
+	clock := &fakeClock{now: at(7, 0)}
+	s := newTestScheduler(t, config, r, clock)
+
+	s.SetOverride(true, 30*time.Minute)
+	if !r.isRunning() {
+		t.Error("recorder was not started by the override")
+	}
+	if status := s.Status(); status.Override == nil || !status.Override.Until.Equal(at(7, 30)) {
+		t.Errorf("got status %+v with an override", status)
+	}
+
+	clock.set(at(7, 31))
+	if r.isRunning() {
+		t.Error("recorder was not stopped when the override expired")
+	}
+	if status := s.Status(); status.Override != nil {
+		t.Errorf("override %+v did not expire", status.Override)
+	}
+
+	clock.set(at(12, 0))
+	s.SetOverride(false, time.Hour)
+	if r.isRunning() {
+		t.Error("recorder was not stopped by the override")
+	}
+	s.ClearOverride()
+	if !r.isRunning() {
+		t.Error("recorder was not started after clearing the override")
+	}
+}
+
+func TestSchedulerProfiles(t *testing.T) {
+	config := Config{
+		Profiles:       []ProfileWindow{{Profile: "night", Window: Window{Start: "20:00", End: "06:00"}}},
+		DefaultProfile: "day",
+	}
+	r := &fakeRecorder{running: true, profile: recorder.Profile{Name: "day"}}
+	clock := &fakeClock{now: at(12, 0)}
+	s := newTestScheduler(t, config, r, clock)
+
+	clock.set(at(20, 0))
+	if name := r.Profile().Name; name != "night" {
+		t.Errorf("got profile %s at 20:00", name)
+	}
+
+	// A profile selected manually stays until the next scheduled change.
+	r.SetProfile(recorder.Profile{Name: "day"})
+	clock.set(at(23, 0))
+	if name := r.Profile().Name; name != "day" {
+		t.Errorf("manually selected profile was replaced by %s", name)
+	}
+
+	clock.set(at(6, 0).AddDate(0, 0, 1))
+	clock.set(at(20, 0).AddDate(0, 0, 1))
+	if status := s.Status(); status.Profile != "night" || status.ScheduledProfile != "night" || !r.isRunning() {
+		t.Errorf("got status %+v on the next night", status)
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	s, err := parseConfig(Config{
+		Timezone: "UTC",
+		Windows:  []Window{{Days: []string{"mon"}, Start: "22:00", End: "02:00"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		t      time.Time
+		active bool
+	}{
+		{at(21, 59), false},
+		{at(22, 0), true},
+		{at(1, 59).AddDate(0, 0, 1), true}, // Tuesday, from Monday's window
+		{at(2, 0).AddDate(0, 0, 1), false},
+		{at(23, 0).AddDate(0, 0, 1), false},
+		{at(1, 0), false}, // Monday, but Sunday has no window
+	}
+	for _, test := range tests {
+		if active := s.active(test.t); active != test.active {
+			t.Errorf("active(%v) = %v, want %v", test.t, active, test.active)
+		}
+	}
+
+	if next, err := s.nextChange(at(12, 0)); err != nil || !next.Equal(at(22, 0)) {
+		t.Errorf("nextChange = %v, %v", next, err)
+	}
+	if _, err := parseConfig(Config{Windows: []Window{{Start: "25:00", End: "02:00"}}}); err == nil {
+		t.Error("accepted an invalid time of day")
+	}
+}
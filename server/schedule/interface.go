@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package schedule
+
+import (
+	"time"
+)
+
+// Clock provides the current time and tickers. It can be replaced to
+// control time in tests.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks on a channel, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// SystemClock is the Clock backed by the system time.
+var SystemClock Clock = systemClock{}
+
+// Override forces recording on or off until it expires.
+type Override struct {
+	Record bool      `json:"record"`
+	Until  time.Time `json:"until"`
+}
+
+// Status describes the current state of a Scheduler.
+type Status struct {
+	Config     Config    `json:"config"`
+	InWindow   bool      `json:"inWindow"`
+	Recording  bool      `json:"recording"`
+	Override   *Override `json:"override,omitempty"`
+	NextChange time.Time `json:"nextChange,omitempty"`
+
+	Profile          string `json:"profile"`
+	ScheduledProfile string `json:"scheduledProfile,omitempty"`
+}
+
+// Scheduler starts and stops a recorder according to a schedule.
+type Scheduler interface {
+	Start()
+	Stop()
+
+	// Update evaluates the schedule immediately.
+	Update()
+
+	Status() Status
+	SetOverride(record bool, duration time.Duration)
+	ClearOverride()
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Config describes when to record. Recording happens whenever the current
+// time falls in any of the windows; with no windows, recording never
+// stops.
+type Config struct {
+	// Timezone is an IANA time zone name such as "Europe/London". The
+	// local time zone is used if it is empty.
+	Timezone string   `json:"timezone"`
+	Windows  []Window `json:"windows"`
+
+	// Profiles selects recorder profiles by time of day. The first
+	// matching window wins, and DefaultProfile applies outside all of
+	// them. Profiles are not switched automatically if both are empty.
+	Profiles       []ProfileWindow `json:"profiles"`
+	DefaultProfile string          `json:"defaultProfile"`
+}
+
+// Window is a daily time range on some days of the week. Start and End are
+// given as "HH:MM". A window whose end is not after its start runs past
+// midnight into the next day, and belongs to the day on which it starts.
+// A window without days applies to every day.
+type Window struct {
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// ProfileWindow selects a recorder profile during a window.
+type ProfileWindow struct {
+	Profile string `json:"profile"`
+	Window
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// window is a parsed Window. Times are given in minutes after midnight.
+type window struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); err != nil {
+		return 0, fmt.Errorf("invalid time of day: %s", s)
+	}
+	if hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time of day: %s", s)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+func parseWindow(w Window) (window, error) {
+	var parsed window
+	if len(w.Days) == 0 {
+		for i := range parsed.days {
+			parsed.days[i] = true
+		}
+	}
+	for _, day := range w.Days {
+		day = strings.ToLower(day)
+		if len(day) > 3 {
+			day = day[:3]
+		}
+
+		weekday, ok := dayNames[day]
+		if !ok {
+			return window{}, fmt.Errorf("invalid day: %s", day)
+		}
+		parsed.days[weekday] = true
+	}
+
+	var err error
+	if parsed.start, err = parseTimeOfDay(w.Start); err != nil {
+		return window{}, err
+	}
+	if parsed.end, err = parseTimeOfDay(w.End); err != nil {
+		return window{}, err
+	}
+
+	return parsed, nil
+}
+
+// schedule is a parsed Config.
+type schedule struct {
+	location       *time.Location
+	windows        []window
+	profiles       []profileWindow
+	defaultProfile string
+}
+
+type profileWindow struct {
+	profile string
+	window  window
+}
+
+func parseConfig(config Config) (*schedule, error) {
+	location := time.Local
+	if len(config.Timezone) != 0 {
+		var err error
+		location, err = time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &schedule{
+		location:       location,
+		defaultProfile: config.DefaultProfile,
+	}
+	for _, w := range config.Windows {
+		parsed, err := parseWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, parsed)
+	}
+	for _, w := range config.Profiles {
+		if len(w.Profile) == 0 {
+			return nil, errors.New("profile window requires a profile")
+		}
+
+		parsed, err := parseWindow(w.Window)
+		if err != nil {
+			return nil, err
+		}
+		s.profiles = append(s.profiles, profileWindow{profile: w.Profile, window: parsed})
+	}
+
+	return s, nil
+}
+
+// Validate checks that a configuration can be parsed.
+func (config Config) Validate() error {
+	_, err := parseConfig(config)
+	return err
+}
+
+// active reports whether t falls within any window.
+func (s *schedule) active(t time.Time) bool {
+	if len(s.windows) == 0 {
+		return true
+	}
+
+	for _, w := range s.windows {
+		if w.contains(t, s.location) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// profileAt returns the name of the profile scheduled at t, or an empty
+// string if profiles are not scheduled.
+func (s *schedule) profileAt(t time.Time) string {
+	for _, w := range s.profiles {
+		if w.window.contains(t, s.location) {
+			return w.profile
+		}
+	}
+
+	return s.defaultProfile
+}
+
+// ProfileAt returns the name of the profile scheduled at t, or an empty
+// string if profiles are not scheduled.
+func (config Config) ProfileAt(t time.Time) (string, error) {
+	s, err := parseConfig(config)
+	if err != nil {
+		return "", err
+	}
+
+	return s.profileAt(t), nil
+}
+
+// contains reports whether t falls within the window.
+func (w window) contains(t time.Time, location *time.Location) bool {
+	t = t.In(location)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	yesterday := midnight.AddDate(0, 0, -1)
+
+	// Check the window that starts today and the one that started
+	// yesterday, in case it runs past midnight.
+	for _, day := range []time.Time{midnight, yesterday} {
+		if !w.days[day.Weekday()] {
+			continue
+		}
+
+		// Build the times from the date so that they stay correct across
+		// daylight saving time changes.
+		start := time.Date(day.Year(), day.Month(), day.Day(), 0, w.start, 0, 0, location)
+		end := time.Date(day.Year(), day.Month(), day.Day(), 0, w.end, 0, 0, location)
+		if w.end <= w.start {
+			end = end.AddDate(0, 0, 1)
+		}
+
+		if !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextChange returns the next time after t at which the schedule becomes
+// active or inactive, searching up to a week ahead at minute resolution,
+// which is the resolution of the windows themselves.
+func (s *schedule) nextChange(t time.Time) (time.Time, error) {
+	if len(s.windows) == 0 {
+		return time.Time{}, errors.New("schedule never changes")
+	}
+
+	current := s.active(t)
+	next := t.Truncate(time.Minute)
+	for i := 0; i < 7*24*60; i++ {
+		next = next.Add(time.Minute)
+		if s.active(next) != current {
+			return next, nil
+		}
+	}
+
+	return time.Time{}, errors.New("schedule never changes")
+}
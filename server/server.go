@@ -26,21 +26,23 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/joshb/pi-camera-go/server/recorder"
+	"github.com/joshb/pi-camera-go/server/aggregator"
+	"github.com/joshb/pi-camera-go/server/rtsp"
 	"github.com/joshb/pi-camera-go/server/storage"
 	"github.com/joshb/pi-camera-go/server/util"
 )
 
-const (
-	segmentsPrefix = "/segments/"
-	staticPrefix = "/"
-)
+const staticPrefix = "/"
 
 type Server interface {
 	Start(addr string) error
@@ -50,17 +52,22 @@ type Server interface {
 type serverImpl struct {
 	privateKeyPath string
 	publicKeyPath  string
+	config         Config
 
-	storage  storage.Storage
-	recorder recorder.Recorder
+	// cameras holds every camera, in the order they were configured.
+	// The first is the default camera, which is also served at the
+	// top-level URLs.
+	cameras       []*camera
+	camerasByName map[string]*camera
+	ingest        *ingestStore
+	rtsp          *rtsp.Server
 
-	segmentsFileServer http.Handler
-	staticFileServer   http.Handler
+	staticFileServer http.Handler
 }
 
-func New(https bool) (Server, error) {
+func New(config Config) (Server, error) {
 	var privateKeyPath, publicKeyPath string
-	if https {
+	if config.HTTPS {
 		var err error
 		privateKeyPath, publicKeyPath, err = util.KeyPaths()
 		if err != nil {
@@ -68,40 +75,49 @@ func New(https bool) (Server, error) {
 		}
 	}
 
-	return &serverImpl{
+	cameraConfigs, err := config.CameraConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &serverImpl{
 		privateKeyPath: privateKeyPath,
 		publicKeyPath:  publicKeyPath,
-	}, nil
+		config:         config,
+		camerasByName:  make(map[string]*camera),
+		ingest:         newIngestStore(config.Ingest, config.Storage),
+	}
+	for _, cameraConfig := range cameraConfigs {
+		c := newCamera(cameraConfig, config.Replication, config.WebRTC, config.MJPEG)
+		s.cameras = append(s.cameras, c)
+		s.camerasByName[c.name] = c
+	}
+
+	return s, nil
 }
 
 func (s *serverImpl) Start(addr string) error {
-	var err error
-	s.storage, err = storage.New()
-	if err != nil {
-		return err
+	for _, c := range s.cameras {
+		if err := c.start(); err != nil {
+			return fmt.Errorf("unable to start camera %s: %s", c.name, err)
+		}
+	}
+
+	if s.config.RTSP.Enabled() {
+		if err := s.startRTSP(); err != nil {
+			return fmt.Errorf("unable to start RTSP server: %s", err)
+		}
 	}
 
-	s.segmentsFileServer = http.StripPrefix(segmentsPrefix,
-		http.FileServer(http.Dir(s.storage.SegmentDir())))
 	s.staticFileServer = http.StripPrefix(staticPrefix,
 		http.FileServer(http.Dir("static")))
 
-	s.recorder, err = recorder.New()
-	if err != nil {
-		return err
-	}
-
-	if err := s.recorder.Start(); err != nil {
-		fmt.Println("Unable to start recorder:", err)
-		fmt.Println("Using mock recorder")
-		s.recorder = recorder.NewMock()
-		if err := s.recorder.Start(); err != nil {
-			return err
+	if s.config.Announce {
+		if err := s.announce(addr); err != nil {
+			fmt.Println("Unable to announce server:", err)
 		}
 	}
 
-	s.recorder.AddSubscriber(s.storage)
-
 	println("Starting server at address", addr)
 	if len(s.publicKeyPath) != 0 && len(s.privateKeyPath) != 0 {
 		return http.ListenAndServeTLS(addr, s.publicKeyPath, s.privateKeyPath, s)
@@ -111,40 +127,103 @@ func (s *serverImpl) Start(addr string) error {
 }
 
 func (s *serverImpl) Stop() error {
-	if err := s.recorder.Stop(); err != nil {
-		return err
+	if s.rtsp != nil {
+		s.rtsp.Stop()
+	}
+
+	for _, c := range s.cameras {
+		if err := c.stop(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// startRTSP serves each camera's frames over RTSP at /cameras/<camera>/live,
+// and the default camera's at /live.
+func (s *serverImpl) startRTSP() error {
+	var err error
+	s.rtsp, err = rtsp.New(s.config.RTSP)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range s.cameras {
+		stream := rtsp.NewStream()
+		c.recorder.AddSubscriber(stream)
+		s.rtsp.Handle(camerasPrefix+c.name+"/live", stream)
+		if i == 0 {
+			s.rtsp.Handle("/live", stream)
+		}
+	}
+
+	fmt.Println("Starting RTSP server at address", s.config.RTSP.Address)
+	return s.rtsp.Start()
+}
+
 func (s *serverImpl) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	u := req.URL.String()
-	if strings.HasPrefix(u, segmentsPrefix) {
-		s.segmentsFileServer.ServeHTTP(w, req)
-	} else if u == "/live.m3u" {
-		s.serveLivePlaylist(w, false)
-	} else if u == "/live.txt" {
-		s.serveLivePlaylist(w, true)
-	} else {
+	if strings.HasPrefix(req.URL.Path, apiPrefix) {
+		s.serveAPI(w, req)
+	} else if strings.HasPrefix(req.URL.Path, camerasPrefix) {
+		s.serveCamera(w, req)
+	} else if strings.HasPrefix(req.URL.Path, ingestPrefix) {
+		s.ingest.serve(w, req)
+	} else if !s.cameras[0].serve(w, req, strings.TrimPrefix(req.URL.Path, "/")) {
 		s.staticFileServer.ServeHTTP(w, req)
 	}
 }
 
-func (s *serverImpl) serveLivePlaylist(w http.ResponseWriter, txt bool) {
-	// Get enough segments to fill 10 seconds.
-	numSegments := int((10 * time.Second) / s.recorder.SegmentDuration())
-	if numSegments < 3 {
-		numSegments = 3
+// announce starts broadcasting the server's host name and port to
+// aggregators.
+func (s *serverImpl) announce(addr string) error {
+	if len(s.config.AnnounceKey) == 0 {
+		return errors.New("announce requires an announceKey")
+	}
+
+	_, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+
+	name, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	go aggregator.Announce(name, port, s.config.HTTPS, s.config.AnnounceKey)
+	return nil
+}
+
+// serveCamera serves a request for /cameras/{name}/...
+func (s *serverImpl) serveCamera(w http.ResponseWriter, req *http.Request) {
+	p := strings.TrimPrefix(req.URL.Path, camerasPrefix)
+	name, rest := p, ""
+	if i := strings.Index(p, "/"); i >= 0 {
+		name, rest = p[:i], p[i+1:]
+	}
+
+	c, ok := s.camerasByName[name]
+	if !ok || !c.serve(w, req, rest) {
+		http.NotFound(w, req)
 	}
+}
 
-	segments := s.storage.LatestSegments(numSegments)
+func writePlaylist(w http.ResponseWriter, segments []storage.Segment, annotations []storage.Annotation, txt, vod bool) {
 	targetDuration := time.Duration(0)
 	firstSegmentID := storage.SegmentID(0)
+	fmp4 := false
 	for _, segment := range segments {
 		if segment.Duration > targetDuration {
 			targetDuration = segment.Duration
 		}
+		if len(segment.Init) != 0 {
+			fmp4 = true
+		}
 
 		if firstSegmentID == 0 {
 			firstSegmentID = segment.ID
@@ -158,21 +237,80 @@ func (s *serverImpl) serveLivePlaylist(w http.ResponseWriter, txt bool) {
 	}
 	
 	io.WriteString(w, "#EXTM3U\n")
+	if fmp4 {
+		// Fragmented MP4 segments need a newer protocol version than
+		// MPEG-TS segments.
+		io.WriteString(w, "#EXT-X-VERSION:7\n")
+	}
 	targetDurationInt := int(targetDuration / time.Second)
 	io.WriteString(w, fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", targetDurationInt))
 	io.WriteString(w, fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", firstSegmentID))
+	if vod {
+		io.WriteString(w, "#EXT-X-PLAYLIST-TYPE:VOD\n")
+	}
+
+	for _, annotation := range annotations {
+		writeDateRange(w, annotation)
+	}
 
 	prevSegmentID := firstSegmentID - 1
+	currentInit := ""
 	for _, segment := range segments {
 		// Indicate if there is a gap in segments.
-		if segment.ID != prevSegmentID + 1 {
+		if segment.ID != prevSegmentID + 1 || segment.Discontinuity {
 			io.WriteString(w, "#EXT-X-DISCONTINUITY\n")
 		}
 
+		// Fragmented MP4 segments need their initialization segment,
+		// which changes along with the recorder settings.
+		if len(segment.Init) != 0 && segment.Init != currentInit {
+			io.WriteString(w, fmt.Sprintf("#EXT-X-MAP:URI=\"segments/%s\"\n", segment.Init))
+			currentInit = segment.Init
+		}
+
+		// Date ranges require the segments' dates to be known.
+		if len(annotations) != 0 {
+			io.WriteString(w, fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", formatPlaylistDate(segment.Time)))
+		}
+
 		duration := float64(segment.Duration) / float64(time.Second)
 		io.WriteString(w, fmt.Sprintf("#EXTINF:%f,\n", duration))
 		io.WriteString(w, fmt.Sprintf("segments/%s\n", segment.Name))
 
 		prevSegmentID = segment.ID
 	}
-}
\ No newline at end of file
+
+	if vod {
+		io.WriteString(w, "#EXT-X-ENDLIST\n")
+	}
+}
+
+func formatPlaylistDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// playlistString makes a string safe to use as a quoted attribute value.
+func playlistString(s string) string {
+	return strings.NewReplacer("\"", "'", "\n", " ", "\r", " ").Replace(s)
+}
+
+// writeDateRange writes an annotation as an EXT-X-DATERANGE tag.
+func writeDateRange(w io.Writer, annotation storage.Annotation) {
+	tag := fmt.Sprintf("#EXT-X-DATERANGE:ID=\"annotation-%d\",CLASS=\"com.github.joshb.pi-camera-go.annotation\",START-DATE=\"%s\"",
+		annotation.ID, formatPlaylistDate(annotation.Start))
+	if annotation.End != nil {
+		tag += fmt.Sprintf(",END-DATE=\"%s\"", formatPlaylistDate(*annotation.End))
+	}
+	tag += fmt.Sprintf(",X-LABEL=\"%s\"", playlistString(annotation.Label))
+	if len(annotation.Text) != 0 {
+		tag += fmt.Sprintf(",X-TEXT=\"%s\"", playlistString(annotation.Text))
+	}
+	if len(annotation.Author) != 0 {
+		tag += fmt.Sprintf(",X-AUTHOR=\"%s\"", playlistString(annotation.Author))
+	}
+	if len(annotation.Tags) != 0 {
+		tag += fmt.Sprintf(",X-TAGS=\"%s\"", playlistString(strings.Join(annotation.Tags, ",")))
+	}
+
+	io.WriteString(w, tag+"\n")
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var annotationsBucket = []byte("annotations")
+
+// ErrAnnotationNotFound is returned for annotation IDs that do not exist.
+var ErrAnnotationNotFound = errors.New("annotation not found")
+
+type AnnotationID uint64
+
+// Annotation marks a point in time, or a range if End is set, on the
+// recording timeline.
+type Annotation struct {
+	ID      AnnotationID `json:"id"`
+	Start   time.Time    `json:"start"`
+	End     *time.Time   `json:"end,omitempty"`
+	Label   string       `json:"label"`
+	Text    string       `json:"text,omitempty"`
+	Author  string       `json:"author,omitempty"`
+	Tags    []string     `json:"tags,omitempty"`
+	Created time.Time    `json:"created"`
+}
+
+// EndTime returns the end of the annotation, which is its start for an
+// annotation that marks a single point in time.
+func (a Annotation) EndTime() time.Time {
+	if a.End == nil {
+		return a.Start
+	}
+
+	return *a.End
+}
+
+// Validate checks that the annotation has a label and a valid time range.
+func (a Annotation) Validate() error {
+	if len(strings.TrimSpace(a.Label)) == 0 {
+		return errors.New("annotation requires a label")
+	}
+	if a.Start.IsZero() {
+		return errors.New("annotation requires a start time")
+	}
+	if a.End != nil && a.End.Before(a.Start) {
+		return errors.New("annotation ends before it starts")
+	}
+
+	return nil
+}
+
+// AnnotationQuery selects annotations. Empty fields match everything.
+type AnnotationQuery struct {
+	// Annotations overlapping the range from Start to End match.
+	Start time.Time
+	End   time.Time
+
+	// Text matches the label or text, ignoring case.
+	Text   string
+	Author string
+	Tag    string
+}
+
+func (q AnnotationQuery) matches(a Annotation) bool {
+	if !q.Start.IsZero() && a.EndTime().Before(q.Start) {
+		return false
+	}
+	if !q.End.IsZero() && a.Start.After(q.End) {
+		return false
+	}
+	if len(q.Text) != 0 {
+		text := strings.ToLower(q.Text)
+		if !strings.Contains(strings.ToLower(a.Label), text) &&
+			!strings.Contains(strings.ToLower(a.Text), text) {
+			return false
+		}
+	}
+	if len(q.Author) != 0 && a.Author != q.Author {
+		return false
+	}
+	if len(q.Tag) != 0 {
+		found := false
+		for _, tag := range a.Tags {
+			if tag == q.Tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// annotationStore keeps annotations in their own bucket of the segment
+// index database, with a copy in memory for searching.
+type annotationStore struct {
+	db          *bolt.DB
+	annotations map[AnnotationID]Annotation
+	mutex       *sync.Mutex
+}
+
+// annotationsFile is the form in which annotations are exported.
+type annotationsFile struct {
+	Annotations []Annotation `json:"annotations"`
+}
+
+func annotationKey(id AnnotationID) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func newAnnotationStore(index *segmentIndex) (*annotationStore, error) {
+	store := &annotationStore{
+		db:          index.db,
+		annotations: make(map[AnnotationID]Annotation),
+		mutex:       &sync.Mutex{},
+	}
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(annotationsBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(key, value []byte) error {
+			var annotation Annotation
+			if err := json.Unmarshal(value, &annotation); err != nil {
+				return err
+			}
+			store.annotations[annotation.ID] = annotation
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// put stores an annotation, first assigning it the next ID from the
+// bucket's sequence if assignID is set. Sequence numbers are never reused,
+// even after the annotation with the highest ID is deleted.
+func (store *annotationStore) put(annotation Annotation, assignID bool) (Annotation, error) {
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(annotationsBucket)
+		if assignID {
+			id, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			annotation.ID = AnnotationID(id)
+		}
+
+		value, err := json.Marshal(&annotation)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(annotationKey(annotation.ID), value)
+	})
+	if err != nil {
+		return Annotation{}, err
+	}
+
+	return annotation, nil
+}
+
+func (store *annotationStore) remove(id AnnotationID) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(annotationsBucket).Delete(annotationKey(id))
+	})
+}
+
+// sorted returns the annotations matching a query, ordered by start time.
+// The caller must hold the mutex.
+func (store *annotationStore) sorted(query AnnotationQuery) []Annotation {
+	annotations := make([]Annotation, 0)
+	for _, annotation := range store.annotations {
+		if query.matches(annotation) {
+			annotations = append(annotations, annotation)
+		}
+	}
+	sort.Slice(annotations, func(i, j int) bool {
+		if annotations[i].Start.Equal(annotations[j].Start) {
+			return annotations[i].ID < annotations[j].ID
+		}
+		return annotations[i].Start.Before(annotations[j].Start)
+	})
+
+	return annotations
+}
+
+func (s *storageImpl) AddAnnotation(annotation Annotation) (Annotation, error) {
+	if err := annotation.Validate(); err != nil {
+		return Annotation{}, err
+	}
+
+	store := s.annotations
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	annotation.Created = time.Now()
+	annotation, err := store.put(annotation, true)
+	if err != nil {
+		return Annotation{}, err
+	}
+	store.annotations[annotation.ID] = annotation
+
+	return annotation, nil
+}
+
+func (s *storageImpl) UpdateAnnotation(annotation Annotation) (Annotation, error) {
+	if err := annotation.Validate(); err != nil {
+		return Annotation{}, err
+	}
+
+	store := s.annotations
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	previous, ok := store.annotations[annotation.ID]
+	if !ok {
+		return Annotation{}, ErrAnnotationNotFound
+	}
+
+	annotation.Created = previous.Created
+	annotation, err := store.put(annotation, false)
+	if err != nil {
+		return Annotation{}, err
+	}
+	store.annotations[annotation.ID] = annotation
+
+	return annotation, nil
+}
+
+func (s *storageImpl) DeleteAnnotation(id AnnotationID) error {
+	store := s.annotations
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.annotations[id]; !ok {
+		return ErrAnnotationNotFound
+	}
+
+	if err := store.remove(id); err != nil {
+		return err
+	}
+	delete(store.annotations, id)
+
+	return nil
+}
+
+func (s *storageImpl) Annotation(id AnnotationID) (Annotation, error) {
+	store := s.annotations
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	annotation, ok := store.annotations[id]
+	if !ok {
+		return Annotation{}, ErrAnnotationNotFound
+	}
+
+	return annotation, nil
+}
+
+func (s *storageImpl) SearchAnnotations(query AnnotationQuery) []Annotation {
+	store := s.annotations
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.sorted(query)
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnotations(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStorage(t, Config{}, dir)
+
+	start := time.Unix(1500000000, 0).UTC()
+	end := start.Add(time.Minute)
+	point, err := s.AddAnnotation(Annotation{Start: start, Label: "Delivery", Author: "alice", Tags: []string{"door"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddAnnotation(Annotation{Start: start.Add(time.Hour), End: &end, Label: "Backwards"}); err == nil {
+		t.Error("added an annotation that ends before it starts")
+	}
+	rangeEnd := start.Add(2 * time.Hour)
+	ranged, err := s.AddAnnotation(Annotation{Start: start.Add(time.Hour), End: &rangeEnd, Label: "Car parked", Text: "Blue van"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddAnnotation(Annotation{Start: start}); err == nil {
+		t.Error("added an annotation without a label")
+	}
+	if point.ID == 0 || ranged.ID <= point.ID || point.Created.IsZero() {
+		t.Errorf("got annotations %+v and %+v", point, ranged)
+	}
+
+	// A point in time has no end in its JSON form.
+	b, err := json.Marshal(&point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"end"`) {
+		t.Errorf("point annotation has an end: %s", b)
+	}
+
+	for _, test := range []struct {
+		query AnnotationQuery
+		want  []AnnotationID
+	}{
+		{AnnotationQuery{}, []AnnotationID{point.ID, ranged.ID}},
+		{AnnotationQuery{Text: "van"}, []AnnotationID{ranged.ID}},
+		{AnnotationQuery{Author: "alice"}, []AnnotationID{point.ID}},
+		{AnnotationQuery{Tag: "door"}, []AnnotationID{point.ID}},
+		{AnnotationQuery{Start: start.Add(90 * time.Minute), End: start.Add(3 * time.Hour)}, []AnnotationID{ranged.ID}},
+		{AnnotationQuery{Start: start.Add(3 * time.Hour)}, nil},
+	} {
+		var got []AnnotationID
+		for _, annotation := range s.SearchAnnotations(test.query) {
+			got = append(got, annotation.ID)
+		}
+		if len(got) != len(test.want) || (len(got) != 0 && (got[0] != test.want[0] || got[len(got)-1] != test.want[len(test.want)-1])) {
+			t.Errorf("query %+v matched %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	point.Label = "Parcel"
+	updated, err := s.UpdateAnnotation(point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Label != "Parcel" || !updated.Created.Equal(point.Created) {
+		t.Errorf("got updated annotation %+v", updated)
+	}
+	if _, err := s.UpdateAnnotation(Annotation{ID: 100, Start: start, Label: "Missing"}); err != ErrAnnotationNotFound {
+		t.Errorf("updating a missing annotation returned %v", err)
+	}
+
+	// Annotations are kept in the index across restarts, and the ID of a
+	// deleted annotation is never reused.
+	if err := s.DeleteAnnotation(ranged.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteAnnotation(ranged.ID); err != ErrAnnotationNotFound {
+		t.Errorf("deleting a deleted annotation returned %v", err)
+	}
+	s.index.close()
+	s = newTestStorage(t, Config{}, dir)
+
+	got, err := s.Annotation(point.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Label != "Parcel" || got.End != nil || !got.Start.Equal(start) {
+		t.Errorf("got annotation %+v after reopening", got)
+	}
+	if _, err := s.Annotation(ranged.ID); err != ErrAnnotationNotFound {
+		t.Errorf("deleted annotation was found after reopening: %v", err)
+	}
+
+	added, err := s.AddAnnotation(Annotation{Start: start, Label: "Later"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.ID <= ranged.ID {
+		t.Errorf("new annotation reused ID %d", added.ID)
+	}
+}
+
+func TestAnnotationsSurviveIndexRebuild(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStorage(t, Config{}, dir)
+	addTestSegment(t, s, time.Unix(1500000000, 0), 1)
+	annotation, err := s.AddAnnotation(Annotation{Start: time.Unix(1500000000, 0), Label: "Delivery"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuilding the segments of the index leaves annotations alone.
+	if err := s.index.replace(s.segments); err != nil {
+		t.Fatal(err)
+	}
+	s.index.close()
+	s = newTestStorage(t, Config{}, dir)
+	if _, err := s.Annotation(annotation.ID); err != nil {
+		t.Errorf("annotation was lost: %v", err)
+	}
+}
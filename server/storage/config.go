@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"path"
+)
+
+// Config selects and configures the driver used to store segments.
+type Config struct {
+	// Driver is either "local" (the default) or "s3".
+	Driver string   `json:"driver"`
+	S3     S3Config `json:"s3"`
+
+	// MaxSize is the maximum size of the local tier in bytes, and MaxAge
+	// is the age in seconds after which segments are removed. Either may
+	// be zero for no limit. Pinned segments are never removed.
+	MaxSize int64 `json:"maxSize"`
+	MaxAge  int   `json:"maxAge"`
+
+	// Archive configures an optional second tier that older segments
+	// are moved to.
+	Archive ArchiveConfig `json:"archive"`
+
+	// Transcode configures re-encoding of older segments at a lower
+	// resolution or bit rate.
+	Transcode TranscodeConfig `json:"transcode"`
+
+	// Evidence enables the tamper-evident hash chain and signed
+	// manifests.
+	Evidence EvidenceConfig `json:"evidence"`
+}
+
+// ArchiveConfig configures the archive tier. The archive tier is disabled
+// if Driver is empty.
+type ArchiveConfig struct {
+	// Driver is either "local" or "s3". The local driver stores segments
+	// in Dir, which would usually be a USB disk or NAS mount.
+	Driver string   `json:"driver"`
+	Dir    string   `json:"dir"`
+	S3     S3Config `json:"s3"`
+
+	// Segments older than After (in seconds) are moved to the archive.
+	// Segments are also moved early if the local tier exceeds its MaxSize,
+	// and are removed from it instead if they cannot be archived.
+	After int `json:"after"`
+
+	// MaxSize is the maximum size of the archive in bytes, or zero for no
+	// limit. The oldest archived segments are removed when it is exceeded.
+	MaxSize int64 `json:"maxSize"`
+}
+
+// S3Config configures the S3-compatible object store driver.
+type S3Config struct {
+	// Endpoint is the base URL of the object store, e.g.
+	// "http://localhost:9000" for a local MinIO instance.
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+
+	// If Redirect is true, segment requests are answered with a redirect
+	// to a presigned URL instead of being proxied through the server.
+	Redirect      bool `json:"redirect"`
+	PresignExpiry int  `json:"presignExpiry"` // seconds
+}
+
+// TranscodeConfig configures the background transcoding job. The job is
+// disabled if After is zero.
+type TranscodeConfig struct {
+	// Segments older than After (in seconds) are re-encoded.
+	After int `json:"after"`
+
+	// Width and Height give the new resolution. If either is zero, the
+	// resolution is left unchanged.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// BitRate is the new bit rate in bits per second.
+	BitRate int `json:"bitRate"`
+
+	// Threads limits the number of threads used by ffmpeg (default 1).
+	Threads int `json:"threads"`
+
+	// MaxLoad is the one-minute load average above which no transcoding
+	// is started (default 0.5 per CPU).
+	MaxLoad float64 `json:"maxLoad"`
+}
+
+// EvidenceConfig configures the evidence mode. In evidence mode, every
+// segment records the hash of the segment before it, manifests of new
+// segments are signed with the server's key, and segments are never
+// transcoded.
+type EvidenceConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// ManifestPeriod is the number of seconds between signed manifests
+	// (default 300).
+	ManifestPeriod int `json:"manifestPeriod"`
+}
+
+// withPrefix returns the configuration with the namespace appended to the
+// key prefix.
+func (c S3Config) withPrefix(namespace string) S3Config {
+	c.Prefix = path.Join(c.Prefix, namespace)
+	return c
+}
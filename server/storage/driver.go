@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"io"
+	"net/http"
+)
+
+// FileInfo describes a file stored by a Driver.
+type FileInfo struct {
+	Name string
+	Size int64
+}
+
+// Driver stores segment files for a Storage. Names are plain file names
+// without any directory components.
+type Driver interface {
+	// Put stores size bytes read from r under the given name. The file
+	// must not become visible under its final name until it is complete.
+	Put(name string, r io.Reader, size int64) error
+
+	// Open returns a reader for the named file.
+	Open(name string) (io.ReadCloser, error)
+
+	// Remove deletes the named file. Removing a file that does not exist
+	// is not an error.
+	Remove(name string) error
+
+	// List returns all files stored by the driver.
+	List() ([]FileInfo, error)
+
+	// ServeFile responds to an HTTP request for the named file.
+	ServeFile(w http.ResponseWriter, req *http.Request, name string)
+}
+
+// recoverer is implemented by drivers that can leave incomplete, corrupt
+// or unindexed files behind after a crash. recover is given the indexed
+// segments stored by the driver, and those of other tiers, and returns the
+// driver's segments that should stay in the index.
+type recoverer interface {
+	recover(segments, others map[SegmentID]Segment) (map[SegmentID]Segment, error)
+}
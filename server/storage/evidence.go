@@ -0,0 +1,496 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"archive/tar"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/util"
+)
+
+const (
+	manifestDirName       = "manifests"
+	certificateFileName   = "certificate.pem"
+	defaultManifestPeriod = 5 * time.Minute
+)
+
+// Manifest lists a run of consecutive segments and their hashes. Manifests
+// are signed with the server's private key, and each one includes the
+// hash of the previous signed manifest.
+type Manifest struct {
+	Created      time.Time `json:"created"`
+	FirstID      SegmentID `json:"firstId"`
+	LastID       SegmentID `json:"lastId"`
+	PrevManifest string    `json:"prevManifest,omitempty"`
+	Segments     []Segment `json:"segments"`
+}
+
+// SignedManifest is the form in which manifests are stored. The signature
+// is an RSA PKCS #1 v1.5 signature of the SHA-256 hash of the raw
+// manifest bytes.
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+}
+
+// manifestSigner periodically writes signed manifests of new segments.
+type manifestSigner struct {
+	dir         string
+	period      time.Duration
+	key         *rsa.PrivateKey
+	certificate []byte
+	lastID      SegmentID
+	lastHash    string
+	lastTime    time.Time
+}
+
+func newManifestSigner(segmentDir string, config EvidenceConfig) (*manifestSigner, error) {
+	dir := path.Join(segmentDir, manifestDirName)
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	key, _, err := util.LoadKeys()
+	if err != nil {
+		return nil, err
+	}
+	_, publicKeyPath, err := util.KeyPaths()
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	period := time.Duration(config.ManifestPeriod) * time.Second
+	if period <= 0 {
+		period = defaultManifestPeriod
+	}
+
+	signer := &manifestSigner{
+		dir:         dir,
+		period:      period,
+		key:         key,
+		certificate: certificate,
+		lastTime:    time.Now(),
+	}
+
+	// Continue the manifest chain from the most recent manifest.
+	names, err := signer.manifestNames()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) != 0 {
+		b, err := ioutil.ReadFile(path.Join(dir, names[len(names)-1]))
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := readSignedManifest(b, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		signer.lastID = manifest.LastID
+		signer.lastHash = sha256Hex(b)
+	}
+
+	return signer, nil
+}
+
+// manifestNames returns the names of all stored manifests in the order in
+// which they were written.
+func (m *manifestSigner) manifestNames() ([]string, error) {
+	files, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, fileInfo := range files {
+		if strings.HasPrefix(fileInfo.Name(), "manifest_") && strings.HasSuffix(fileInfo.Name(), ".json") {
+			names = append(names, fileInfo.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// due reports whether a new manifest should be written.
+func (m *manifestSigner) due(now time.Time) bool {
+	return now.Sub(m.lastTime) >= m.period
+}
+
+// write signs and stores a manifest of the given segments, which must all
+// have IDs greater than the last manifest's.
+func (m *manifestSigner) write(segments []Segment, now time.Time) error {
+	m.lastTime = now
+	if len(segments) == 0 {
+		return nil
+	}
+
+	manifest := Manifest{
+		Created:      now,
+		FirstID:      segments[0].ID,
+		LastID:       segments[len(segments)-1].ID,
+		PrevManifest: m.lastHash,
+		Segments:     segments,
+	}
+	raw, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(raw)
+	signature, err := rsa.SignPKCS1v15(nil, m.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+
+	// The envelope must not be indented, since that would change the
+	// signed manifest bytes.
+	b, err := json.Marshal(&SignedManifest{
+		Manifest:  raw,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Zero-padded IDs keep the file names in the order they were written.
+	name := fmt.Sprintf("manifest_%020d_%020d.json", manifest.FirstID, manifest.LastID)
+	if err := util.WriteFileAtomic(path.Join(m.dir, name), b); err != nil {
+		return err
+	}
+
+	m.lastID = manifest.LastID
+	m.lastHash = sha256Hex(b)
+	return nil
+}
+
+// readSignedManifest parses a stored manifest. If certificate is not nil,
+// the manifest's signature is checked against it.
+func readSignedManifest(b []byte, certificate *x509.Certificate) (Manifest, error) {
+	var signed SignedManifest
+	if err := json.Unmarshal(b, &signed); err != nil {
+		return Manifest{}, err
+	}
+
+	if certificate != nil {
+		publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return Manifest{}, errors.New("certificate does not contain an RSA key")
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+		if err != nil {
+			return Manifest{}, err
+		}
+
+		hash := sha256.Sum256(signed.Manifest)
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature); err != nil {
+			return Manifest{}, errors.New("invalid manifest signature")
+		}
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(signed.Manifest, &manifest); err != nil {
+		return Manifest{}, err
+	}
+
+	return manifest, nil
+}
+
+// signManifestIfDue writes a manifest of all segments added since the last
+// one if the manifest period has passed. The caller must hold the mutex.
+func (s *storageImpl) signManifestIfDue(now time.Time) error {
+	if s.signer == nil || !s.signer.due(now) {
+		return nil
+	}
+
+	return s.signManifest(now)
+}
+
+// signManifest writes a manifest of all segments added since the last one.
+// The caller must hold the mutex.
+func (s *storageImpl) signManifest(now time.Time) error {
+	segments := make([]Segment, 0)
+	for _, segment := range s.segments {
+		if segment.ID > s.signer.lastID {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].ID < segments[j].ID
+	})
+
+	return s.signer.write(segments, now)
+}
+
+// linkRecoveredSegments fills in the previous segment's checksum for
+// segments that were indexed by recovery rather than by addSegment, so
+// that they continue the hash chain. indexed holds the IDs of the
+// segments that were already in the index.
+func linkRecoveredSegments(segments map[SegmentID]Segment, indexed map[SegmentID]bool) {
+	segmentIDs := make([]SegmentID, 0, len(segments))
+	for segmentID := range segments {
+		segmentIDs = append(segmentIDs, segmentID)
+	}
+	sort.Slice(segmentIDs, func(i, j int) bool {
+		return segmentIDs[i] < segmentIDs[j]
+	})
+
+	for i, segmentID := range segmentIDs {
+		segment := segments[segmentID]
+		if i == 0 || indexed[segmentID] || len(segment.PrevChecksum) != 0 {
+			continue
+		}
+
+		segment.PrevChecksum = segments[segmentIDs[i-1]].Checksum
+		segments[segmentID] = segment
+	}
+}
+
+// exportManifests adds the manifests covering the given segments to an
+// export, together with the certificate needed to check them.
+func (s *storageImpl) exportManifests(tw *tar.Writer, segments []Segment) error {
+	if s.signer == nil || len(segments) == 0 {
+		return nil
+	}
+
+	first, last := segments[0].ID, segments[len(segments)-1].ID
+	names, err := s.signer.manifestNames()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var firstID, lastID SegmentID
+		if _, err := fmt.Sscanf(name, "manifest_%d_%d.json", &firstID, &lastID); err != nil {
+			continue
+		}
+		if lastID < first || firstID > last {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(path.Join(s.signer.dir, name))
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, manifestDirName+"/"+name, b); err != nil {
+			return err
+		}
+	}
+
+	return writeTarFile(tw, certificateFileName, s.signer.certificate)
+}
+
+func writeTarFile(tw *tar.Writer, name string, b []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(b)
+	return err
+}
+
+// ExportReport is the result of verifying an export.
+type ExportReport struct {
+	Segments int      `json:"segments"`
+	Signed   int      `json:"signed"`
+	Problems []string `json:"problems"`
+	Warnings []string `json:"warnings"`
+}
+
+// OK reports whether no problems were found.
+func (r *ExportReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *ExportReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *ExportReport) warning(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// VerifyExport checks an export written by Export: the segment files
+// against the manifest, the export hash chain, the links between
+// consecutive segments, and the signed manifests and the links between
+// them. Every segment of an evidence export must be covered by a signed
+// manifest. If certificate is nil, the certificate included in the export
+// is used, which only shows that the export is consistent, not who
+// created it.
+func VerifyExport(r io.Reader, certificate *x509.Certificate) (*ExportReport, error) {
+	checksums := make(map[string]string)
+	manifests := make(map[string][]byte)
+	var exportManifest []byte
+	var includedCertificate []byte
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case header.Name == manifestFileName:
+			exportManifest, err = ioutil.ReadAll(tr)
+		case header.Name == certificateFileName:
+			includedCertificate, err = ioutil.ReadAll(tr)
+		case strings.HasPrefix(header.Name, manifestDirName+"/"):
+			manifests[header.Name], err = ioutil.ReadAll(tr)
+		default:
+			hash := sha256.New()
+			_, err = io.Copy(hash, tr)
+			checksums[header.Name] = hex.EncodeToString(hash.Sum(nil))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if exportManifest == nil {
+		return nil, errors.New("export does not contain a manifest")
+	}
+	var manifest ExportManifest
+	if err := json.Unmarshal(exportManifest, &manifest); err != nil {
+		return nil, err
+	}
+
+	report := &ExportReport{Segments: len(manifest.Segments)}
+
+	// Check each segment file and the export hash chain.
+	chain := ""
+	for i, entry := range manifest.Segments {
+		checksum, ok := checksums[entry.Name]
+		if !ok {
+			report.problem("segment %s is missing", entry.Name)
+		} else if checksum != entry.Checksum {
+			report.problem("segment %s does not match its checksum", entry.Name)
+		}
+
+		var err error
+		chain, err = chainHash(chain, entry.Checksum)
+		if err != nil || chain != entry.Chain {
+			report.problem("hash chain is broken at segment %s", entry.Name)
+			chain = entry.Chain
+		}
+
+		// Check the link recorded when the segment was stored.
+		if i > 0 {
+			prev := manifest.Segments[i-1]
+			if entry.ID != prev.ID+1 {
+				report.warning("segments %d to %d are not in the export", prev.ID+1, entry.ID-1)
+			} else if len(entry.PrevChecksum) != 0 && entry.PrevChecksum != prev.Checksum {
+				report.problem("segment %s does not link to segment %s", entry.Name, prev.Name)
+			}
+		}
+	}
+
+	// Check the signed manifests.
+	if certificate == nil && len(manifests) != 0 {
+		if includedCertificate == nil {
+			return nil, errors.New("export does not contain a certificate")
+		}
+
+		var err error
+		certificate, err = util.ParseCertificate(includedCertificate)
+		if err != nil {
+			return nil, err
+		}
+		report.warning("using the certificate included in the export")
+	}
+
+	// Manifest names sort in the order in which the manifests were
+	// written, and each manifest includes the hash of the one before it.
+	names := make([]string, 0, len(manifests))
+	for name := range manifests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	signed := make(map[SegmentID]string)
+	for i, name := range names {
+		m, err := readSignedManifest(manifests[name], certificate)
+		if err != nil {
+			report.problem("manifest %s: %s", name, err)
+			continue
+		}
+
+		if i > 0 && m.PrevManifest != sha256Hex(manifests[names[i-1]]) {
+			report.problem("manifest %s does not link to manifest %s", name, names[i-1])
+		}
+		for _, segment := range m.Segments {
+			signed[segment.ID] = segment.Checksum
+		}
+	}
+
+	// Exports of evidence mode footage must be signed throughout, so that
+	// removing the manifests does not leave an export that still passes.
+	evidence := manifest.Evidence || certificate != nil || includedCertificate != nil || len(manifests) != 0
+	for _, entry := range manifest.Segments {
+		checksum, ok := signed[entry.ID]
+		if !ok && evidence {
+			report.problem("segment %s is not covered by a signed manifest", entry.Name)
+		} else if !ok {
+			report.warning("segment %s is not covered by a signed manifest", entry.Name)
+		} else if checksum != entry.Checksum {
+			report.problem("segment %s does not match its signed manifest", entry.Name)
+		} else {
+			report.Signed++
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSigner returns a manifest signer for the segment directory dir
+// with a newly generated key, and the certificate for that key.
+func newTestSigner(t *testing.T, dir string) (*manifestSigner, *x509.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"pi-camera-go"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	b, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestDir := path.Join(dir, manifestDirName)
+	if err := os.MkdirAll(manifestDir, os.ModeDir|os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	return &manifestSigner{
+		dir:         manifestDir,
+		period:      time.Hour,
+		key:         key,
+		certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b}),
+		lastTime:    time.Now(),
+	}, certificate
+}
+
+// filterTar copies a tar archive, leaving out the entries for which skip
+// returns true.
+func filterTar(t *testing.T, b []byte, skip func(name string) bool) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(b))
+	tw := tar.NewWriter(&out)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if skip(header.Name) {
+			continue
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()
+}
+
+// hasProblem reports whether a report contains a problem mentioning text.
+func hasProblem(report *ExportReport, text string) bool {
+	for _, problem := range report.Problems {
+		if strings.Contains(problem, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVerifyExport(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStorage(t, Config{}, dir)
+	var certificate *x509.Certificate
+	s.signer, certificate = newTestSigner(t, dir)
+
+	// Sign a manifest after each segment, so that the export is covered
+	// by a chain of three manifests.
+	created := time.Unix(1500000000, 0)
+	for i := 0; i < 3; i++ {
+		addTestSegment(t, s, created.Add(time.Duration(i)*5*time.Second), byte(i+1))
+		s.mutex.Lock()
+		err := s.signManifest(time.Now())
+		s.mutex.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := s.signer.manifestNames()
+	if err != nil || len(names) != 3 {
+		t.Fatalf("got manifests %v, %v", names, err)
+	}
+
+	var export bytes.Buffer
+	if err := s.Export(&export, created, created.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifyExport(bytes.NewReader(export.Bytes()), certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Segments != 3 || report.Signed != 3 {
+		t.Errorf("got report %+v", report)
+	}
+
+	// An evidence export whose manifests have been removed must fail.
+	b := filterTar(t, export.Bytes(), func(name string) bool {
+		return strings.HasPrefix(name, manifestDirName+"/") || name == certificateFileName
+	})
+	report, err = VerifyExport(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || report.Signed != 0 || !hasProblem(report, "not covered by a signed manifest") {
+		t.Errorf("got report %+v without manifests", report)
+	}
+
+	// Removing a manifest from the middle of the chain breaks its links.
+	b = filterTar(t, export.Bytes(), func(name string) bool {
+		return name == manifestDirName+"/"+names[1]
+	})
+	report, err = VerifyExport(bytes.NewReader(b), certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || !hasProblem(report, "does not link to manifest") || !hasProblem(report, "not covered by a signed manifest") {
+		t.Errorf("got report %+v without the second manifest", report)
+	}
+}
+
+func TestLinkRecoveredSegments(t *testing.T) {
+	segments := map[SegmentID]Segment{
+		1: {ID: 1, Checksum: "a"},
+		2: {ID: 2, Checksum: "b", PrevChecksum: "a"},
+		4: {ID: 4, Checksum: "d"},
+		5: {ID: 5, Checksum: "e"},
+	}
+	linkRecoveredSegments(segments, map[SegmentID]bool{1: true, 2: true})
+
+	for segmentID, want := range map[SegmentID]string{1: "", 2: "a", 4: "b", 5: "d"} {
+		if got := segments[segmentID].PrevChecksum; got != want {
+			t.Errorf("segment %d links to %q, want %q", segmentID, got, want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	manifestFileName          = "manifest.json"
+	exportAnnotationsFileName = "annotations.json"
+)
+
+// ExportManifest lists the segments in an export. Chain links the segments
+// together: the chain hash of each entry is the SHA-256 hash of the
+// previous entry's chain hash followed by the entry's own checksum, so
+// removing, reordering or altering any segment breaks every later link.
+type ExportManifest struct {
+	Created  time.Time     `json:"created"`
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Evidence bool          `json:"evidence,omitempty"`
+	Segments []ExportEntry `json:"segments"`
+}
+
+// ExportEntry describes a single exported segment.
+type ExportEntry struct {
+	Segment
+	Chain string `json:"chain"`
+}
+
+// chainHash returns the next link of an export hash chain.
+func chainHash(prevChain, checksum string) (string, error) {
+	prev, err := hex.DecodeString(prevChain)
+	if err != nil {
+		return "", err
+	}
+	sum, err := hex.DecodeString(checksum)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write(prev)
+	hash.Write(sum)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *storageImpl) Export(w io.Writer, start, end time.Time) error {
+	// Keep background jobs from replacing or moving segment files while
+	// they are being exported.
+	s.jobMutex.Lock()
+	defer s.jobMutex.Unlock()
+
+	// Make sure that every exported segment is covered by a signed
+	// manifest.
+	if s.signer != nil {
+		s.mutex.Lock()
+		err := s.signManifest(time.Now())
+		s.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	segments := s.SegmentsInRange(start, end)
+	if len(segments) == 0 {
+		return errors.New("no segments in range")
+	}
+
+	manifest := ExportManifest{
+		Created:  time.Now(),
+		Start:    start,
+		End:      end,
+		Evidence: s.signer != nil,
+		Segments: make([]ExportEntry, 0, len(segments)),
+	}
+
+	tw := tar.NewWriter(w)
+	chain := ""
+	for _, segment := range segments {
+		// Hash each segment as it is written so that the manifest
+		// describes exactly what was exported.
+		file, err := s.driverFor(segment).Open(segment.Name)
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.New()
+		err = tw.WriteHeader(&tar.Header{
+			Name:    segment.Name,
+			Mode:    0644,
+			Size:    segment.Size,
+			ModTime: segment.Time,
+		})
+		if err == nil {
+			_, err = io.Copy(tw, io.TeeReader(file, hash))
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		checksum := hex.EncodeToString(hash.Sum(nil))
+		if len(segment.Checksum) != 0 && checksum != segment.Checksum {
+			return fmt.Errorf("segment %d does not match its checksum", segment.ID)
+		}
+		segment.Checksum = checksum
+
+		chain, err = chainHash(chain, checksum)
+		if err != nil {
+			return err
+		}
+		manifest.Segments = append(manifest.Segments, ExportEntry{
+			Segment: segment,
+			Chain:   chain,
+		})
+	}
+
+	b, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, manifestFileName, b); err != nil {
+		return err
+	}
+
+	if err := s.exportInits(tw, segments); err != nil {
+		return err
+	}
+
+	annotations := s.SearchAnnotations(AnnotationQuery{Start: start, End: end})
+	b, err = json.MarshalIndent(&annotationsFile{Annotations: annotations}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, exportAnnotationsFileName, b); err != nil {
+		return err
+	}
+
+	if err := s.exportManifests(tw, segments); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// exportInits adds the initialization segments of any fragmented MP4
+// segments to an export, so that the segments can be played.
+func (s *storageImpl) exportInits(tw *tar.Writer, segments []Segment) error {
+	exported := make(map[string]bool)
+	for _, segment := range segments {
+		if len(segment.Init) == 0 || exported[segment.Init] {
+			continue
+		}
+
+		file, err := s.driver.Open(segment.Init)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, segment.Init, b); err != nil {
+			return err
+		}
+		exported[segment.Init] = true
+	}
+
+	return nil
+}
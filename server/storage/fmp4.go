@@ -0,0 +1,280 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	initPrefix    = "init_"
+	initExtension = ".mp4"
+)
+
+// mp4Box is a top-level box in an MP4 file.
+type mp4Box struct {
+	boxType string
+	offset  int64
+	size    int64
+}
+
+// readBoxes returns the top-level boxes of an MP4 file of the given size.
+func readBoxes(r io.ReaderAt, size int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for offset := int64(0); offset < size; {
+		header := make([]byte, 16)
+		n, err := r.ReadAt(header, offset)
+		if n < 8 {
+			if err == nil || err == io.EOF {
+				err = errors.New("truncated box header")
+			}
+			return nil, err
+		}
+
+		box := mp4Box{boxType: string(header[4:8]), offset: offset}
+		switch boxSize := binary.BigEndian.Uint32(header); boxSize {
+		case 0:
+			// The box extends to the end of the file.
+			box.size = size - offset
+		case 1:
+			if n < 16 {
+				return nil, errors.New("truncated box header")
+			}
+			box.size = int64(binary.BigEndian.Uint64(header[8:]))
+		default:
+			box.size = int64(boxSize)
+		}
+		if box.size < 8 || box.size > size-offset {
+			return nil, fmt.Errorf("invalid size for %q box", box.boxType)
+		}
+
+		boxes = append(boxes, box)
+		offset += box.size
+	}
+
+	return boxes, nil
+}
+
+func hasBoxes(boxes []mp4Box, boxTypes ...string) bool {
+	for _, boxType := range boxTypes {
+		found := false
+		for _, box := range boxes {
+			if box.boxType == boxType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateMP4 checks that a file is a fragmented MP4 media segment, or a
+// complete fragmented MP4 file, whose boxes fill the whole file.
+func validateMP4(r io.ReaderAt, size int64) error {
+	boxes, err := readBoxes(r, size)
+	if err != nil {
+		return err
+	}
+	if !hasBoxes(boxes, "moof", "mdat") {
+		return errors.New("no movie fragments")
+	}
+
+	return nil
+}
+
+// splitFragmentedMP4 splits a fragmented MP4 file into its initialization
+// segment (the ftyp and moov boxes) and its media segment (the movie
+// fragments). Other boxes, such as the mfra box written at the end, are
+// dropped.
+func splitFragmentedMP4(b []byte) (init, media []byte, err error) {
+	boxes, err := readBoxes(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hasBoxes(boxes, "ftyp", "moov", "moof", "mdat") {
+		return nil, nil, errors.New("not a fragmented MP4 file")
+	}
+
+	for _, box := range boxes {
+		data := b[box.offset : box.offset+box.size]
+		switch box.boxType {
+		case "ftyp", "moov":
+			init = append(init, data...)
+		case "styp", "sidx", "prft", "emsg", "moof", "mdat":
+			media = append(media, data...)
+		}
+	}
+
+	return init, media, nil
+}
+
+// initName returns the name of an initialization segment, which is
+// derived from its contents so that segments recorded with the same
+// settings share one.
+func initName(init []byte) string {
+	hash := sha256.Sum256(init)
+	return initPrefix + hex.EncodeToString(hash[:8]) + initExtension
+}
+
+// InitSegment describes the video track in an initialization segment.
+type InitSegment struct {
+	Name      string
+	Codecs    string
+	Width     int
+	Height    int
+	Timescale uint32
+}
+
+// findBox returns the contents of the box at the given path of nested box
+// types, or nil if there is none.
+func findBox(b []byte, boxPath ...string) []byte {
+	for _, boxType := range boxPath {
+		boxes, err := readBoxes(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return nil
+		}
+
+		var found []byte
+		for _, box := range boxes {
+			if box.boxType == boxType {
+				headerSize := int64(8)
+				if binary.BigEndian.Uint32(b[box.offset:]) == 1 {
+					headerSize = 16
+				}
+				found = b[box.offset+headerSize : box.offset+box.size]
+				break
+			}
+		}
+		if found == nil {
+			return nil
+		}
+		b = found
+	}
+
+	return b
+}
+
+// mediaTime returns the decode time of the first sample in a media
+// segment, in the track's timescale.
+func mediaTime(media []byte) (uint64, bool) {
+	tfdt := findBox(media, "moof", "traf", "tfdt")
+	switch {
+	case len(tfdt) >= 12 && tfdt[0] == 1:
+		return binary.BigEndian.Uint64(tfdt[4:]), true
+	case len(tfdt) >= 8:
+		return uint64(binary.BigEndian.Uint32(tfdt[4:])), true
+	default:
+		return 0, false
+	}
+}
+
+// parseInit reads the timescale, dimensions and RFC 6381 codecs string of
+// the first track, which is the video track, from an initialization
+// segment.
+func parseInit(name string, b []byte) (InitSegment, error) {
+	init := InitSegment{Name: name}
+
+	mdia := findBox(b, "moov", "trak", "mdia")
+	mdhd := findBox(mdia, "mdhd")
+	switch {
+	case len(mdhd) >= 24 && mdhd[0] == 1:
+		init.Timescale = binary.BigEndian.Uint32(mdhd[20:])
+	case len(mdhd) >= 16:
+		init.Timescale = binary.BigEndian.Uint32(mdhd[12:])
+	}
+	if init.Timescale == 0 {
+		return InitSegment{}, errors.New("no timescale in initialization segment")
+	}
+
+	// The stsd box holds a version, flags and entry count before the
+	// sample entries. An AVC sample entry has 78 bytes of fields before
+	// its child boxes, including the width and height.
+	stsd := findBox(mdia, "minf", "stbl", "stsd")
+	if len(stsd) < 8 {
+		return InitSegment{}, errors.New("no sample description in initialization segment")
+	}
+	entry := findBox(stsd[8:], "avc1")
+	if entry == nil {
+		entry = findBox(stsd[8:], "avc3")
+	}
+	if len(entry) < 78 {
+		return InitSegment{}, errors.New("no H.264 video in initialization segment")
+	}
+	init.Width = int(binary.BigEndian.Uint16(entry[24:]))
+	init.Height = int(binary.BigEndian.Uint16(entry[26:]))
+
+	avcC := findBox(entry[78:], "avcC")
+	if len(avcC) < 4 {
+		return InitSegment{}, errors.New("no AVC configuration in initialization segment")
+	}
+	init.Codecs = fmt.Sprintf("avc1.%02x%02x%02x", avcC[1], avcC[2], avcC[3])
+
+	return init, nil
+}
+
+// InitSegment returns a description of a stored initialization segment.
+func (s *storageImpl) InitSegment(name string) (InitSegment, error) {
+	s.mutex.Lock()
+	init, ok := s.inits[name]
+	s.mutex.Unlock()
+	if !ok {
+		return InitSegment{}, errors.New("unknown initialization segment: " + name)
+	}
+	if init != nil {
+		return *init, nil
+	}
+
+	file, err := s.driver.Open(name)
+	if err != nil {
+		return InitSegment{}, err
+	}
+	b, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return InitSegment{}, err
+	}
+
+	parsed, err := parseInit(name, b)
+	if err != nil {
+		return InitSegment{}, err
+	}
+
+	s.mutex.Lock()
+	s.inits[name] = &parsed
+	s.mutex.Unlock()
+	return parsed, nil
+}
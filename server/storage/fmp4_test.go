@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func newMP4Box(boxType string, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+	copy(b[4:], boxType)
+	return append(b, payload...)
+}
+
+// addTestMP4Segment adds a fragmented MP4 segment whose initialization
+// segment depends on settings.
+func addTestMP4Segment(t *testing.T, s *storageImpl, created time.Time, settings byte) Segment {
+	t.Helper()
+	var b []byte
+	b = append(b, newMP4Box("ftyp", []byte("isom\x00\x00\x02\x00"))...)
+	b = append(b, newMP4Box("moov", []byte{settings})...)
+	b = append(b, newMP4Box("moof", nil)...)
+	b = append(b, newMP4Box("mdat", []byte{1, 2, 3, 4})...)
+
+	filePath := path.Join(t.TempDir(), "recorded.mp4")
+	if err := ioutil.WriteFile(filePath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddSegment(filePath, created, created.Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.segments[s.lastSegmentID]
+}
+
+func TestRemoveUnusedInit(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStorage(t, Config{}, dir)
+	created := time.Unix(1500000000, 0)
+	first := addTestMP4Segment(t, s, created, 1)
+	second := addTestMP4Segment(t, s, created.Add(5*time.Second), 1)
+	third := addTestMP4Segment(t, s, created.Add(10*time.Second), 2)
+	if first.Init != second.Init || first.Init == third.Init {
+		t.Fatalf("got initialization segments %s, %s and %s", first.Init, second.Init, third.Init)
+	}
+
+	exists := func(name string) bool {
+		_, err := os.Stat(path.Join(dir, name))
+		return err == nil
+	}
+
+	s.mutex.Lock()
+	err := s.removeSegment(first.ID)
+	s.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(first.Init) {
+		t.Error("initialization segment was removed while a segment refers to it")
+	}
+
+	s.mutex.Lock()
+	err = s.removeSegment(second.ID)
+	_, known := s.inits[second.Init]
+	s.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(second.Init) || known {
+		t.Error("unused initialization segment was not removed")
+	}
+	if !exists(third.Init) {
+		t.Error("initialization segment of another segment was removed")
+	}
+
+	// Adding a segment with a removed initialization segment stores it
+	// again.
+	fourth := addTestMP4Segment(t, s, created.Add(15*time.Second), 1)
+	if fourth.Init != first.Init || !exists(fourth.Init) {
+		t.Errorf("initialization segment %s was not stored again", fourth.Init)
+	}
+}
+
+// TestRecoveryRemovesUnusedInits checks initialization segments that were
+// left unused by a crash, or before they were removed with their segments.
+func TestRecoveryRemovesUnusedInits(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStorage(t, Config{}, dir)
+	segment := addTestMP4Segment(t, s, time.Unix(1500000000, 0), 1)
+	s.index.close()
+
+	unused := initPrefix + "0123456789abcdef" + initExtension
+	if err := ioutil.WriteFile(path.Join(dir, unused), []byte("unused"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestStorage(t, Config{}, dir)
+	if _, err := os.Stat(path.Join(dir, unused)); !os.IsNotExist(err) {
+		t.Errorf("unused initialization segment was not removed: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, segment.Init)); err != nil {
+		t.Errorf("initialization segment in use was removed: %v", err)
+	}
+	if segments := s.sortedSegments(); len(segments) != 1 || segments[0].Init != segment.Init {
+		t.Errorf("got segments %+v", segments)
+	}
+}
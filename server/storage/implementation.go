@@ -26,12 +26,17 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"errors"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"strconv"
 	"sync"
@@ -41,62 +46,309 @@ import (
 )
 
 type storageImpl struct {
+	namespace         string
 	segmentDir        string
+	driver            Driver
+	archive           Driver
+	archiveAfter      time.Duration
+	archiveMaxSize    int64
 	segmentDirMaxSize int64
+	maxAge            time.Duration
 	segments          map[SegmentID]Segment
 	lastSegmentID     SegmentID
+	index             *segmentIndex
 	mutex             *sync.Mutex
+	archiveWake       chan struct{}
+	transcode         TranscodeConfig
+	signer            *manifestSigner
+	lastChecksum      string
+	pinnedOverBudget  map[Tier]bool
+	discontinuity     bool
+	annotations       *annotationStore
+
+	// inits holds the initialization segments that have been stored,
+	// with their descriptions once they have been read. They are small
+	// and shared by many segments, so they are kept in the local tier and
+	// removed once no segment refers to them. pendingInits counts the
+	// segments being added with each of them, which are not indexed yet.
+	inits        map[string]*InitSegment
+	pendingInits map[string]int
+
+	// jobMutex serializes background jobs that move or rewrite segment
+	// files, so that they never operate on the same file at once.
+	jobMutex *sync.Mutex
 }
 
-func New() (Storage, error) {
-	segmentDir, err := util.ConfigDir("segments")
+// New creates the storage for a camera. Each camera's segments are kept in
+// a separate namespace in every tier; the namespace may be empty if there
+// is only one camera.
+func New(config Config, namespace string) (Storage, error) {
+	segmentDir, err := util.ConfigDir("segments", namespace)
 	if err != nil {
 		return nil, err
 	}
 
-	segments, lastSegmentID, err := loadSegments(segmentDir)
+	return newStorage(config, segmentDir, namespace)
+}
+
+// newStorage creates the storage for a camera whose index and local
+// segments are kept in segmentDir.
+func newStorage(config Config, segmentDir, namespace string) (_ Storage, err error) {
+	driver, err := newDriver(config.Driver, segmentDir, config.S3.withPrefix(namespace))
+	if err != nil {
+		return nil, err
+	}
+
+	var archive Driver
+	if len(config.Archive.Driver) != 0 {
+		if config.Archive.Driver == "local" && len(config.Archive.Dir) == 0 {
+			return nil, errors.New("local archive requires a directory")
+		}
+
+		archive, err = newDriver(config.Archive.Driver, path.Join(config.Archive.Dir, namespace), config.Archive.S3.withPrefix(namespace))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The index is always kept on the local filesystem.
+	index, err := openSegmentIndex(segmentDir)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			index.close()
+		}
+	}()
+
+	segments, err := index.load()
+	indexed := make(map[SegmentID]bool, len(segments))
+	for segmentID := range segments {
+		indexed[segmentID] = true
+	}
+	if err != nil {
+		// The index is missing or unreadable, so rebuild it from the
+		// segment file names.
+		if !os.IsNotExist(err) {
+			fmt.Println("Unable to load segment index, rebuilding:", err)
+		}
+
+		segments, err = loadSegments(driver, TierLocal)
+		if err != nil {
+			return nil, err
+		}
+
+		// Segments found in the archive take precedence, since a segment
+		// is only removed from the local tier after it has been copied.
+		if archive != nil {
+			archived, err := loadSegments(archive, TierArchive)
+			if err != nil {
+				return nil, err
+			}
+			for segmentID, segment := range archived {
+				segments[segmentID] = segment
+			}
+		}
+	}
 
-	return &storageImpl{
+	// Quarantine any segments that were left truncated or invalid by a
+	// crash and save the resulting index.
+	segments, err = recoverTier(driver, TierLocal, segments)
+	if err != nil {
+		return nil, err
+	}
+	if archive != nil {
+		segments, err = recoverTier(archive, TierArchive, segments)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Evidence.Enabled && len(indexed) != 0 {
+		linkRecoveredSegments(segments, indexed)
+	}
+	if err := index.replace(segments); err != nil {
+		return nil, err
+	}
+
+	lastSegmentID := SegmentID(0)
+	for segmentID := range segments {
+		if segmentID > lastSegmentID {
+			lastSegmentID = segmentID
+		}
+	}
+
+	annotations, err := newAnnotationStore(index)
+	if err != nil {
+		return nil, err
+	}
+
+	var signer *manifestSigner
+	if config.Evidence.Enabled {
+		signer, err = newManifestSigner(segmentDir, config.Evidence)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &storageImpl{
+		namespace: namespace,
 		segmentDir: segmentDir,
-		segmentDirMaxSize: 1024*1024*1024, // 1 GB
+		driver: driver,
+		archive: archive,
+		archiveAfter: time.Duration(config.Archive.After) * time.Second,
+		archiveMaxSize: config.Archive.MaxSize,
+		segmentDirMaxSize: config.MaxSize,
+		maxAge: time.Duration(config.MaxAge) * time.Second,
 		segments: segments,
 		lastSegmentID: lastSegmentID + 1,
+		index: index,
 		mutex: &sync.Mutex{},
-	}, nil
+		archiveWake: make(chan struct{}, 1),
+		transcode: config.Transcode,
+		signer: signer,
+		annotations: annotations,
+		lastChecksum: segments[lastSegmentID].Checksum,
+		pinnedOverBudget: make(map[Tier]bool),
+		inits: make(map[string]*InitSegment),
+		pendingInits: make(map[string]int),
+		jobMutex: &sync.Mutex{},
+	}
+	for _, segment := range segments {
+		if len(segment.Init) != 0 {
+			s.inits[segment.Init] = nil
+		}
+	}
+	return s, nil
 }
 
-func (s *storageImpl) SegmentDir() string {
-	return s.segmentDir
+func (s *storageImpl) Start() {
+	if s.archive != nil {
+		go s.archiveLoop()
+	}
+	if s.transcode.After > 0 {
+		// Transcoding would change the segment hashes that evidence
+		// mode relies on.
+		if s.signer != nil {
+			fmt.Println("Transcoding is disabled in evidence mode")
+		} else {
+			go s.transcodeLoop()
+		}
+	}
+}
+
+func newDriver(name, dir string, s3Config S3Config) (Driver, error) {
+	switch name {
+	case "", "local":
+		return newLocalDriver(dir), nil
+	case "s3":
+		return newS3Driver(s3Config)
+	default:
+		return nil, errors.New("unknown storage driver: " + name)
+	}
+}
+
+// recoverTier runs driver recovery for the segments stored in the given
+// tier, leaving the segments of other tiers untouched. Recovery may also
+// index segment files of the tier that were missing from the index.
+func recoverTier(driver Driver, tier Tier, segments map[SegmentID]Segment) (map[SegmentID]Segment, error) {
+	r, ok := driver.(recoverer)
+	if !ok {
+		return segments, nil
+	}
+
+	tierSegments := make(map[SegmentID]Segment)
+	result := make(map[SegmentID]Segment, len(segments))
+	for segmentID, segment := range segments {
+		if segment.Tier == tier {
+			tierSegments[segmentID] = segment
+		} else {
+			result[segmentID] = segment
+		}
+	}
+
+	valid, err := r.recover(tierSegments, result)
+	if err != nil {
+		return nil, err
+	}
+	for segmentID, segment := range valid {
+		segment.Tier = tier
+		result[segmentID] = segment
+	}
+
+	return result, nil
+}
+
+// driverFor returns the driver that stores the given segment.
+func (s *storageImpl) driverFor(segment Segment) Driver {
+	if segment.Tier == TierArchive && s.archive != nil {
+		return s.archive
+	}
+
+	return s.driver
+}
+
+func (s *storageImpl) ServeSegment(w http.ResponseWriter, req *http.Request, name string) {
+	if strings.HasPrefix(name, initPrefix) {
+		s.mutex.Lock()
+		_, ok := s.inits[name]
+		s.mutex.Unlock()
+		if ok {
+			s.driver.ServeFile(w, req, name)
+		} else {
+			http.NotFound(w, req)
+		}
+		return
+	}
+
+	// Only serve files that are known segments.
+	segment, err := segmentFromFileName(name)
+	if err == nil {
+		s.mutex.Lock()
+		indexed, ok := s.segments[segment.ID]
+		s.mutex.Unlock()
+		if ok && indexed.Name == name {
+			s.driverFor(indexed).ServeFile(w, req, name)
+			return
+		}
+	}
+
+	http.NotFound(w, req)
 }
 
-func loadSegments(segmentDir string) (map[SegmentID]Segment, SegmentID, error) {
-	// Get a listing of files in the segment directory.
-	files, err := ioutil.ReadDir(segmentDir)
+func loadSegments(driver Driver, tier Tier) (map[SegmentID]Segment, error) {
+	// Get a listing of files stored by the driver.
+	files, err := driver.List()
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
 	// Build a map of segments.
 	segments := make(map[SegmentID]Segment, len(files))
-	lastSegmentID := SegmentID(0)
 	for _, fileInfo := range files {
-		segment, err := segmentFromFileName(fileInfo.Name())
+		segment, err := segmentFromFileName(fileInfo.Name)
 		if err == nil {
+			segment.Size = fileInfo.Size
+			segment.Tier = tier
 			segments[segment.ID] = segment
-			if segment.ID > lastSegmentID {
-				lastSegmentID = segment.ID
-			}
 		}
 	}
 
-	return segments, lastSegmentID, nil
+	return segments, nil
 }
 
+// segmentFromFileName parses the name of an MPEG-TS segment,
+// segment_<time>_<duration>_<id>.ts, or of a fragmented MP4 segment,
+// segment_<time>_<duration>_<id>_<init>.m4s, where init identifies the
+// initialization segment. Transcoded MPEG-TS segments are named
+// segment_<time>_<duration>_<id>.transcoded.ts.
 func segmentFromFileName(name string) (Segment, error) {
 	parts := strings.Split(strings.Split(name, ".")[0], "_")
+	init := ""
+	if len(parts) == 5 && strings.HasSuffix(name, ".m4s") {
+		init = initPrefix + parts[4] + initExtension
+		parts = parts[:4]
+	}
 	if len(parts) != 4 || parts[0] != "segment" {
 		return Segment{}, errors.New("invalid segment file name")
 	}
@@ -120,10 +372,12 @@ func segmentFromFileName(name string) (Segment, error) {
 	}
 
 	return Segment{
-		ID:       SegmentID(segmentID),
-		Name:     name,
-		Time:     time.Unix(int64(segmentTime), 0),
-		Duration: time.Duration(segmentDuration) * time.Millisecond,
+		ID:         SegmentID(segmentID),
+		Name:       name,
+		Time:       time.Unix(int64(segmentTime), 0),
+		Duration:   time.Duration(segmentDuration) * time.Millisecond,
+		Init:       init,
+		Transcoded: strings.HasSuffix(name, transcodedSuffix),
 	}, nil
 }
 
@@ -142,13 +396,36 @@ func (s *storageImpl) LatestSegments(count int) []Segment {
 	return segments
 }
 
+func (s *storageImpl) SegmentsInRange(start, end time.Time) []Segment {
+	s.mutex.Lock()
+
+	segments := make([]Segment, 0)
+	for _, segment := range s.segments {
+		if segment.Time.Add(segment.Duration).After(start) && segment.Time.Before(end) {
+			segments = append(segments, segment)
+		}
+	}
+
+	s.mutex.Unlock()
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].ID < segments[j].ID
+	})
+	return segments
+}
+
 func (s *storageImpl) addSegment(filePath string, created, modified time.Time) error {
 	t := time.Now()
 
+	if err := validateSegmentFile(filePath, -1); err != nil {
+		return err
+	}
+
 	inFile, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
+	defer inFile.Close()
 
 	fileInfo, err := inFile.Stat()
 	if err != nil {
@@ -158,41 +435,291 @@ func (s *storageImpl) addSegment(filePath string, created, modified time.Time) e
 	segmentTime := created
 	segmentDuration := modified.Sub(created)
 
-	// Generate segment file name/path.
+	// Generate segment file name.
 	segmentID := s.lastSegmentID + 1
 	segmentName := fmt.Sprintf("segment_%d_%d_%d.ts", segmentTime.Unix(),
 		(segmentDuration / time.Millisecond), segmentID)
-	segmentPath := path.Join(s.segmentDir, segmentName)
 
-	// Copy the file to the segments directory.
-	outFile, err := os.Create(segmentPath)
-	if err != nil {
+	// A fragmented MP4 file is stored as an initialization segment, which
+	// is shared with other segments, and a media segment.
+	var r io.Reader = inFile
+	size := fileInfo.Size()
+	init := ""
+	var segmentMediaTime *uint64
+	if mp4, err := isMP4File(inFile); err != nil {
 		return err
+	} else if mp4 {
+		b, err := ioutil.ReadAll(inFile)
+		if err != nil {
+			return err
+		}
+		initData, media, err := splitFragmentedMP4(b)
+		if err != nil {
+			return err
+		}
+		if init, err = s.putInit(initData); err != nil {
+			return err
+		}
+		defer s.releaseInit(init)
+
+		segmentName = fmt.Sprintf("segment_%d_%d_%d_%s.m4s", segmentTime.Unix(),
+			(segmentDuration / time.Millisecond), segmentID,
+			strings.TrimSuffix(strings.TrimPrefix(init, initPrefix), initExtension))
+		r = bytes.NewReader(media)
+		size = int64(len(media))
+		if t, ok := mediaTime(media); ok {
+			segmentMediaTime = &t
+		}
 	}
-	if n, err := io.Copy(outFile, inFile); err != nil {
+
+	// Store the file, hashing it as it is copied.
+	hash := sha256.New()
+	if err := s.driver.Put(segmentName, io.TeeReader(r, hash), size); err != nil {
 		return err
-	} else if n != fileInfo.Size() {
-		return errors.New("could not copy entire file")
 	}
 
 	s.mutex.Lock()
-	s.lastSegmentID = segmentID
-	s.segments[segmentID] = Segment{
+	segment := Segment{
 		ID: segmentID,
 		Name: segmentName,
 		Time: segmentTime,
 		Duration: segmentDuration,
+		Size: size,
+		Init: init,
+		MediaTime: segmentMediaTime,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+	}
+	if s.signer != nil {
+		segment.PrevChecksum = s.lastChecksum
+	}
+	segment.Discontinuity = s.discontinuity
+	s.segments[segmentID] = segment
+	if err := s.index.put(segment); err != nil {
+		delete(s.segments, segmentID)
+		s.mutex.Unlock()
+		s.driver.Remove(segmentName)
+		return err
+	}
+	s.lastSegmentID = segmentID
+	s.lastChecksum = segment.Checksum
+	s.discontinuity = false
+	if err := s.signManifestIfDue(time.Now()); err != nil {
+		fmt.Println("Error when signing manifest:", err)
 	}
 	s.mutex.Unlock()
 
+	// Without an archive tier, old segments are simply removed. Otherwise
+	// the archive loop moves them out of the local tier.
+	if s.archive == nil {
+		if err := s.applyRetention(); err != nil {
+			fmt.Println("Error when removing old segments:", err)
+		}
+	} else {
+		s.wakeArchiveLoop()
+	}
+
 	d := time.Since(t)
 	println("Added segment", segmentID, "in", d / time.Millisecond, "ms")
 
 	return nil
 }
 
+// isMP4File returns whether a segment file is an MP4 file rather than an
+// MPEG-TS file.
+func isMP4File(file *os.File) (bool, error) {
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, 0); err != nil {
+		return false, err
+	}
+
+	return b[0] != tsSyncByte, nil
+}
+
+// putInit stores an initialization segment if it has not been stored yet
+// and returns its name. It is kept until releaseInit is called, even if
+// no segment refers to it.
+func (s *storageImpl) putInit(b []byte) (string, error) {
+	name := initName(b)
+
+	s.mutex.Lock()
+	s.pendingInits[name]++
+	_, ok := s.inits[name]
+	s.mutex.Unlock()
+	if ok {
+		return name, nil
+	}
+
+	if err := s.driver.Put(name, bytes.NewReader(b), int64(len(b))); err != nil {
+		s.releaseInit(name)
+		return "", err
+	}
+
+	s.mutex.Lock()
+	s.inits[name] = nil
+	s.mutex.Unlock()
+	return name, nil
+}
+
+// releaseInit is called once a segment stored with putInit has been
+// indexed, or could not be, and removes the initialization segment if no
+// segment refers to it.
+func (s *storageImpl) releaseInit(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pendingInits[name]--; s.pendingInits[name] == 0 {
+		delete(s.pendingInits, name)
+	}
+	if err := s.removeUnusedInit(name); err != nil {
+		fmt.Println("Error when removing initialization segment:", err)
+	}
+}
+
+// removeUnusedInit removes an initialization segment if no segment refers
+// to it and none is being added with it. The caller must hold the mutex.
+func (s *storageImpl) removeUnusedInit(name string) error {
+	if _, ok := s.inits[name]; !ok || s.pendingInits[name] != 0 {
+		return nil
+	}
+	for _, segment := range s.segments {
+		if segment.Init == name {
+			return nil
+		}
+	}
+
+	println("Removing initialization segment", name)
+	delete(s.inits, name)
+	return s.driver.Remove(name)
+}
+
+// removeSegment deletes a segment from the index and then removes its file.
+// The caller must hold the mutex.
+func (s *storageImpl) removeSegment(segmentID SegmentID) error {
+	segment, ok := s.segments[segmentID]
+	if !ok {
+		return nil
+	}
+
+	delete(s.segments, segmentID)
+	if err := s.index.remove(segmentID); err != nil {
+		s.segments[segmentID] = segment
+		return err
+	}
+
+	if err := s.driverFor(segment).Remove(segment.Name); err != nil {
+		return err
+	}
+	if len(segment.Init) != 0 {
+		return s.removeUnusedInit(segment.Init)
+	}
+
+	return nil
+}
+
+// applyRetention removes segments that exceed the size or age limits of
+// the tier they would be removed from. Nothing is removed unless a limit
+// has been configured.
+func (s *storageImpl) applyRetention() error {
+	// With an archive tier, the local tier only exceeds its limit if
+	// segments could not be archived, e.g. because the archive is
+	// unreachable. They are then removed as they would be without an
+	// archive, so that the local disk does not fill up.
+	if s.segmentDirMaxSize > 0 {
+		if err := s.enforceMaxSize(TierLocal, s.segmentDirMaxSize); err != nil {
+			return err
+		}
+	}
+	if s.archive != nil && s.archiveMaxSize > 0 {
+		if err := s.enforceMaxSize(TierArchive, s.archiveMaxSize); err != nil {
+			return err
+		}
+	}
+
+	if s.maxAge > 0 {
+		return s.enforceMaxAge(s.maxAge)
+	}
+
+	return nil
+}
+
+// enforceMaxSize removes the oldest unpinned segments in the given tier
+// until the total size of the tier's segments fits within maxSize.
+func (s *storageImpl) enforceMaxSize(tier Tier, maxSize int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	totalSize := int64(0)
+	pinnedSize := int64(0)
+	segmentIDs := make([]SegmentID, 0, len(s.segments))
+	for segmentID, segment := range s.segments {
+		if segment.Tier != tier {
+			continue
+		}
+
+		totalSize += segment.Size
+		if segment.IsPinned(now) {
+			pinnedSize += segment.Size
+		} else {
+			segmentIDs = append(segmentIDs, segmentID)
+		}
+	}
+	sort.Slice(segmentIDs, func(i, j int) bool {
+		return segmentIDs[i] < segmentIDs[j]
+	})
+
+	for _, segmentID := range segmentIDs {
+		if totalSize <= maxSize {
+			break
+		}
+
+		size := s.segments[segmentID].Size
+		if err := s.removeSegment(segmentID); err != nil {
+			return err
+		}
+		totalSize -= size
+	}
+
+	// Report when pinned segments alone exceed the budget, since no
+	// amount of removal can then bring the tier within its limit.
+	overBudget := pinnedSize > maxSize
+	if overBudget && !s.pinnedOverBudget[tier] {
+		fmt.Println("Pinned segments use", pinnedSize, "bytes, exceeding the storage budget of", maxSize, "bytes")
+	}
+	s.pinnedOverBudget[tier] = overBudget
+
+	return nil
+}
+
+// enforceMaxAge removes unpinned segments older than maxAge from all tiers.
+func (s *storageImpl) enforceMaxAge(maxAge time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for segmentID, segment := range s.segments {
+		if now.Sub(segment.Time) > maxAge && !segment.IsPinned(now) {
+			if err := s.removeSegment(segmentID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func (s *storageImpl) VideoRecorded(filePath string, created, modified time.Time) {
 	if err := s.addSegment(filePath, created, modified); err != nil {
 		fmt.Println("Error when adding segment:", err)
 	}
 }
+
+func (s *storageImpl) AddSegment(filePath string, created, modified time.Time) error {
+	return s.addSegment(filePath, created, modified)
+}
+
+func (s *storageImpl) Discontinuity() {
+	s.mutex.Lock()
+	s.discontinuity = true
+	s.mutex.Unlock()
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const indexFileName = "index.db"
+
+var segmentsBucket = []byte("segments")
+
+// segmentIndex persists segment metadata in a bbolt database in the
+// segment directory, with one record per segment keyed by its ID. Every
+// update is a single transaction that only writes the segments that
+// changed, so a crash leaves either the old or the new records on disk.
+type segmentIndex struct {
+	db *bolt.DB
+}
+
+// openSegmentIndex opens the index in the given directory, creating it if
+// it does not exist. A database that cannot be read is moved aside, so
+// that the index can be rebuilt.
+func openSegmentIndex(segmentDir string) (*segmentIndex, error) {
+	dbPath := path.Join(segmentDir, indexFileName)
+	options := &bolt.Options{Timeout: time.Second}
+	db, err := bolt.Open(dbPath, 0644, options)
+	if err == bolt.ErrTimeout {
+		return nil, errors.New("segment index is in use by another process")
+	} else if err != nil {
+		fmt.Println("Unable to open segment index, rebuilding:", err)
+		if err := os.Rename(dbPath, dbPath+".corrupt"); err != nil {
+			return nil, err
+		}
+		if db, err = bolt.Open(dbPath, 0644, options); err != nil {
+			return nil, err
+		}
+	}
+
+	return &segmentIndex{db: db}, nil
+}
+
+func (idx *segmentIndex) close() error {
+	return idx.db.Close()
+}
+
+func segmentKey(segmentID SegmentID) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(segmentID))
+	return key
+}
+
+// load returns the indexed segments. The error satisfies os.IsNotExist if
+// the index is empty because it has just been created.
+func (idx *segmentIndex) load() (map[SegmentID]Segment, error) {
+	segments := make(map[SegmentID]Segment)
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(segmentsBucket)
+		if bucket == nil {
+			return os.ErrNotExist
+		}
+
+		return bucket.ForEach(func(key, value []byte) error {
+			var segment Segment
+			if err := json.Unmarshal(value, &segment); err != nil {
+				return err
+			}
+			if len(key) != 8 || segment.ID != SegmentID(binary.BigEndian.Uint64(key)) || len(segment.Name) == 0 {
+				return errors.New("invalid segment in index")
+			}
+			segments[segment.ID] = segment
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return segments, nil
+}
+
+func putSegments(bucket *bolt.Bucket, segments []Segment) error {
+	for _, segment := range segments {
+		value, err := json.Marshal(&segment)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(segmentKey(segment.ID), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replace replaces the contents of the index with the given segments.
+func (idx *segmentIndex) replace(segments map[SegmentID]Segment) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(segmentsBucket) != nil {
+			if err := tx.DeleteBucket(segmentsBucket); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket(segmentsBucket)
+		if err != nil {
+			return err
+		}
+
+		list := make([]Segment, 0, len(segments))
+		for _, segment := range segments {
+			list = append(list, segment)
+		}
+		return putSegments(bucket, list)
+	})
+}
+
+// put adds or updates the given segments.
+func (idx *segmentIndex) put(segments ...Segment) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(segmentsBucket)
+		if err != nil {
+			return err
+		}
+
+		return putSegments(bucket, segments)
+	})
+}
+
+// remove deletes the given segments.
+func (idx *segmentIndex) remove(segmentIDs ...SegmentID) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(segmentsBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, segmentID := range segmentIDs {
+			if err := bucket.Delete(segmentKey(segmentID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
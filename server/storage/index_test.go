@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeTSFile writes an MPEG-TS file of the given number of packets, each
+// starting with the sync byte and filled with fill.
+func writeTSFile(t *testing.T, filePath string, packets int, fill byte) {
+	t.Helper()
+	b := make([]byte, packets*tsPacketSize)
+	for i := range b {
+		b[i] = fill
+		if i%tsPacketSize == 0 {
+			b[i] = tsSyncByte
+		}
+	}
+	if err := ioutil.WriteFile(filePath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestStorage creates a storage in dir, which is closed when the test
+// ends.
+func newTestStorage(t *testing.T, config Config, dir string) *storageImpl {
+	t.Helper()
+	s, err := newStorage(config, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl := s.(*storageImpl)
+	t.Cleanup(func() { impl.index.close() })
+	return impl
+}
+
+// addTestSegment adds a segment recorded at the given time.
+func addTestSegment(t *testing.T, s *storageImpl, created time.Time, fill byte) Segment {
+	t.Helper()
+	filePath := path.Join(t.TempDir(), "recorded.ts")
+	writeTSFile(t, filePath, 10, fill)
+	if err := s.AddSegment(filePath, created, created.Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.segments[s.lastSegmentID]
+}
+
+func TestSegmentIndex(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := openSegmentIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.load(); !os.IsNotExist(err) {
+		t.Fatalf("new index: got error %v, want a not-exist error", err)
+	}
+
+	first := Segment{ID: 1, Name: "segment_1_5000_1.ts", Size: 1880, Checksum: "abc"}
+	second := Segment{ID: 2, Name: "segment_6_5000_2.ts", Size: 1880, Pinned: true}
+	if err := idx.put(first, second); err != nil {
+		t.Fatal(err)
+	}
+	first.Tier = TierArchive
+	if err := idx.put(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.remove(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = openSegmentIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.close()
+	segments, err := idx.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("got %d segments, want 1", len(segments))
+	}
+	if got := segments[1]; got.Name != first.Name || got.Tier != TierArchive || got.Checksum != "abc" {
+		t.Errorf("got segment %+v, want %+v", got, first)
+	}
+}
+
+func TestSegmentIndexCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dir, indexFileName), []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := openSegmentIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.close()
+	if _, err := idx.load(); !os.IsNotExist(err) {
+		t.Errorf("got error %v, want a not-exist error", err)
+	}
+	if _, err := os.Stat(path.Join(dir, indexFileName+".corrupt")); err != nil {
+		t.Errorf("corrupt index was not moved aside: %v", err)
+	}
+}
+
+func TestStorageReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStorage(t, Config{}, dir)
+	created := time.Unix(1500000000, 0)
+	first := addTestSegment(t, s, created, 1)
+	second := addTestSegment(t, s, created.Add(5*time.Second), 2)
+	if _, err := s.Pin(created, created.Add(time.Second), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	s.index.close()
+
+	// Metadata that file names do not hold, such as checksums and pins,
+	// is restored from the index.
+	s = newTestStorage(t, Config{}, dir)
+	segments := s.sortedSegments()
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want 2", len(segments))
+	}
+	if segments[0].Checksum != first.Checksum || !segments[0].Pinned {
+		t.Errorf("got first segment %+v", segments[0])
+	}
+	if segments[1].Checksum != second.Checksum || segments[1].Pinned {
+		t.Errorf("got second segment %+v", segments[1])
+	}
+}
+
+func TestStorageRebuildsIndex(t *testing.T) {
+	dir := t.TempDir()
+	writeTSFile(t, path.Join(dir, "segment_1500000000_5000_1.ts"), 10, 1)
+	writeTSFile(t, path.Join(dir, "segment_1500000005_5000_2.ts"), 10, 2)
+
+	s := newTestStorage(t, Config{}, dir)
+	segments := s.sortedSegments()
+	if len(segments) != 2 || segments[1].Duration != 5*time.Second || !segments[1].Time.Equal(time.Unix(1500000005, 0)) {
+		t.Fatalf("got segments %+v", segments)
+	}
+	if s.lastSegmentID != 3 {
+		t.Errorf("next segment ID is %d, want 3", s.lastSegmentID)
+	}
+}
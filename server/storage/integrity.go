@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// VerifyStatus describes the outcome of verifying a single segment.
+type VerifyStatus string
+
+const (
+	VerifyOK         VerifyStatus = "ok"
+	VerifyMismatch   VerifyStatus = "mismatch"
+	VerifyUnreadable VerifyStatus = "unreadable"
+	VerifyNoChecksum VerifyStatus = "no-checksum"
+)
+
+// VerifyResult is the result of verifying a single segment.
+type VerifyResult struct {
+	Segment     Segment      `json:"segment"`
+	Status      VerifyStatus `json:"status"`
+	Checksum    string       `json:"checksum,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Quarantined bool         `json:"quarantined,omitempty"`
+}
+
+// hashSegment returns the hex-encoded SHA-256 hash of a stored segment.
+func (s *storageImpl) hashSegment(segment Segment) (string, error) {
+	file, err := s.driverFor(segment).Open(segment.Name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *storageImpl) sortedSegments() []Segment {
+	s.mutex.Lock()
+	segments := make([]Segment, 0, len(s.segments))
+	for _, segment := range s.segments {
+		segments = append(segments, segment)
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].ID < segments[j].ID
+	})
+	return segments
+}
+
+func (s *storageImpl) Verify(quarantine bool) ([]VerifyResult, error) {
+	// Keep background jobs from rewriting segments while they are hashed.
+	s.jobMutex.Lock()
+	defer s.jobMutex.Unlock()
+
+	segments := s.sortedSegments()
+	results := make([]VerifyResult, 0, len(segments))
+	for _, segment := range segments {
+		result := VerifyResult{Segment: segment}
+
+		checksum, err := s.hashSegment(segment)
+		if err != nil {
+			result.Status = VerifyUnreadable
+			result.Error = err.Error()
+		} else if len(segment.Checksum) == 0 {
+			result.Status = VerifyNoChecksum
+			result.Checksum = checksum
+		} else if checksum != segment.Checksum {
+			result.Status = VerifyMismatch
+			result.Checksum = checksum
+		} else {
+			result.Status = VerifyOK
+		}
+
+		if quarantine && result.Status == VerifyMismatch {
+			if err := s.quarantineSegment(segment); err != nil {
+				return nil, err
+			}
+			result.Quarantined = true
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// quarantineSegment removes a segment from the index and moves its file to
+// the local quarantine directory, wherever it was stored.
+func (s *storageImpl) quarantineSegment(segment Segment) error {
+	quarantineDir := path.Join(s.segmentDir, quarantineDirName)
+	if err := os.MkdirAll(quarantineDir, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+
+	inFile, err := s.driverFor(segment).Open(segment.Name)
+	if err != nil {
+		return err
+	}
+	err = copyFile(path.Join(quarantineDir, segment.Name), inFile, -1)
+	inFile.Close()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.removeSegment(segment.ID)
+}
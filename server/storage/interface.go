@@ -26,20 +26,99 @@
 package storage
 
 import (
+	"io"
+	"net/http"
 	"time"
 )
 
 type SegmentID uint64
 
 type Segment struct {
-	ID       SegmentID
-	Name     string
-	Time     time.Time
-	Duration time.Duration
+	ID       SegmentID     `json:"id"`
+	Name     string        `json:"name"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Size     int64         `json:"size"`
+	Tier     Tier          `json:"tier,omitempty"`
+
+	// Init is the name of the initialization segment of a fragmented MP4
+	// segment. It is empty for MPEG-TS segments.
+	Init string `json:"init,omitempty"`
+
+	// MediaTime is the decode time that a fragmented MP4 segment starts
+	// at, in the timescale of its initialization segment, if it is known.
+	MediaTime *uint64 `json:"mediaTime,omitempty"`
+
+	// Discontinuity is true if the segment does not continue the one
+	// before it, e.g. because the camera settings changed.
+	Discontinuity bool `json:"discontinuity,omitempty"`
+
+	Transcoded bool `json:"transcoded,omitempty"`
+
+	// Checksum is the hex-encoded SHA-256 hash of the segment file.
+	Checksum string `json:"checksum,omitempty"`
+
+	// PrevChecksum is the checksum of the segment stored before this one.
+	// It is only recorded in evidence mode.
+	PrevChecksum string `json:"prevChecksum,omitempty"`
+
+	// Pinned segments are never removed by retention. If PinnedUntil is
+	// set, the pin expires at that time.
+	Pinned      bool      `json:"pinned,omitempty"`
+	PinnedUntil time.Time `json:"pinnedUntil,omitempty"`
 }
 
+// IsPinned reports whether the segment is pinned at the given time.
+func (s Segment) IsPinned(now time.Time) bool {
+	return s.Pinned && (s.PinnedUntil.IsZero() || now.Before(s.PinnedUntil))
+}
+
+// Tier identifies where a segment is stored.
+type Tier string
+
+const (
+	TierLocal   Tier = ""
+	TierArchive Tier = "archive"
+)
+
 type Storage interface {
-	SegmentDir() string
+	// Start begins the background jobs (archiving and transcoding).
+	Start()
+
+	ServeSegment(w http.ResponseWriter, req *http.Request, name string)
+
+	// InitSegment describes the initialization segment with the given
+	// name, as referred to by fragmented MP4 segments.
+	InitSegment(name string) (InitSegment, error)
 	LatestSegments(count int) []Segment
+	SegmentsInRange(start, end time.Time) []Segment
 	VideoRecorded(filePath string, created, modified time.Time)
+	Discontinuity()
+
+	// AddSegment stores a segment in the same way as VideoRecorded, but
+	// returns any error to the caller. The file is left in place.
+	AddSegment(filePath string, created, modified time.Time) error
+
+	// Verify re-hashes all stored segments and reports the result for
+	// each one. If quarantine is true, corrupt segments are moved to the
+	// quarantine directory and removed from the index.
+	Verify(quarantine bool) ([]VerifyResult, error)
+
+	// Export writes a tar archive of the segments between start and end,
+	// together with a manifest containing their hashes and the
+	// annotations in the same range.
+	Export(w io.Writer, start, end time.Time) error
+
+	// Pin protects the segments between start and end from retention
+	// until the given time, or indefinitely if until is zero. Unpin
+	// removes the protection. Both return the number of segments changed.
+	Pin(start, end, until time.Time) (int, error)
+	Unpin(start, end time.Time) (int, error)
+	PinStatus() PinStatus
+
+	AddAnnotation(annotation Annotation) (Annotation, error)
+	UpdateAnnotation(annotation Annotation) (Annotation, error)
+	DeleteAnnotation(id AnnotationID) error
+	Annotation(id AnnotationID) (Annotation, error)
+	SearchAnnotations(query AnnotationQuery) []Annotation
 }
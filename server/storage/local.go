@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/joshb/pi-camera-go/server/util"
+)
+
+// localDriver stores segment files in a directory on the local filesystem.
+type localDriver struct {
+	dir string
+}
+
+func newLocalDriver(dir string) *localDriver {
+	return &localDriver{dir: dir}
+}
+
+func (d *localDriver) filePath(name string) (string, error) {
+	if len(name) == 0 || path.Base(name) != name || name[0] == '.' {
+		return "", errors.New("invalid file name")
+	}
+
+	return path.Join(d.dir, name), nil
+}
+
+func (d *localDriver) Put(name string, r io.Reader, size int64) error {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return err
+	}
+
+	// Copy the data to a temporary file in the directory.
+	tmpPath := filePath + tempFileSuffix
+	if err := copyFile(tmpPath, r, size); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Move the complete file into place.
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return util.SyncDir(d.dir)
+}
+
+func (d *localDriver) Open(name string) (io.ReadCloser, error) {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(filePath)
+}
+
+func (d *localDriver) Remove(name string) error {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (d *localDriver) List() ([]FileInfo, error) {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]FileInfo, 0, len(files))
+	for _, fileInfo := range files {
+		if fileInfo.IsDir() {
+			continue
+		}
+
+		infos = append(infos, FileInfo{
+			Name: fileInfo.Name(),
+			Size: fileInfo.Size(),
+		})
+	}
+
+	return infos, nil
+}
+
+func (d *localDriver) ServeFile(w http.ResponseWriter, req *http.Request, name string) {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	http.ServeFile(w, req, filePath)
+}
+
+func (d *localDriver) recover(segments, others map[SegmentID]Segment) (map[SegmentID]Segment, error) {
+	return recoverSegments(d.dir, segments, others)
+}
+
+// copyFile copies size bytes from r to a new file at filePath and syncs the
+// file before closing it. If size is negative, all of r is copied.
+func copyFile(filePath string, r io.Reader, size int64) error {
+	outFile, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+
+	if n, err := io.Copy(outFile, r); err != nil {
+		outFile.Close()
+		return err
+	} else if size >= 0 && n != size {
+		outFile.Close()
+		return errors.New("could not copy entire file")
+	}
+
+	if err := outFile.Sync(); err != nil {
+		outFile.Close()
+		return err
+	}
+
+	return outFile.Close()
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"time"
+)
+
+// PinStatus summarizes the pinned segments.
+type PinStatus struct {
+	Segments []Segment `json:"segments"`
+	Size     int64     `json:"size"`
+
+	// Budget is the size limit of the tier that segments are removed
+	// from, or zero if there is no limit. OverBudget is true if pinned
+	// segments alone exceed it.
+	Budget     int64 `json:"budget"`
+	OverBudget bool  `json:"overBudget"`
+}
+
+// setPinned updates the pin of every segment between start and end and
+// saves the index. The caller must hold the mutex.
+func (s *storageImpl) setPinned(start, end time.Time, pinned bool, until time.Time) (int, error) {
+	previous := make(map[SegmentID]Segment)
+	var changed []Segment
+	for segmentID, segment := range s.segments {
+		if !segment.Time.Add(segment.Duration).After(start) || !segment.Time.Before(end) {
+			continue
+		}
+
+		previous[segmentID] = segment
+		segment.Pinned = pinned
+		segment.PinnedUntil = until
+		s.segments[segmentID] = segment
+		changed = append(changed, segment)
+	}
+
+	if len(previous) == 0 {
+		return 0, nil
+	}
+
+	if err := s.index.put(changed...); err != nil {
+		for segmentID, segment := range previous {
+			s.segments[segmentID] = segment
+		}
+		return 0, err
+	}
+
+	return len(previous), nil
+}
+
+func (s *storageImpl) Pin(start, end, until time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.setPinned(start, end, true, until)
+}
+
+func (s *storageImpl) Unpin(start, end time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.setPinned(start, end, false, time.Time{})
+}
+
+func (s *storageImpl) PinStatus() PinStatus {
+	now := time.Now()
+	status := PinStatus{Segments: make([]Segment, 0)}
+
+	// Segments are removed from the local tier if there is no archive,
+	// and from the archive otherwise.
+	status.Budget = s.segmentDirMaxSize
+	if s.archive != nil {
+		status.Budget = s.archiveMaxSize
+	}
+
+	for _, segment := range s.sortedSegments() {
+		if segment.IsPinned(now) {
+			status.Segments = append(status.Segments, segment)
+			status.Size += segment.Size
+		}
+	}
+	status.OverBudget = status.Budget > 0 && status.Size > status.Budget
+
+	return status
+}
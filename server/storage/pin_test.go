@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// pinTestSegment pins a single segment until the given time.
+func pinTestSegment(t *testing.T, s *storageImpl, segment Segment, until time.Time) {
+	t.Helper()
+	n, err := s.Pin(segment.Time, segment.Time.Add(time.Second), until)
+	if err != nil || n != 1 {
+		t.Fatalf("Pin returned %d, %v", n, err)
+	}
+}
+
+// segmentIDs returns the IDs of the stored segments in order.
+func segmentIDs(s *storageImpl) []SegmentID {
+	var ids []SegmentID
+	for _, segment := range s.sortedSegments() {
+		ids = append(ids, segment.ID)
+	}
+	return ids
+}
+
+func equalIDs(a, b []SegmentID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPinSurvivesRetention(t *testing.T) {
+	s := newTestStorage(t, Config{}, t.TempDir())
+	created := time.Now().Add(-time.Hour)
+	var added []Segment
+	for i := 0; i < 4; i++ {
+		added = append(added, addTestSegment(t, s, created.Add(time.Duration(i)*5*time.Second), byte(i)))
+	}
+
+	until := time.Now().Add(500 * time.Millisecond)
+	pinTestSegment(t, s, added[0], time.Time{})
+	pinTestSegment(t, s, added[1], until)
+
+	// Every segment is too old and the limit only fits one segment, so
+	// only the pinned segments may remain.
+	s.maxAge = time.Minute
+	s.segmentDirMaxSize = 10 * tsPacketSize
+	if err := s.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := segmentIDs(s); !equalIDs(ids, []SegmentID{added[0].ID, added[1].ID}) {
+		t.Fatalf("got segments %v after retention", ids)
+	}
+	if _, err := os.Stat(path.Join(s.segmentDir, added[0].Name)); err != nil {
+		t.Errorf("pinned segment file was removed: %v", err)
+	}
+
+	status := s.PinStatus()
+	if len(status.Segments) != 2 || status.Size != 2*10*tsPacketSize || status.Budget != s.segmentDirMaxSize || !status.OverBudget {
+		t.Errorf("got pin status %+v", status)
+	}
+
+	// The pin is released once it expires.
+	time.Sleep(time.Until(until))
+	if err := s.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := segmentIDs(s); !equalIDs(ids, []SegmentID{added[0].ID}) {
+		t.Fatalf("got segments %v after the pin expired", ids)
+	}
+
+	// Unpinning releases the rest.
+	n, err := s.Unpin(created, created.Add(time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("Unpin returned %d, %v", n, err)
+	}
+	if err := s.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := segmentIDs(s); len(ids) != 0 {
+		t.Errorf("got segments %v after unpinning", ids)
+	}
+}
+
+func TestPinSurvivesTiering(t *testing.T) {
+	archiveDir := t.TempDir()
+	s := newTestStorage(t, Config{
+		Archive: ArchiveConfig{Driver: "local", Dir: archiveDir, After: 1, MaxSize: 10 * tsPacketSize},
+	}, t.TempDir())
+
+	created := time.Now().Add(-time.Minute)
+	var added []Segment
+	for i := 0; i < 3; i++ {
+		added = append(added, addTestSegment(t, s, created.Add(time.Duration(i)*5*time.Second), byte(i)))
+	}
+	pinTestSegment(t, s, added[1], time.Time{})
+
+	// All segments are moved to the archive, which only has room for the
+	// pinned one.
+	if err := s.archiveSegments(); err != nil {
+		t.Fatal(err)
+	}
+	segments := s.sortedSegments()
+	if len(segments) != 1 || segments[0].ID != added[1].ID {
+		t.Fatalf("got segments %v after archiving", segmentIDs(s))
+	}
+	if segments[0].Tier != TierArchive || !segments[0].Pinned {
+		t.Errorf("got archived segment %+v", segments[0])
+	}
+	if _, err := os.Stat(path.Join(archiveDir, added[1].Name)); err != nil {
+		t.Errorf("pinned segment is not in the archive: %v", err)
+	}
+
+	// The pin is kept in the index.
+	indexed, err := s.index.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segment := indexed[added[1].ID]; !segment.Pinned || segment.Tier != TierArchive {
+		t.Errorf("got indexed segment %+v", segment)
+	}
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	quarantineDirName = "quarantine"
+	tempFileSuffix    = ".tmp"
+
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// ValidateSegment checks that a file looks like a complete MPEG-TS or
+// fragmented MP4 segment before it is added to storage.
+func ValidateSegment(filePath string) error {
+	return validateSegmentFile(filePath, -1)
+}
+
+// validateSegmentFile checks that a segment file looks complete. An
+// MPEG-TS file must have a non-zero size that is a whole number of packets,
+// with the sync byte present at the start of the first and last packet; a
+// fragmented MP4 file must consist of whole boxes including a movie
+// fragment. If expectedSize is not negative, the file must also have
+// exactly that size.
+func validateSegmentFile(filePath string, expectedSize int64) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := fileInfo.Size()
+	if expectedSize >= 0 && size != expectedSize {
+		return fmt.Errorf("unexpected size %d (expected %d)", size, expectedSize)
+	}
+	if size == 0 {
+		return errors.New("file is empty")
+	}
+
+	// Tell the containers apart by the MPEG-TS sync byte.
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, 0); err != nil {
+		return err
+	}
+	if b[0] != tsSyncByte {
+		return validateMP4(file, size)
+	}
+
+	if size%tsPacketSize != 0 {
+		return fmt.Errorf("size %d is not a multiple of the packet size", size)
+	}
+
+	for _, offset := range []int64{0, size - tsPacketSize} {
+		b := make([]byte, 1)
+		if _, err := file.ReadAt(b, offset); err != nil && err != io.EOF {
+			return err
+		}
+		if b[0] != tsSyncByte {
+			return errors.New("bad sync byte")
+		}
+	}
+
+	return nil
+}
+
+// quarantineFile moves a file out of the segment directory and into the
+// quarantine directory so that it is no longer served.
+func quarantineFile(segmentDir, name string) error {
+	quarantineDir := path.Join(segmentDir, quarantineDirName)
+	if err := os.MkdirAll(quarantineDir, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.Rename(path.Join(segmentDir, name), path.Join(quarantineDir, name))
+}
+
+// recoverSegments removes temporary files left behind by an interrupted
+// write and quarantines segments whose files are missing, truncated or
+// invalid. It returns the segments that passed validation.
+//
+// Segment files that are not in the index were left by a crash after the
+// file was stored but before the index was updated. If another tier or
+// file already holds the segment, the file is a leftover copy from moving
+// or transcoding it and is removed; otherwise it is validated and indexed,
+// or quarantined if it is invalid. Initialization segments that no segment
+// refers to are removed.
+func recoverSegments(segmentDir string, segments, others map[SegmentID]Segment) (map[SegmentID]Segment, error) {
+	files, err := ioutil.ReadDir(segmentDir)
+	if err != nil {
+		return nil, err
+	}
+
+	indexed := make(map[string]bool, len(segments))
+	for _, segment := range segments {
+		indexed[segment.Name] = true
+	}
+
+	var orphans []Segment
+	for _, fileInfo := range files {
+		if fileInfo.IsDir() {
+			continue
+		}
+
+		if strings.HasSuffix(fileInfo.Name(), tempFileSuffix) {
+			println("Removing incomplete file", fileInfo.Name())
+			if err := os.Remove(path.Join(segmentDir, fileInfo.Name())); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if segment, err := segmentFromFileName(fileInfo.Name()); err == nil && !indexed[segment.Name] {
+			orphans = append(orphans, segment)
+		}
+	}
+
+	valid := make(map[SegmentID]Segment, len(segments))
+	for segmentID, segment := range segments {
+		segmentPath := path.Join(segmentDir, segment.Name)
+		err := validateSegmentFile(segmentPath, segment.Size)
+		if err == nil {
+			valid[segmentID] = segment
+			continue
+		}
+
+		fmt.Println("Invalid segment", segment.Name+":", err)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err := quarantineFile(segmentDir, segment.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, segment := range orphans {
+		_, inTier := segments[segment.ID]
+		_, inOtherTier := others[segment.ID]
+		if inTier || inOtherTier {
+			println("Removing leftover copy of segment", segment.ID, segment.Name)
+			if err := os.Remove(path.Join(segmentDir, segment.Name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		recovered, err := recoverOrphan(segmentDir, segment)
+		if err != nil {
+			fmt.Println("Invalid unindexed segment", segment.Name+":", err)
+			if err := quarantineFile(segmentDir, segment.Name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		println("Indexing unindexed segment", segment.Name)
+		valid[segment.ID] = recovered
+	}
+
+	inits := make(map[string]bool)
+	for _, segments := range []map[SegmentID]Segment{valid, others} {
+		for _, segment := range segments {
+			inits[segment.Init] = true
+		}
+	}
+	for _, fileInfo := range files {
+		name := fileInfo.Name()
+		if !fileInfo.IsDir() && strings.HasPrefix(name, initPrefix) && strings.HasSuffix(name, initExtension) && !inits[name] {
+			println("Removing unused initialization segment", name)
+			if err := os.Remove(path.Join(segmentDir, name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return valid, nil
+}
+
+// recoverOrphan validates a segment file that is not in the index and
+// fills in the segment's size and checksum, which are not part of its name.
+func recoverOrphan(segmentDir string, segment Segment) (Segment, error) {
+	segmentPath := path.Join(segmentDir, segment.Name)
+	if err := validateSegmentFile(segmentPath, -1); err != nil {
+		return Segment{}, err
+	}
+	if len(segment.Init) != 0 {
+		if _, err := os.Stat(path.Join(segmentDir, segment.Init)); err != nil {
+			return Segment{}, err
+		}
+	}
+
+	b, err := ioutil.ReadFile(segmentPath)
+	if err != nil {
+		return Segment{}, err
+	}
+
+	hash := sha256.Sum256(b)
+	segment.Size = int64(len(b))
+	segment.Checksum = hex.EncodeToString(hash[:])
+	if len(segment.Init) != 0 {
+		if t, ok := mediaTime(b); ok {
+			segment.MediaTime = &t
+		}
+	}
+
+	return segment, nil
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRecoveryQuarantinesInvalidSegments(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStorage(t, Config{}, dir)
+	created := time.Unix(1500000000, 0)
+	truncated := addTestSegment(t, s, created, 1)
+	valid := addTestSegment(t, s, created.Add(5*time.Second), 2)
+	s.index.close()
+
+	segmentPath := path.Join(dir, truncated.Name)
+	if err := os.Truncate(segmentPath, truncated.Size-100); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, valid.Name+tempFileSuffix), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestStorage(t, Config{}, dir)
+	segments := s.sortedSegments()
+	if len(segments) != 1 || segments[0].ID != valid.ID {
+		t.Fatalf("got segments %+v, want only segment %d", segments, valid.ID)
+	}
+	if _, err := os.Stat(path.Join(dir, quarantineDirName, truncated.Name)); err != nil {
+		t.Errorf("truncated segment was not quarantined: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, valid.Name+tempFileSuffix)); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+}
+
+// TestRecoveryIndexesOrphans checks segment files that were stored but
+// not indexed before a crash.
+func TestRecoveryIndexesOrphans(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStorage(t, Config{}, dir)
+	created := time.Unix(1500000000, 0)
+	indexed := addTestSegment(t, s, created, 1)
+	s.index.close()
+
+	orphan := "segment_1500000005_5000_7.ts"
+	writeTSFile(t, path.Join(dir, orphan), 10, 2)
+	invalid := "segment_1500000010_5000_8.ts"
+	if err := ioutil.WriteFile(path.Join(dir, invalid), []byte("not a segment"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second copy of an indexed segment is left by an interrupted
+	// transcode or move between tiers.
+	leftover := "segment_1500000000_5000_2.old.ts"
+	writeTSFile(t, path.Join(dir, leftover), 10, 3)
+
+	s = newTestStorage(t, Config{}, dir)
+	segments := s.sortedSegments()
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want 2", len(segments))
+	}
+	if segments[0].Name != indexed.Name || segments[0].Checksum != indexed.Checksum {
+		t.Errorf("got first segment %+v, want %+v", segments[0], indexed)
+	}
+	recovered := segments[1]
+	if recovered.ID != 7 || recovered.Name != orphan || recovered.Size != 10*tsPacketSize || len(recovered.Checksum) == 0 {
+		t.Errorf("got recovered segment %+v", recovered)
+	}
+	if s.lastSegmentID != 8 {
+		t.Errorf("next segment ID is %d, want 8", s.lastSegmentID)
+	}
+
+	if _, err := os.Stat(path.Join(dir, quarantineDirName, invalid)); err != nil {
+		t.Errorf("invalid segment was not quarantined: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, leftover)); !os.IsNotExist(err) {
+		t.Errorf("leftover copy was not removed: %v", err)
+	}
+
+	// The recovered segment is now in the index.
+	s.index.close()
+	s = newTestStorage(t, Config{}, dir)
+	if got := s.sortedSegments(); len(got) != 2 || got[1].Checksum != recovered.Checksum {
+		t.Errorf("got segments %+v after reopening", got)
+	}
+}
@@ -0,0 +1,431 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+)
+
+// s3Driver stores segment files in a bucket of an S3-compatible object
+// store. Requests use path-style addressing so that the driver also works
+// with MinIO and similar servers.
+type s3Driver struct {
+	endpoint      *url.URL
+	region        string
+	bucket        string
+	prefix        string
+	accessKey     string
+	secretKey     string
+	redirect      bool
+	presignExpiry time.Duration
+	client        *http.Client
+}
+
+func newS3Driver(config S3Config) (*s3Driver, error) {
+	if len(config.Endpoint) == 0 || len(config.Bucket) == 0 {
+		return nil, errors.New("s3 driver requires an endpoint and a bucket")
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	region := config.Region
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+
+	presignExpiry := time.Duration(config.PresignExpiry) * time.Second
+	if presignExpiry <= 0 {
+		presignExpiry = 5 * time.Minute
+	}
+
+	return &s3Driver{
+		endpoint:      endpoint,
+		region:        region,
+		bucket:        config.Bucket,
+		prefix:        strings.Trim(config.Prefix, "/"),
+		accessKey:     config.AccessKey,
+		secretKey:     config.SecretKey,
+		redirect:      config.Redirect,
+		presignExpiry: presignExpiry,
+		client:        &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+func (d *s3Driver) key(name string) string {
+	if len(d.prefix) == 0 {
+		return name
+	}
+
+	return d.prefix + "/" + name
+}
+
+// objectURL returns the URL of an object, or of the bucket itself if key
+// is empty.
+func (d *s3Driver) objectURL(key string) *url.URL {
+	u := *d.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + d.bucket
+	if len(key) != 0 {
+		u.Path += "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = ""
+
+	return &u
+}
+
+func (d *s3Driver) Put(name string, r io.Reader, size int64) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	} else if int64(len(b)) != size {
+		return errors.New("could not read entire file")
+	}
+
+	req, err := http.NewRequest(http.MethodPut, d.objectURL(d.key(name)).String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentTypeForName(name))
+	d.sign(req, sha256Hex(b), time.Now())
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkS3Response(resp)
+}
+
+func (d *s3Driver) Open(name string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, d.objectURL(d.key(name)).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	d.sign(req, s3UnsignedPayload, time.Now())
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkS3Response(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (d *s3Driver) Remove(name string) error {
+	req, err := http.NewRequest(http.MethodDelete, d.objectURL(d.key(name)).String(), nil)
+	if err != nil {
+		return err
+	}
+	d.sign(req, s3UnsignedPayload, time.Now())
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return checkS3Response(resp)
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (d *s3Driver) List() ([]FileInfo, error) {
+	prefix := ""
+	if len(d.prefix) != 0 {
+		prefix = d.prefix + "/"
+	}
+
+	var infos []FileInfo
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if len(continuationToken) != 0 {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		u := d.objectURL("")
+		u.RawQuery = query.Encode()
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		d.sign(req, s3UnsignedPayload, time.Now())
+
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = checkS3Response(resp)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, prefix)
+			if len(name) == 0 || strings.Contains(name, "/") {
+				continue
+			}
+
+			infos = append(infos, FileInfo{Name: name, Size: object.Size})
+		}
+
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	return infos, nil
+}
+
+func (d *s3Driver) ServeFile(w http.ResponseWriter, req *http.Request, name string) {
+	if d.redirect {
+		http.Redirect(w, req, d.presign(http.MethodGet, d.key(name), time.Now()), http.StatusFound)
+		return
+	}
+
+	proxyReq, err := http.NewRequest(http.MethodGet, d.objectURL(d.key(name)).String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, header := range []string{"Range", "If-None-Match", "If-Modified-Since"} {
+		if value := req.Header.Get(header); len(value) != 0 {
+			proxyReq.Header.Set(header, value)
+		}
+	}
+	d.sign(proxyReq, s3UnsignedPayload, time.Now())
+
+	resp, err := d.client.Do(proxyReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+		if value := resp.Header.Get(header); len(value) != 0 {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (d *s3Driver) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headerNames := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "range" {
+			headerNames = append(headerNames, lower)
+		}
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		value := req.Host
+		if name == "host" {
+			if len(value) == 0 {
+				value = req.URL.Host
+			}
+		} else {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := d.scope(t)
+	signature := d.signature(t, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, d.accessKey, scope, signedHeaders, signature))
+}
+
+// presign returns a URL for the given object that can be used without
+// credentials until the presign expiry has passed.
+func (d *s3Driver) presign(method, key string, t time.Time) string {
+	t = t.UTC()
+	u := d.objectURL(key)
+	scope := d.scope(t)
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", d.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", t.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(d.presignExpiry/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+
+	query.Set("X-Amz-Signature", d.signature(t, scope, canonicalRequest))
+	u.RawQuery = canonicalQuery(query)
+
+	return u.String()
+}
+
+func (d *s3Driver) scope(t time.Time) string {
+	return t.Format(s3DateFormat) + "/" + d.region + "/s3/aws4_request"
+}
+
+func (d *s3Driver) signature(t time.Time, scope, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		t.Format(s3TimeFormat),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+d.secretKey), t.Format(s3DateFormat))
+	key = hmacSHA256(key, d.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalQuery encodes query parameters sorted by name, using the
+// percent-encoding required by Signature Version 4.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+func s3Escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func checkS3Response(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+}
+
+func contentTypeForName(name string) string {
+	if strings.HasSuffix(name, ".ts") {
+		return "video/mp2t"
+	}
+
+	return "application/octet-stream"
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The S3 driver is tested against a MinIO server, for example one started
+// with
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//
+// The tests are skipped unless PCG_TEST_S3_ENDPOINT is set to its URL.
+// PCG_TEST_S3_ACCESS_KEY and PCG_TEST_S3_SECRET_KEY default to MinIO's
+// default credentials, and the bucket is created if it does not exist.
+func testS3Config(t *testing.T) S3Config {
+	t.Helper()
+	endpoint := os.Getenv("PCG_TEST_S3_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("PCG_TEST_S3_ENDPOINT is not set")
+	}
+
+	config := S3Config{
+		Endpoint:  endpoint,
+		Bucket:    "pi-camera-go-test",
+		Prefix:    fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		AccessKey: os.Getenv("PCG_TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("PCG_TEST_S3_SECRET_KEY"),
+	}
+	if len(config.AccessKey) == 0 {
+		config.AccessKey, config.SecretKey = "minioadmin", "minioadmin"
+	}
+
+	// Create the bucket, and remove everything under the prefix once
+	// the test is done.
+	d, err := newS3Driver(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPut, d.objectURL("").String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.sign(req, sha256Hex(nil), time.Now())
+	resp, err := d.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		t.Fatalf("unable to create bucket: status %d", resp.StatusCode)
+	}
+	t.Cleanup(func() {
+		files, _ := d.List()
+		for _, file := range files {
+			d.Remove(file.Name)
+		}
+	})
+
+	return config
+}
+
+func TestS3Driver(t *testing.T) {
+	config := testS3Config(t)
+	d, err := newS3Driver(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"segment_1500000000_5000_1.ts": bytes.Repeat([]byte{tsSyncByte}, 1880),
+		"init_0123456789abcdef.mp4":    []byte("init segment"),
+	}
+	for name, b := range files {
+		if err := d.Put(name, bytes.NewReader(b), int64(len(b))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Objects outside the driver's prefix are not listed.
+	other := config
+	other.Prefix += "-other"
+	otherDriver, err := newS3Driver(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := otherDriver.Put("segment_1_5000_9.ts", strings.NewReader("x"), 1); err != nil {
+		t.Fatal(err)
+	}
+	defer otherDriver.Remove("segment_1_5000_9.ts")
+
+	infos, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(files) {
+		t.Fatalf("listed %+v, want %d files", infos, len(files))
+	}
+	for _, info := range infos {
+		if int64(len(files[info.Name])) != info.Size {
+			t.Errorf("listed %s with size %d, want %d", info.Name, info.Size, len(files[info.Name]))
+		}
+	}
+
+	r, err := d.Open("init_0123456789abcdef.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "init segment" {
+		t.Errorf("read %q, %v", b, err)
+	}
+
+	// Proxied requests pass ranges through.
+	req := httptest.NewRequest(http.MethodGet, "/segment_1500000000_5000_1.ts", nil)
+	req.Header.Set("Range", "bytes=0-187")
+	w := httptest.NewRecorder()
+	d.ServeFile(w, req, "segment_1500000000_5000_1.ts")
+	if w.Code != http.StatusPartialContent || w.Body.Len() != 188 {
+		t.Errorf("proxied range request: got status %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("Content-Type"); got != "video/mp2t" {
+		t.Errorf("proxied request: got content type %q", got)
+	}
+
+	// Redirects go to presigned URLs that need no credentials.
+	d.redirect = true
+	w = httptest.NewRecorder()
+	d.ServeFile(w, httptest.NewRequest(http.MethodGet, "/", nil), "segment_1500000000_5000_1.ts")
+	if w.Code != http.StatusFound {
+		t.Fatalf("redirect: got status %d", w.Code)
+	}
+	resp, err := http.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(b) != 1880 {
+		t.Errorf("presigned request: got status %d with %d bytes", resp.StatusCode, len(b))
+	}
+
+	if err := d.Remove("init_0123456789abcdef.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove("init_0123456789abcdef.mp4"); err != nil {
+		t.Errorf("removing a missing file: %v", err)
+	}
+	if _, err := d.Open("init_0123456789abcdef.mp4"); err == nil {
+		t.Error("opened a removed file")
+	}
+}
+
+// TestS3Storage checks that segments stored in S3 survive the loss of the
+// local index.
+func TestS3Storage(t *testing.T) {
+	config := Config{Driver: "s3", S3: testS3Config(t)}
+	dir := t.TempDir()
+	s := newTestStorage(t, config, dir)
+	created := time.Unix(1500000000, 0)
+	first := addTestSegment(t, s, created, 1)
+	second := addTestSegment(t, s, created.Add(5*time.Second), 2)
+	s.index.close()
+
+	if err := os.Remove(path.Join(dir, indexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	s = newTestStorage(t, config, dir)
+	segments := s.sortedSegments()
+	if len(segments) != 2 || segments[0].Name != first.Name || segments[1].Name != second.Name {
+		t.Fatalf("got segments %+v", segments)
+	}
+	if segments[1].Size != second.Size {
+		t.Errorf("got size %d, want %d", segments[1].Size, second.Size)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeSegment(w, httptest.NewRequest(http.MethodGet, "/", nil), second.Name)
+	if w.Code != http.StatusOK || int64(w.Body.Len()) != second.Size {
+		t.Errorf("served segment: got status %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const archiveInterval = time.Minute
+
+// archiveLoop periodically moves segments from the local tier to the
+// archive tier.
+func (s *storageImpl) archiveLoop() {
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.archiveSegments(); err != nil {
+			fmt.Println("Error when archiving segments:", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.archiveWake:
+		}
+	}
+}
+
+// wakeArchiveLoop makes the archive loop run as soon as possible.
+func (s *storageImpl) wakeArchiveLoop() {
+	select {
+	case s.archiveWake <- struct{}{}:
+	default:
+	}
+}
+
+// archiveCandidates returns the local segments that should be moved to the
+// archive, oldest first: segments older than archiveAfter, plus as many of
+// the oldest segments as needed to bring the local tier within its size
+// limit.
+func (s *storageImpl) archiveCandidates(now time.Time) []Segment {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	localSegments := make([]Segment, 0, len(s.segments))
+	totalSize := int64(0)
+	for _, segment := range s.segments {
+		if segment.Tier == TierLocal {
+			localSegments = append(localSegments, segment)
+			totalSize += segment.Size
+		}
+	}
+	sort.Slice(localSegments, func(i, j int) bool {
+		return localSegments[i].ID < localSegments[j].ID
+	})
+
+	candidates := make([]Segment, 0)
+	for _, segment := range localSegments {
+		tooOld := s.archiveAfter > 0 && now.Sub(segment.Time) > s.archiveAfter
+		tooBig := s.segmentDirMaxSize > 0 && totalSize > s.segmentDirMaxSize
+		if !tooOld && !tooBig {
+			break
+		}
+
+		candidates = append(candidates, segment)
+		totalSize -= segment.Size
+	}
+
+	return candidates
+}
+
+func (s *storageImpl) archiveSegments() error {
+	s.jobMutex.Lock()
+	defer s.jobMutex.Unlock()
+
+	var archiveErr error
+	for _, segment := range s.archiveCandidates(time.Now()) {
+		if archiveErr = s.moveToArchive(segment); archiveErr != nil {
+			break
+		}
+	}
+
+	// Retention also runs when archiving fails, so that the local tier
+	// stays within its size limit while the archive is unavailable.
+	if err := s.applyRetention(); err != nil {
+		return err
+	}
+
+	return archiveErr
+}
+
+// moveToArchive copies a segment to the archive tier, points the index at
+// the archived copy and then removes the local copy.
+func (s *storageImpl) moveToArchive(segment Segment) error {
+	inFile, err := s.driver.Open(segment.Name)
+	if err != nil {
+		return err
+	}
+	err = s.archive.Put(segment.Name, inFile, segment.Size)
+	inFile.Close()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	current, ok := s.segments[segment.ID]
+	if !ok || current.Tier != TierLocal {
+		// The segment was removed or moved while it was being copied.
+		s.mutex.Unlock()
+		return s.archive.Remove(segment.Name)
+	}
+
+	archived := current
+	archived.Tier = TierArchive
+	s.segments[segment.ID] = archived
+	if err := s.index.put(archived); err != nil {
+		s.segments[segment.ID] = current
+		s.mutex.Unlock()
+		s.archive.Remove(segment.Name)
+		return err
+	}
+	s.mutex.Unlock()
+
+	if err := s.driver.Remove(segment.Name); err != nil {
+		return errors.New("unable to remove archived segment from local tier: " + err.Error())
+	}
+
+	return nil
+}
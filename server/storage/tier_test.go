@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// unavailableDriver is an archive that cannot be written to.
+type unavailableDriver struct {
+	Driver
+}
+
+func (unavailableDriver) Put(name string, r io.Reader, size int64) error {
+	return errors.New("archive is unavailable")
+}
+
+func countTiers(segments []Segment) (local, archived int) {
+	for _, segment := range segments {
+		if segment.Tier == TierArchive {
+			archived++
+		} else {
+			local++
+		}
+	}
+
+	return local, archived
+}
+
+func TestArchiveSegments(t *testing.T) {
+	archiveDir := t.TempDir()
+	s := newTestStorage(t, Config{
+		MaxSize: 2 * 10 * tsPacketSize,
+		Archive: ArchiveConfig{Driver: "local", Dir: archiveDir},
+	}, t.TempDir())
+
+	created := time.Now().Add(-time.Minute)
+	var added []Segment
+	for i := 0; i < 4; i++ {
+		added = append(added, addTestSegment(t, s, created.Add(time.Duration(i)*5*time.Second), byte(i)))
+	}
+	if err := s.archiveSegments(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest segments are moved rather than removed.
+	segments := s.sortedSegments()
+	if local, archived := countTiers(segments); len(segments) != 4 || local != 2 || archived != 2 {
+		t.Fatalf("got %d local and %d archived segments", local, archived)
+	}
+	for _, segment := range added[:2] {
+		if _, err := os.Stat(path.Join(archiveDir, segment.Name)); err != nil {
+			t.Errorf("segment %d is not in the archive: %v", segment.ID, err)
+		}
+		if _, err := os.Stat(path.Join(s.segmentDir, segment.Name)); !os.IsNotExist(err) {
+			t.Errorf("segment %d was not removed from the local tier", segment.ID)
+		}
+	}
+}
+
+// TestArchiveUnavailable checks that the local tier is kept within its
+// size limit when segments cannot be archived.
+func TestArchiveUnavailable(t *testing.T) {
+	s := newTestStorage(t, Config{
+		MaxSize: 3 * 10 * tsPacketSize,
+		Archive: ArchiveConfig{Driver: "local", Dir: t.TempDir()},
+	}, t.TempDir())
+	s.archive = unavailableDriver{s.archive}
+
+	created := time.Now().Add(-time.Minute)
+	var added []Segment
+	for i := 0; i < 5; i++ {
+		added = append(added, addTestSegment(t, s, created.Add(time.Duration(i)*5*time.Second), byte(i)))
+	}
+	if err := s.archiveSegments(); err == nil {
+		t.Error("archiving to an unavailable archive succeeded")
+	}
+
+	segments := s.sortedSegments()
+	if local, archived := countTiers(segments); local != 3 || archived != 0 {
+		t.Fatalf("got %d local and %d archived segments, want 3 local", local, archived)
+	}
+	if segments[0].ID != added[2].ID {
+		t.Errorf("oldest remaining segment is %d, want %d", segments[0].ID, added[2].ID)
+	}
+}
+
+// TestArchiveUnavailableWithoutLimit checks that nothing is removed while
+// the archive is unavailable if the local tier has no size limit.
+func TestArchiveUnavailableWithoutLimit(t *testing.T) {
+	s := newTestStorage(t, Config{
+		Archive: ArchiveConfig{Driver: "local", Dir: t.TempDir(), After: 1},
+	}, t.TempDir())
+	s.archive = unavailableDriver{s.archive}
+
+	created := time.Now().Add(-time.Minute)
+	for i := 0; i < 3; i++ {
+		addTestSegment(t, s, created.Add(time.Duration(i)*5*time.Second), byte(i))
+	}
+	if err := s.archiveSegments(); err == nil {
+		t.Error("archiving to an unavailable archive succeeded")
+	}
+	if segments := s.sortedSegments(); len(segments) != 3 {
+		t.Errorf("got %d segments, want 3", len(segments))
+	}
+}
@@ -0,0 +1,268 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/util"
+)
+
+const (
+	transcodeInterval = time.Minute
+
+	// transcodedSuffix replaces the extension of a segment once it has
+	// been transcoded, so that the new file never overwrites the original.
+	transcodedSuffix = ".transcoded.ts"
+)
+
+// transcodeLoop periodically re-encodes old segments while the system is
+// idle.
+func (s *storageImpl) transcodeLoop() {
+	for {
+		if err := s.transcodeSegments(); err != nil {
+			fmt.Println("Error when transcoding segments:", err)
+		}
+
+		time.Sleep(transcodeInterval)
+	}
+}
+
+// transcodeCandidates returns the unpinned segments that are old enough to
+// be transcoded and have not been transcoded yet, oldest first. Fragmented
+// MP4 segments are left alone, since they could no longer be played with
+// their initialization segment.
+func (s *storageImpl) transcodeCandidates(now time.Time) []Segment {
+	after := time.Duration(s.transcode.After) * time.Second
+
+	s.mutex.Lock()
+	candidates := make([]Segment, 0)
+	for _, segment := range s.segments {
+		if !segment.Transcoded && len(segment.Init) == 0 && !segment.IsPinned(now) && now.Sub(segment.Time) > after {
+			candidates = append(candidates, segment)
+		}
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
+	return candidates
+}
+
+func (s *storageImpl) transcodeSegments() error {
+	for _, segment := range s.transcodeCandidates(time.Now()) {
+		// Stop as soon as the system is busy so that live recording is
+		// never disturbed.
+		if !s.isIdle() {
+			return nil
+		}
+
+		if err := s.transcodeSegment(segment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isIdle reports whether the one-minute load average is below the
+// configured maximum.
+func (s *storageImpl) isIdle() bool {
+	maxLoad := s.transcode.MaxLoad
+	if maxLoad <= 0 {
+		maxLoad = 0.5 * float64(runtime.NumCPU())
+	}
+
+	b, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		// Without a load average, assume that the system is idle and
+		// rely on the process priority instead.
+		return true
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return true
+	}
+
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return true
+	}
+
+	return load < maxLoad
+}
+
+// transcodeSegment re-encodes a segment and replaces the stored file with
+// the result. The result is stored under a new name, and the original is
+// only removed once the index refers to it, so that the index never
+// describes a file that has been replaced.
+func (s *storageImpl) transcodeSegment(segment Segment) error {
+	s.jobMutex.Lock()
+	defer s.jobMutex.Unlock()
+
+	// The segment may have been moved or removed since the candidates
+	// were chosen.
+	s.mutex.Lock()
+	segment, ok := s.segments[segment.ID]
+	s.mutex.Unlock()
+	if !ok || segment.Transcoded {
+		return nil
+	}
+
+	transcodeDir, err := util.ConfigDir("transcode", s.namespace)
+	if err != nil {
+		return err
+	}
+
+	inPath := path.Join(transcodeDir, "in_"+segment.Name)
+	outPath := path.Join(transcodeDir, "out_"+segment.Name)
+	defer os.Remove(inPath)
+	defer os.Remove(outPath)
+
+	// Fetch the segment.
+	driver := s.driverFor(segment)
+	inFile, err := driver.Open(segment.Name)
+	if err != nil {
+		return err
+	}
+	err = copyFile(inPath, inFile, segment.Size)
+	inFile.Close()
+	if err != nil {
+		return err
+	}
+
+	t := time.Now()
+	if err := s.runTranscoder(inPath, outPath); err != nil {
+		return err
+	}
+	if err := validateSegmentFile(outPath, -1); err != nil {
+		return errors.New("transcoded segment is invalid: " + err.Error())
+	}
+
+	outFile, err := os.Open(outPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	fileInfo, err := outFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Keep the original if re-encoding did not make it any smaller.
+	transcoded := segment
+	transcoded.Transcoded = true
+	if fileInfo.Size() < segment.Size {
+		hash := sha256.New()
+		transcoded.Name = strings.TrimSuffix(segment.Name, path.Ext(segment.Name)) + transcodedSuffix
+		if err := driver.Put(transcoded.Name, io.TeeReader(outFile, hash), fileInfo.Size()); err != nil {
+			return err
+		}
+		transcoded.Size = fileInfo.Size()
+		transcoded.Checksum = hex.EncodeToString(hash.Sum(nil))
+	}
+	replaced := transcoded.Name != segment.Name
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.segments[segment.ID]
+	if !ok {
+		// The segment was removed by retention while it was being
+		// transcoded, so remove the replacement too.
+		if replaced {
+			return driver.Remove(transcoded.Name)
+		}
+		return nil
+	}
+
+	// Only the fields describing the file are taken from the transcoded
+	// copy, so that changes such as pins made in the meantime are kept.
+	updated := current
+	updated.Name = transcoded.Name
+	updated.Size = transcoded.Size
+	updated.Checksum = transcoded.Checksum
+	updated.Transcoded = true
+	s.segments[segment.ID] = updated
+	if err := s.index.put(updated); err != nil {
+		s.segments[segment.ID] = current
+		if replaced {
+			driver.Remove(transcoded.Name)
+		}
+		return err
+	}
+	if replaced {
+		if err := driver.Remove(segment.Name); err != nil {
+			return errors.New("unable to remove original of transcoded segment: " + err.Error())
+		}
+	}
+
+	println("Transcoded segment", segment.ID, "from", segment.Size, "to",
+		transcoded.Size, "bytes in", time.Since(t)/time.Millisecond, "ms")
+	return nil
+}
+
+// runTranscoder runs ffmpeg at the lowest scheduling priority to
+// re-encode inPath into outPath.
+func (s *storageImpl) runTranscoder(inPath, outPath string) error {
+	threads := s.transcode.Threads
+	if threads <= 0 {
+		threads = 1
+	}
+
+	args := []string{
+		"-n", "19", "ffmpeg",
+		"-y",
+		"-threads", strconv.Itoa(threads),
+		"-i", inPath,
+	}
+	if s.transcode.Width > 0 && s.transcode.Height > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:%d", s.transcode.Width, s.transcode.Height))
+	}
+	args = append(args, "-codec:v", "libx264", "-preset", "veryfast",
+		"-threads", strconv.Itoa(threads))
+	if s.transcode.BitRate > 0 {
+		args = append(args, "-b:v", strconv.Itoa(s.transcode.BitRate))
+	}
+	args = append(args, "-codec:a", "copy", "-f", "mpegts", outPath)
+
+	return exec.Command("nice", args...).Run()
+}
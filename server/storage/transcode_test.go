@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// fakeFFmpeg puts an ffmpeg on the PATH that writes a five-packet MPEG-TS
+// file to its output path, which is its last argument.
+func fakeFFmpeg(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor out; do :; done\nhead -c 940 /dev/zero | tr '\\000' 'G' > \"$out\"\n"
+	if err := ioutil.WriteFile(path.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// blockingFFmpeg is like fakeFFmpeg, but the fake creates the returned
+// started file when it runs and then waits for the release file to exist
+// before writing its output.
+func blockingFFmpeg(t *testing.T) (started, release string) {
+	t.Helper()
+	dir := t.TempDir()
+	started = path.Join(dir, "started")
+	release = path.Join(dir, "release")
+	script := "#!/bin/sh\nfor out; do :; done\ntouch " + started + "\n" +
+		"while [ ! -e " + release + " ]; do sleep 0.01; done\n" +
+		"head -c 940 /dev/zero | tr '\\000' 'G' > \"$out\"\n"
+	if err := ioutil.WriteFile(path.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return started, release
+}
+
+func TestTranscodeSegment(t *testing.T) {
+	fakeFFmpeg(t)
+	s := newTestStorage(t, Config{Transcode: TranscodeConfig{After: 1}}, t.TempDir())
+	original := addTestSegment(t, s, time.Now().Add(-time.Minute), 1)
+
+	if err := s.transcodeSegment(original); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mutex.Lock()
+	transcoded := s.segments[original.ID]
+	s.mutex.Unlock()
+	if transcoded.Name != "segment_"+original.Name[len("segment_"):len(original.Name)-len(".ts")]+transcodedSuffix {
+		t.Errorf("transcoded segment is named %s", transcoded.Name)
+	}
+	if !transcoded.Transcoded || transcoded.Size != 5*tsPacketSize || transcoded.Checksum == original.Checksum {
+		t.Errorf("got transcoded segment %+v", transcoded)
+	}
+	if _, err := os.Stat(path.Join(s.segmentDir, original.Name)); !os.IsNotExist(err) {
+		t.Errorf("original was not removed: %v", err)
+	}
+
+	results, err := s.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != VerifyOK {
+		t.Errorf("got verify results %+v", results)
+	}
+
+	// Transcoded segments are recognized by name if the index is rebuilt.
+	s.index.close()
+	if err := os.Remove(path.Join(s.segmentDir, indexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	s = newTestStorage(t, Config{}, s.segmentDir)
+	if segments := s.sortedSegments(); len(segments) != 1 || !segments[0].Transcoded {
+		t.Errorf("got segments %+v after rebuilding the index", segments)
+	}
+}
+
+// TestTranscodeSegmentIndexFailure checks that the original is kept if the
+// index cannot be updated.
+func TestTranscodeSegmentIndexFailure(t *testing.T) {
+	fakeFFmpeg(t)
+	s := newTestStorage(t, Config{Transcode: TranscodeConfig{After: 1}}, t.TempDir())
+	original := addTestSegment(t, s, time.Now().Add(-time.Minute), 1)
+
+	s.index.close()
+	if err := s.transcodeSegment(original); err == nil {
+		t.Fatal("transcoding succeeded without an index")
+	}
+
+	s.mutex.Lock()
+	current := s.segments[original.ID]
+	s.mutex.Unlock()
+	if current.Name != original.Name || current.Checksum != original.Checksum || current.Transcoded {
+		t.Errorf("got segment %+v, want %+v", current, original)
+	}
+	if err := validateSegmentFile(path.Join(s.segmentDir, original.Name), original.Size); err != nil {
+		t.Errorf("original was changed: %v", err)
+	}
+	files, err := ioutil.ReadDir(s.segmentDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileInfo := range files {
+		if fileInfo.Name() != original.Name && path.Ext(fileInfo.Name()) == ".ts" {
+			t.Errorf("found %s next to the original", fileInfo.Name())
+		}
+	}
+}
+
+// TestTranscodeSegmentKeepsPin checks that a segment pinned while it is
+// being transcoded stays pinned.
+func TestTranscodeSegmentKeepsPin(t *testing.T) {
+	started, release := blockingFFmpeg(t)
+	s := newTestStorage(t, Config{Transcode: TranscodeConfig{After: 1}}, t.TempDir())
+	original := addTestSegment(t, s, time.Now().Add(-time.Minute), 1)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.transcodeSegment(original)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("transcoder did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	n, err := s.Pin(original.Time, original.Time.Add(time.Second), until)
+	if err != nil || n != 1 {
+		t.Fatalf("Pin returned %d, %v", n, err)
+	}
+	if err := ioutil.WriteFile(release, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	s.mutex.Lock()
+	transcoded := s.segments[original.ID]
+	s.mutex.Unlock()
+	if !transcoded.Transcoded || transcoded.Name == original.Name {
+		t.Errorf("segment was not transcoded: %+v", transcoded)
+	}
+	if !transcoded.Pinned || !transcoded.PinnedUntil.Equal(until) {
+		t.Errorf("pin was lost: %+v", transcoded)
+	}
+
+	// The index must agree with the segment in memory.
+	indexed, err := s.index.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !indexed[original.ID].Pinned || indexed[original.ID].Name != transcoded.Name {
+		t.Errorf("got indexed segment %+v", indexed[original.ID])
+	}
+}
+
+// TestRecoveryAfterInterruptedTranscode checks that a crash between
+// storing a transcoded segment and indexing it keeps the original.
+func TestRecoveryAfterInterruptedTranscode(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestStorage(t, Config{}, dir)
+	original := addTestSegment(t, s, time.Unix(1500000000, 0), 1)
+	s.index.close()
+
+	leftover := original.Name[:len(original.Name)-len(".ts")] + transcodedSuffix
+	writeTSFile(t, path.Join(dir, leftover), 5, 2)
+
+	s = newTestStorage(t, Config{}, dir)
+	segments := s.sortedSegments()
+	if len(segments) != 1 || segments[0].Name != original.Name || segments[0].Checksum != original.Checksum {
+		t.Errorf("got segments %+v, want %+v", segments, original)
+	}
+	if _, err := os.Stat(path.Join(dir, leftover)); !os.IsNotExist(err) {
+		t.Errorf("transcoded copy was not removed: %v", err)
+	}
+}
@@ -31,6 +31,8 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"io/ioutil"
 	"math/big"
 	"os"
 	"path"
@@ -119,4 +121,47 @@ func createKeys(privateKeyPath, publicKeyPath string) error {
 
 	println("Done generating certificate")
 	return nil
-}
\ No newline at end of file
+}
+
+// LoadKeys returns the server's private key and certificate, creating them
+// first if necessary.
+func LoadKeys() (*rsa.PrivateKey, *x509.Certificate, error) {
+	privateKeyPath, publicKeyPath, err := KeyPaths()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, nil, errors.New("invalid private key file")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err = ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := ParseCertificate(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, cert, nil
+}
+
+// ParseCertificate parses a PEM-encoded certificate.
+func ParseCertificate(b []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("invalid certificate")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes, from RFC 6455.
+const (
+	opBinary = 0x2
+	opClose  = 0x8
+	opPing   = 0x9
+	opPong   = 0xa
+)
+
+const (
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// maxMessageSize is the largest frame accepted from clients, which
+	// have nothing to send but control frames.
+	maxMessageSize = 64 * 1024
+
+	writeTimeout = 10 * time.Second
+)
+
+// conn is the server end of a WebSocket connection. Messages are only
+// sent; frames from the client are read to answer pings and closes.
+type conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// mutex guards writes, since pongs are written while messages are
+	// being sent.
+	mutex *sync.Mutex
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// upgrade completes the opening handshake, responding with an error if
+// the request is not a valid WebSocket request.
+func upgrade(w http.ResponseWriter, req *http.Request) (*conn, error) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || !headerContains(req.Header, "Connection", "upgrade") ||
+		!headerContains(req.Header, "Upgrade", "websocket") || len(key) == 0 {
+		http.Error(w, "WebSocket connection required", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket request")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	netConn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := io.WriteString(netConn, response); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	// Any data already buffered by the HTTP server is read first.
+	return &conn{conn: netConn, reader: rw.Reader, mutex: &sync.Mutex{}}, nil
+}
+
+// writeFrame writes an unfragmented frame. Frames from the server are
+// not masked.
+func (c *conn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// readLoop reads frames from the client until the connection is closed,
+// answering pings and closes.
+func (c *conn) readLoop() error {
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return err
+		}
+
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(c.reader, b[:]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(c.reader, b[:]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(b[:])
+		}
+		if !masked || length > maxMessageSize {
+			c.writeFrame(opClose, closePayload(1002))
+			return errors.New("invalid WebSocket frame")
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return err
+			}
+		case opClose:
+			// The client's status code is echoed, as RFC 6455 asks.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(opClose, payload)
+			return nil
+		}
+	}
+}
+
+func closePayload(code uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, code)
+	return b
+}
+
+func (c *conn) close() {
+	c.conn.Close()
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package websocket pushes the frames being captured to browsers over a
+// WebSocket, for JavaScript H.264 decoders such as JMuxer and Broadway.
+// Each binary message holds one access unit in Annex B format; the first
+// holds the SPS and PPS, and frames follow from the next key frame.
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+)
+
+// maxQueuedFrames is the number of frames queued for each client. Frames
+// are dropped for clients that fall further behind, until the next key
+// frame.
+const maxQueuedFrames = 30
+
+// Stream is the WebSocket stream of one camera. It is a recorder
+// subscriber.
+type Stream struct {
+	mutex   *sync.Mutex
+	clients map[*client]bool
+
+	sps, pps []byte
+}
+
+type client struct {
+	conn   *conn
+	frames chan []byte
+
+	// started is set once a key frame has been queued, as the frames
+	// before it cannot be decoded.
+	started bool
+}
+
+func NewStream() *Stream {
+	return &Stream{
+		mutex:   &sync.Mutex{},
+		clients: make(map[*client]bool),
+	}
+}
+
+// VideoRecorded implements recorder.Subscriber. Only frames are pushed to
+// clients, so recorded segments are ignored.
+func (s *Stream) VideoRecorded(filePath string, created, modified time.Time) {
+}
+
+// FrameCaptured implements recorder.FrameSubscriber.
+func (s *Stream) FrameCaptured(frame recorder.Frame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data := frame.Data
+	if frame.KeyFrame {
+		data = s.withParameterSets(frame)
+	}
+
+	for c := range s.clients {
+		if !c.started && !frame.KeyFrame {
+			continue
+		}
+
+		select {
+		case c.frames <- data:
+			c.started = true
+		default:
+			c.started = false
+		}
+	}
+}
+
+// withParameterSets returns a key frame's data, with the last seen SPS and
+// PPS added if it lacks them, so that clients can start decoding at any
+// key frame.
+func (s *Stream) withParameterSets(frame recorder.Frame) []byte {
+	hasSPS, hasPPS := false, false
+	for _, nal := range frame.NALUnits() {
+		switch nal[0] & 0x1f {
+		case 7:
+			s.sps, hasSPS = append([]byte(nil), nal...), true
+		case 8:
+			s.pps, hasPPS = append([]byte(nil), nal...), true
+		}
+	}
+
+	if (hasSPS && hasPPS) || s.sps == nil || s.pps == nil {
+		return frame.Data
+	}
+
+	data := make([]byte, 0, len(s.sps)+len(s.pps)+len(frame.Data)+8)
+	data = append(data, 0, 0, 0, 1)
+	data = append(data, s.sps...)
+	data = append(data, 0, 0, 0, 1)
+	data = append(data, s.pps...)
+	return append(data, frame.Data...)
+}
+
+// ServeHTTP upgrades the request to a WebSocket and pushes frames until
+// the client goes away.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parameterSets, err := s.parameterSets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := upgrade(w, req)
+	if err != nil {
+		return
+	}
+	defer conn.close()
+
+	c := &client{conn: conn, frames: make(chan []byte, maxQueuedFrames)}
+	c.frames <- parameterSets
+	s.addClient(c)
+	defer s.removeClient(c)
+
+	go c.writeLoop()
+	conn.readLoop()
+}
+
+// parameterSets returns the last seen SPS and PPS in Annex B format.
+func (s *Stream) parameterSets() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.sps == nil || s.pps == nil {
+		return nil, errors.New("live stream is not available")
+	}
+
+	data := make([]byte, 0, len(s.sps)+len(s.pps)+8)
+	data = append(data, 0, 0, 0, 1)
+	data = append(data, s.sps...)
+	data = append(data, 0, 0, 0, 1)
+	return append(data, s.pps...), nil
+}
+
+func (s *Stream) addClient(c *client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.clients[c] = true
+}
+
+func (s *Stream) removeClient(c *client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.clients, c)
+	close(c.frames)
+}
+
+// writeLoop sends the client's frames until it is removed. If a write
+// fails, the connection is closed, which ends the read loop.
+func (c *client) writeLoop() {
+	for frame := range c.frames {
+		if err := c.conn.writeFrame(opBinary, frame); err != nil {
+			c.conn.close()
+			return
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+)
+
+var (
+	testSPS = []byte{0x67, 1, 2}
+	testPPS = []byte{0x68, 3}
+	testIDR = []byte{0x65, 4, 5, 6}
+)
+
+func annexB(nals ...[]byte) []byte {
+	var data []byte
+	for _, nal := range nals {
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, nal...)
+	}
+	return data
+}
+
+// dial connects to the server and completes the opening handshake with
+// the key from the example in RFC 6455.
+func dial(t *testing.T, url string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	netConn, err := net.Dial("tcp", url[len("http://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { netConn.Close() })
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(netConn, "GET /ws HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+
+	reader := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got Sec-WebSocket-Accept %q", accept)
+	}
+
+	return netConn, reader
+}
+
+// readFrame reads an unmasked frame from the server.
+func readFrame(t *testing.T, r io.Reader) (opcode byte, payload []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("got frame header %x", header)
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		io.ReadFull(r, b[:])
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(r, b[:])
+		length = binary.BigEndian.Uint64(b[:])
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// writeFrame writes a masked frame, as clients must.
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func TestServeHTTP(t *testing.T) {
+	s := NewStream()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	// Nothing can be decoded before the parameter sets are known.
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d without parameter sets", resp.StatusCode)
+	}
+
+	s.FrameCaptured(recorder.Frame{KeyFrame: true, Data: annexB(testSPS, testPPS, testIDR)})
+
+	// Plain HTTP requests are rejected.
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for a plain request", resp.StatusCode)
+	}
+
+	netConn, reader := dial(t, server.URL)
+	if opcode, payload := readFrame(t, reader); opcode != opBinary || !bytes.Equal(payload, annexB(testSPS, testPPS)) {
+		t.Fatalf("got first message %x %x, want the parameter sets", opcode, payload)
+	}
+
+	// Pings are answered with the same payload.
+	if err := writeFrame(netConn, opPing, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, payload := readFrame(t, reader); opcode != opPong || string(payload) != "ping" {
+		t.Fatalf("got %x %q, want a pong", opcode, payload)
+	}
+
+	// The client is registered before the first read, so frames that are
+	// captured now are sent.
+	s.FrameCaptured(recorder.Frame{KeyFrame: true, Data: annexB(testIDR)})
+	if opcode, payload := readFrame(t, reader); opcode != opBinary || !bytes.Equal(payload, annexB(testSPS, testPPS, testIDR)) {
+		t.Fatalf("got %x %x, want a key frame", opcode, payload)
+	}
+
+	// Closes are echoed.
+	if err := writeFrame(netConn, opClose, closePayload(1000)); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, payload := readFrame(t, reader); opcode != opClose || !bytes.Equal(payload, closePayload(1000)) {
+		t.Fatalf("got %x %x, want a close", opcode, payload)
+	}
+}
+
+// TestSlowClient checks that a client whose queue overflows gets nothing
+// until the next key frame, which comes with the parameter sets.
+func TestSlowClient(t *testing.T) {
+	s := NewStream()
+	s.FrameCaptured(recorder.Frame{KeyFrame: true, Data: annexB(testSPS, testPPS, testIDR)})
+
+	c := &client{frames: make(chan []byte, maxQueuedFrames)}
+	s.addClient(c)
+
+	// Frames before the first key frame are not queued.
+	nonIDR := annexB([]byte{0x41, 7})
+	s.FrameCaptured(recorder.Frame{Data: nonIDR})
+	if len(c.frames) != 0 {
+		t.Fatalf("queued %d frames before a key frame", len(c.frames))
+	}
+
+	s.FrameCaptured(recorder.Frame{KeyFrame: true, Data: annexB(testIDR)})
+	for i := 0; i < maxQueuedFrames; i++ {
+		s.FrameCaptured(recorder.Frame{Data: nonIDR})
+	}
+	if len(c.frames) != maxQueuedFrames {
+		t.Fatalf("queued %d frames, want %d", len(c.frames), maxQueuedFrames)
+	}
+
+	// The client catches up, but the frames that followed the dropped one
+	// cannot be decoded.
+	for len(c.frames) != 0 {
+		<-c.frames
+	}
+	s.FrameCaptured(recorder.Frame{Data: nonIDR})
+	if len(c.frames) != 0 {
+		t.Fatalf("queued a frame after one was dropped")
+	}
+
+	s.FrameCaptured(recorder.Frame{KeyFrame: true, Data: annexB(testIDR)})
+	s.FrameCaptured(recorder.Frame{Data: nonIDR})
+	if len(c.frames) != 2 {
+		t.Fatalf("queued %d frames after a key frame, want 2", len(c.frames))
+	}
+	if data := <-c.frames; !bytes.Equal(data, annexB(testSPS, testPPS, testIDR)) {
+		t.Errorf("got %x, want the parameter sets and the key frame", data)
+	}
+
+	s.removeClient(c)
+}
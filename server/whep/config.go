@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package whep
+
+import (
+	"errors"
+	"net"
+)
+
+// DefaultMaxPeers is the number of viewers allowed at once if the
+// configuration does not say.
+const DefaultMaxPeers = 4
+
+// Config configures the WebRTC live view.
+type Config struct {
+	// MaxPeers is the number of viewers allowed at once. It defaults to
+	// DefaultMaxPeers; a negative number disables WebRTC.
+	MaxPeers int `json:"maxPeers"`
+
+	// PortMin and PortMax limit the UDP ports used for media, so that
+	// they can be opened in a firewall. Any port is used if they are
+	// zero.
+	PortMin uint16 `json:"portMin"`
+	PortMax uint16 `json:"portMax"`
+
+	// Interfaces lists the network interfaces to offer addresses on.
+	// All interfaces are used if it is empty.
+	Interfaces []string `json:"interfaces"`
+
+	// ICEServers lists STUN server URLs, which are only needed for
+	// viewers outside the local network. Without them, only private and
+	// loopback addresses are offered to viewers.
+	ICEServers []string `json:"iceServers"`
+}
+
+// Enabled returns whether the WebRTC live view is available.
+func (c Config) Enabled() bool {
+	return c.MaxPeers >= 0
+}
+
+func (c Config) maxPeers() int {
+	if c.MaxPeers == 0 {
+		return DefaultMaxPeers
+	}
+
+	return c.MaxPeers
+}
+
+func (c Config) validate() error {
+	if (c.PortMin == 0) != (c.PortMax == 0) || c.PortMax < c.PortMin {
+		return errors.New("invalid WebRTC port range")
+	}
+
+	return nil
+}
+
+// lanOnly returns whether only local addresses are offered.
+func (c Config) lanOnly() bool {
+	return len(c.ICEServers) == 0
+}
+
+// isLocalIP returns whether an address can only be reached from the local
+// network.
+func isLocalIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
@@ -0,0 +1,349 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package whep serves the frames being captured over WebRTC, using the
+// WebRTC-HTTP Egress Protocol (WHEP) for signalling. Frames are sent as
+// they were encoded by the camera, without transcoding.
+package whep
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// maxOfferSize is the largest SDP offer accepted.
+const maxOfferSize = 64 * 1024
+
+type peer struct {
+	connection *webrtc.PeerConnection
+	track      *webrtc.TrackLocalStaticSample
+
+	// started is set once a key frame has been sent, as the frames
+	// before it cannot be decoded.
+	started bool
+}
+
+// Server is a WHEP endpoint for one camera. It is a recorder subscriber.
+type Server struct {
+	config   Config
+	settings webrtc.SettingEngine
+
+	mutex *sync.Mutex
+	peers map[string]*peer
+
+	// Viewers are sent the parameter sets of the latest key frame.
+	sps, pps      []byte
+	lastTime      time.Duration
+	frameDuration time.Duration
+}
+
+func New(config Config) (*Server, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	var settings webrtc.SettingEngine
+	if config.PortMin != 0 {
+		if err := settings.SetEphemeralUDPPortRange(config.PortMin, config.PortMax); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.Interfaces) != 0 {
+		interfaces := config.Interfaces
+		settings.SetInterfaceFilter(func(name string) bool {
+			for _, i := range interfaces {
+				if i == name {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if config.lanOnly() {
+		settings.SetIPFilter(isLocalIP)
+	}
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6})
+	settings.SetIncludeLoopbackCandidate(true)
+
+	return &Server{
+		config:   config,
+		settings: settings,
+		mutex:    &sync.Mutex{},
+		peers:    make(map[string]*peer),
+	}, nil
+}
+
+// VideoRecorded implements recorder.Subscriber. Only frames are sent to
+// viewers, so recorded segments are ignored.
+func (s *Server) VideoRecorded(filePath string, created, modified time.Time) {
+}
+
+// FrameCaptured implements recorder.FrameSubscriber.
+func (s *Server) FrameCaptured(frame recorder.Frame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Frame times start over when the capture process is restarted, in
+	// which case the last frame is assumed to have the usual duration.
+	if frame.Time > s.lastTime {
+		s.frameDuration = frame.Time - s.lastTime
+	}
+	s.lastTime = frame.Time
+
+	data := s.withParameterSets(frame)
+	if len(s.peers) == 0 || s.frameDuration == 0 {
+		return
+	}
+
+	sample := media.Sample{Data: data, Duration: s.frameDuration}
+	for _, p := range s.peers {
+		if !p.started {
+			if !frame.KeyFrame {
+				continue
+			}
+			p.started = true
+		}
+
+		// Errors only mean that the viewer is going away, which is
+		// handled when the connection state changes.
+		p.track.WriteSample(sample)
+	}
+}
+
+// withParameterSets returns the frame's data, with the last seen SPS and
+// PPS added to key frames that lack them, so that viewers can start
+// decoding at any key frame.
+func (s *Server) withParameterSets(frame recorder.Frame) []byte {
+	hasSPS, hasPPS := false, false
+	for _, nal := range frame.NALUnits() {
+		switch nal[0] & 0x1f {
+		case 7:
+			s.sps, hasSPS = append([]byte(nil), nal...), true
+		case 8:
+			s.pps, hasPPS = append([]byte(nil), nal...), true
+		}
+	}
+
+	if !frame.KeyFrame || (hasSPS && hasPPS) || s.sps == nil || s.pps == nil {
+		return frame.Data
+	}
+
+	data := make([]byte, 0, len(s.sps)+len(s.pps)+len(frame.Data)+8)
+	data = append(data, 0, 0, 0, 1)
+	data = append(data, s.sps...)
+	data = append(data, 0, 0, 0, 1)
+	data = append(data, s.pps...)
+	return append(data, frame.Data...)
+}
+
+// Serve serves the WHEP endpoint if p is empty, or the WHEP session
+// resource with the given ID. Sessions are created by POSTing an SDP offer
+// to the endpoint and ended with a DELETE request to the resource. All ICE
+// candidates are included in the answer, so trickle ICE is not supported.
+func (s *Server) Serve(w http.ResponseWriter, req *http.Request, p string) {
+	switch {
+	case len(p) == 0 && req.Method == http.MethodPost:
+		s.serveOffer(w, req)
+	case len(p) == 0:
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case req.Method == http.MethodDelete:
+		if !s.closePeer(p) {
+			http.NotFound(w, req)
+		}
+	default:
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveOffer(w http.ResponseWriter, req *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/sdp" {
+		http.Error(w, "Offer must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, p, err := s.addPeer()
+	if err != nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	answer, err := s.answer(p, string(offer), req)
+	if err != nil {
+		s.closePeer(id)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", strings.TrimSuffix(req.URL.Path, "/")+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+// addPeer creates a peer connection that sends H.264 in the profile of
+// the frames being captured, if the peer limit has not been reached.
+func (s *Server) addPeer() (string, *peer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.peers) >= s.config.maxPeers() {
+		return "", nil, errors.New("too many viewers")
+	}
+	if len(s.sps) < 4 {
+		return "", nil, errors.New("live stream is not available")
+	}
+
+	codec := webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeH264,
+		ClockRate: 90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" +
+			hex.EncodeToString(s.sps[1:4]),
+		RTCPFeedback: []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}},
+	}
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: codec, PayloadType: 102}, webrtc.RTPCodecTypeVideo); err != nil {
+		return "", nil, err
+	}
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptors); err != nil {
+		return "", nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptors),
+		webrtc.WithSettingEngine(s.settings))
+
+	var configuration webrtc.Configuration
+	if len(s.config.ICEServers) != 0 {
+		configuration.ICEServers = []webrtc.ICEServer{{URLs: s.config.ICEServers}}
+	}
+	connection, err := api.NewPeerConnection(configuration)
+	if err != nil {
+		return "", nil, err
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(codec, "video", "pi-camera-go")
+	if err != nil {
+		connection.Close()
+		return "", nil, err
+	}
+	sender, err := connection.AddTrack(track)
+	if err != nil {
+		connection.Close()
+		return "", nil, err
+	}
+
+	// RTCP has to be read for the interceptors to handle it.
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	id, err := newID()
+	if err != nil {
+		connection.Close()
+		return "", nil, err
+	}
+
+	p := &peer{connection: connection, track: track}
+	connection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.closePeer(id)
+		}
+	})
+	s.peers[id] = p
+
+	return id, p, nil
+}
+
+// answer answers the offer once all local ICE candidates are known.
+func (s *Server) answer(p *peer, offer string, req *http.Request) (string, error) {
+	err := p.connection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", err
+	}
+
+	answer, err := p.connection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gatheringComplete := webrtc.GatheringCompletePromise(p.connection)
+	if err := p.connection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	select {
+	case <-gatheringComplete:
+	case <-req.Context().Done():
+		return "", req.Context().Err()
+	}
+
+	return p.connection.LocalDescription().SDP, nil
+}
+
+// closePeer closes and removes the peer with the given ID, returning
+// false if there is none.
+func (s *Server) closePeer(id string) bool {
+	s.mutex.Lock()
+	p, ok := s.peers[id]
+	delete(s.peers, id)
+	s.mutex.Unlock()
+
+	if ok {
+		p.connection.Close()
+	}
+	return ok
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
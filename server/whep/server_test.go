@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2018 Josh A. Beam
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *   1. Redistributions of source code must retain the above copyright
+ *      notice, this list of conditions and the following disclaimer.
+ *   2. Redistributions in binary form must reproduce the above copyright
+ *      notice, this list of conditions and the following disclaimer in the
+ *      documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+ * OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+ * IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+ * OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+ * OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+ * ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package whep
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshb/pi-camera-go/server/recorder"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// startServer serves a WHEP endpoint at /whep for frames from the mock
+// recorder, offering only loopback addresses.
+func startServer(t *testing.T, config Config) (*Server, recorder.Recorder, string) {
+	t.Helper()
+	config.Interfaces = []string{"lo"}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := recorder.NewMock()
+	settings := recorder.DefaultSettings
+	settings.Width, settings.Height, settings.Framerate = 64, 64, 10
+	if err := r.Configure(settings); err != nil {
+		t.Fatal(err)
+	}
+	r.AddSubscriber(s)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.Serve(w, req, strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/whep"), "/"))
+	}))
+	t.Cleanup(httpServer.Close)
+
+	return s, r, httpServer.URL + "/whep"
+}
+
+// newClient creates a peer connection that receives video over loopback
+// and returns the offer to send.
+func newClient(t *testing.T) (*webrtc.PeerConnection, string) {
+	t.Helper()
+	var settings webrtc.SettingEngine
+	settings.SetInterfaceFilter(func(name string) bool { return name == "lo" })
+	settings.SetIncludeLoopbackCandidate(true)
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settings))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatheringComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatheringComplete
+
+	return pc, pc.LocalDescription().SDP
+}
+
+func post(t *testing.T, url, offer string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(url, "application/sdp", strings.NewReader(offer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	_, r, url := startServer(t, Config{MaxPeers: 1})
+	pc, offer := newClient(t)
+
+	// There are no parameter sets to offer until a frame has arrived.
+	if resp := post(t, url, offer); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d before any frames", resp.StatusCode)
+	}
+
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	time.Sleep(300 * time.Millisecond)
+
+	if resp, err := http.Post(url, "text/plain", strings.NewReader(offer)); err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("got %v, %v for an offer that is not SDP", resp, err)
+	}
+
+	// The client should receive the SPS, PPS and key frame first.
+	nalTypes := make(chan byte, 1024)
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		depacketizer := &codecs.H264Packet{}
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			data, err := depacketizer.Unmarshal(packet.Payload)
+			if err != nil {
+				continue
+			}
+			for _, nal := range bytes.Split(data, []byte{0, 0, 0, 1}) {
+				if len(nal) != 0 {
+					select {
+					case nalTypes <- nal[0] & 0x1f:
+					default:
+					}
+				}
+			}
+		}
+	})
+
+	resp := post(t, url, offer)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != "application/sdp" {
+		t.Fatalf("got status %d for an offer", resp.StatusCode)
+	}
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(answer), "a=candidate:") || !strings.Contains(string(answer), "H264/90000") {
+		t.Errorf("answer lacks candidates or H.264:\n%s", answer)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var received []byte
+	for len(received) < 3 || received[0] != 7 {
+		select {
+		case nalType := <-nalTypes:
+			received = append(received, nalType)
+		case <-ctx.Done():
+			t.Fatalf("received NAL units %v", received)
+		}
+	}
+	if received[1] != 8 || received[2] != 5 {
+		t.Errorf("stream started with NAL units %v, want SPS, PPS and IDR", received[:3])
+	}
+
+	// The limit of one viewer has been reached.
+	_, second := newClient(t)
+	if resp := post(t, url, second); resp.StatusCode != http.StatusServiceUnavailable || len(resp.Header.Get("Retry-After")) == 0 {
+		t.Errorf("got status %d for a viewer over the limit", resp.StatusCode)
+	}
+
+	// Ending the session frees its place.
+	location := resp.Header.Get("Location")
+	for i, want := range []int{http.StatusOK, http.StatusNotFound} {
+		req, _ := http.NewRequest(http.MethodDelete, url[:strings.Index(url, "/whep")]+location, nil)
+		deleteResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleteResp.Body.Close()
+		if deleteResp.StatusCode != want {
+			t.Errorf("DELETE %d got status %d, want %d", i+1, deleteResp.StatusCode, want)
+		}
+	}
+	if resp := post(t, url, second); resp.StatusCode != http.StatusCreated {
+		t.Errorf("got status %d after the session ended", resp.StatusCode)
+	}
+}